@@ -2,100 +2,251 @@ package gcache
 
 import (
 	"context"
-	"encoding/json"
-	"github.com/mailgun/groupcache/v2"
-	"github.com/zerjioang/zgo/timer"
-	"log"
+	"crypto/tls"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
 type CachePeer struct {
+	config Config
+	pool   *peerPool
+	// mu guards the lifecycle fields below
+	mu          sync.RWMutex
 	cacheServer *http.Server
-	cacheGroup  *groupcache.Group
+	groups      map[string]*Group
+	listener    net.Listener
+	ready       bool
+	serveErr    error
+	// done is closed when the HTTP server stops serving
+	done chan struct{}
 }
 
-func (peer *CachePeer) Stop() error {
-	return peer.cacheServer.Shutdown(context.Background())
-}
-
-func (peer *CachePeer) Set(id string, value interface{}) error {
-	// create a timeout call to check if data is in the cache
-	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
-	defer cancel()
-
-	// Set the value in the groupcache to expire after 5 minutes
-	raw, err := json.Marshal(value)
+// NewCachePeer creates a new cache peer with given configuration.
+// The peer does not serve nor cache anything until it is started.
+func NewCachePeer(config Config) (*CachePeer, error) {
+	cfg, err := config.withDefaults()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return peer.cacheGroup.Set(ctx, id, raw, timer.Time().Add(time.Minute*5), true)
+	peer := &CachePeer{}
+	if err := peer.init(cfg); err != nil {
+		return nil, err
+	}
+	return peer, nil
 }
 
-func (peer *CachePeer) Get(itemId string, dest interface{}) error {
-	// create a timeout call to check if data is in the cache
-	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
-	defer cancel()
-	var data []byte
-	reader := groupcache.AllocatingByteSliceSink(&data)
-	if err := peer.cacheGroup.Get(ctx, itemId, reader); err != nil {
-		return err
+func (peer *CachePeer) init(cfg Config) error {
+	peer.config = cfg
+	peer.groups = map[string]*Group{}
+	for _, g := range append([]GroupConfig{{Name: cfg.GroupName}}, cfg.Groups...) {
+		if _, err := peer.addGroup(g); err != nil {
+			return err
+		}
 	}
-	// handle readed data
-	if !(data == nil || len(data) == 0) {
-		return json.Unmarshal(data, dest)
+	transport := cfg.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+		if cfg.TLS != nil {
+			transport = cfg.TLS.transport()
+		}
 	}
+	peer.pool = newPeerPool(cfg.SelfURL, cfg.BasePath, transport)
+	peer.pool.Set(cfg.Peers...)
 	return nil
 }
 
+// SetPeers replaces the list of peers of the cluster. It can be called at
+// any time, for example when the cluster is scaled. The list should include
+// our own SelfURL, otherwise every key is considered to be owned by a remote peer.
+func (peer *CachePeer) SetPeers(peers ...string) {
+	peer.pool.Set(peers...)
+}
+
+// Peers returns the sorted list of peers of the cluster
+func (peer *CachePeer) Peers() []string {
+	return peer.pool.Peers()
+}
+
+// Owner returns the URL of the peer that owns given key
+func (peer *CachePeer) Owner(key string) string {
+	return peer.pool.Owner(key)
+}
+
+// Config returns the configuration of the peer with the defaults applied
+func (peer *CachePeer) Config() Config {
+	return peer.config
+}
+
+// Set stores the value in the default group using the default TTL
+func (peer *CachePeer) Set(id string, value interface{}) error {
+	return peer.SetWithTTL(id, value, peer.config.DefaultTTL)
+}
+
+// SetWithTTL stores the value in the default group to expire after given duration
+func (peer *CachePeer) SetWithTTL(id string, value interface{}, ttl time.Duration) error {
+	return peer.defaultGroup().SetWithTTL(context.Background(), id, value, ttl)
+}
+
+func (peer *CachePeer) Get(itemId string, dest interface{}) error {
+	return peer.defaultGroup().Get(context.Background(), itemId, dest)
+}
+
 func (peer *CachePeer) Remove(itemId string) error {
-	// create a timeout call to check if data is in the cache
-	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
-	defer cancel()
-	// Remove the key from the groupcache
-	return peer.cacheGroup.Remove(ctx, itemId)
+	return peer.defaultGroup().Remove(context.Background(), itemId)
 }
 
-func (peer *CachePeer) Start() {
-	// NOTE: It is important to pass the same peer `http://192.168.1.1:8080` to `NewHTTPPoolOpts`
-	// which is provided to `pool.Set()` so the pool can identify which of the peers is our instance.
-	// The pool will not operate correctly if it can't identify which peer is our instance.
+// defaultGroup returns the group named after Config.GroupName
+func (peer *CachePeer) defaultGroup() *Group {
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	if peer.groups == nil {
+		// zero value peer that was never started
+		return &Group{peer: peer}
+	}
+	return peer.groups[peer.config.GroupName]
+}
 
-	// Pool keeps track of peers in our cluster and identifies which peer owns a key.
-	me := "http://0.0.0.0:5000"
-	pool := groupcache.NewHTTPPoolOpts(me, &groupcache.HTTPPoolOptions{})
+// Start binds the peer HTTP server, creates the cache groups and starts serving
+// peer requests in the background. Bind errors are returned synchronously.
+// A zero value CachePeer is started with the default configuration.
+func (peer *CachePeer) Start(ctx context.Context) error {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.pool == nil {
+		cfg, err := Config{}.withDefaults()
+		if err != nil {
+			return err
+		}
+		if err := peer.init(cfg); err != nil {
+			return err
+		}
+	}
+	if peer.cacheServer != nil {
+		return ErrAlreadyStarted
+	}
+	cfg := peer.config
 
-	knownPeers := false
-	if knownPeers {
-		// Whenever peers change
-		//
-		// Add more peers to the cluster You MUST Ensure our instance is included in this list else
-		// determining who owns the key accross the cluster will not be consistent, and the pool won't
-		// be able to determine if our instance owns the key.
-		pool.Set("http://192.168.1.1:8080", "http://192.168.1.2:8080", "http://192.168.1.3:8080")
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	if cfg.TLS != nil {
+		listener = tls.NewListener(listener, cfg.TLS.ServerConfig())
 	}
 
+	mux := http.NewServeMux()
+	mux.Handle(cfg.BasePath, http.StripPrefix(cfg.BasePath, peer.invalidating(serverHandler)))
+	mux.HandleFunc(cfg.HealthPath, peer.serveHealth)
+	mux.HandleFunc(cfg.ReadyPath, peer.serveReady)
 	server := &http.Server{
-		Addr:    "0.0.0.0:5000",
-		Handler: pool,
+		Handler: mux,
+	}
+
+	// Create the groupcache group of every registered group
+	for _, g := range peer.groups {
+		g.create()
 	}
+
 	peer.cacheServer = server
+	peer.listener = listener
+	peer.serveErr = nil
+	peer.done = make(chan struct{})
+	peer.ready = true
 	// Start the HTTP server to listen for peer requests from the groupcache
-	go func() {
-		log.Println("Cache server started....")
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-
-	// Create a new group cache with a max cache size of 64Mb
-	maxSize := int64(64 << 20)
-	group := groupcache.NewGroup("cache", maxSize, groupcache.GetterFunc(
-		func(ctx context.Context, id string, dest groupcache.Sink) error {
-			log.Printf("cache item with KEY=%s not found in local peer", id)
-			// TODO compute the requested data and store in cache
-			return nil
-		},
-	))
-	peer.cacheGroup = group
+	go peer.serve(server, listener, peer.done)
+	return nil
+}
+
+func (peer *CachePeer) serve(server *http.Server, listener net.Listener, done chan struct{}) {
+	defer close(done)
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		peer.mu.Lock()
+		peer.serveErr = err
+		peer.ready = false
+		peer.mu.Unlock()
+	}
+}
+
+// Stop gracefully stops the peer. It stops reporting itself as ready,
+// waits for the in-flight peer requests to finish and removes the cache
+// groups, dropping their content. If ctx expires before every request is
+// drained, the remaining connections are closed and the context error
+// is returned. A stopped peer can be started again.
+func (peer *CachePeer) Stop(ctx context.Context) error {
+	peer.mu.Lock()
+	server, done := peer.cacheServer, peer.done
+	if server == nil {
+		peer.mu.Unlock()
+		return ErrNotStarted
+	}
+	peer.ready = false
+	peer.mu.Unlock()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		_ = server.Close()
+	}
+	<-done
+
+	peer.mu.Lock()
+	for _, g := range peer.groups {
+		g.destroy()
+	}
+	peer.cacheServer = nil
+	peer.listener = nil
+	peer.mu.Unlock()
+	return err
+}
+
+// Restart stops the peer and starts it again with an empty cache
+func (peer *CachePeer) Restart(ctx context.Context) error {
+	if err := peer.Stop(ctx); err != nil && err != ErrNotStarted {
+		return err
+	}
+	return peer.Start(ctx)
+}
+
+// Addr returns the address the peer is listening on, or nil if it is not started
+func (peer *CachePeer) Addr() net.Addr {
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	if peer.listener == nil {
+		return nil
+	}
+	return peer.listener.Addr()
+}
+
+// Ready returns true if the peer is started and serving peer requests
+func (peer *CachePeer) Ready() bool {
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	return peer.ready
+}
+
+// Err returns the error that made the peer HTTP server stop serving, if any
+func (peer *CachePeer) Err() error {
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	return peer.serveErr
+}
+
+// serveHealth reports whether the peer HTTP server is alive
+func (peer *CachePeer) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	if err := peer.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+// serveReady reports whether the peer accepts cache requests
+func (peer *CachePeer) serveReady(w http.ResponseWriter, _ *http.Request) {
+	if !peer.Ready() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ready"))
 }
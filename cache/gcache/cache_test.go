@@ -1,15 +1,22 @@
 package gcache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestBuildCache(t *testing.T) {
 	t.Run("example", func(t *testing.T) {
 		var peer CachePeer
-		peer.Start()
+		assert.NoError(t, peer.Start(context.Background()))
 		// make a get request to the cache system
 
 		var user int64 = 56
@@ -29,6 +36,168 @@ func TestBuildCache(t *testing.T) {
 			log.Fatal(err)
 		}
 
-		defer peer.Stop()
+		defer peer.Stop(context.Background())
+	})
+	t.Run("config", func(t *testing.T) {
+		_, err := NewCachePeer(Config{SelfURL: "127.0.0.1:5000"})
+		assert.Equal(t, errInvalidSelfURL, err)
+
+		peer, err := NewCachePeer(Config{SelfURL: "http://127.0.0.1:5100"})
+		assert.NoError(t, err)
+		cfg := peer.Config()
+		assert.Equal(t, "127.0.0.1:5100", cfg.ListenAddr)
+		assert.Equal(t, DefaultGroupName, cfg.GroupName)
+		assert.Equal(t, DefaultTTL, cfg.DefaultTTL)
+		assert.Equal(t, DefaultTimeout, cfg.GetTimeout)
+	})
+	t.Run("two-peers", func(t *testing.T) {
+		urls := []string{"http://127.0.0.1:5101", "http://127.0.0.1:5102"}
+		a, err := NewCachePeer(Config{SelfURL: urls[0], Peers: urls, GroupName: "users"})
+		assert.NoError(t, err)
+		b, err := NewCachePeer(Config{SelfURL: urls[1], GroupName: "users", GetTimeout: time.Second})
+		assert.NoError(t, err)
+		// peers can be set after creation
+		b.SetPeers(urls...)
+		assert.Equal(t, urls, b.Peers())
+		assert.NoError(t, a.Start(context.Background()))
+		defer a.Stop(context.Background())
+		assert.NoError(t, b.Start(context.Background()))
+		defer b.Stop(context.Background())
+
+		// find a key owned by b, and store it from a
+		var key string
+		for i := 0; ; i++ {
+			key = fmt.Sprintf("user-%d", i)
+			if _, remote := a.pool.PickPeer(key); remote {
+				break
+			}
+		}
+		assert.NoError(t, a.Set(key, "john"))
+		var name string
+		assert.NoError(t, b.Get(key, &name))
+		assert.Equal(t, "john", name)
+	})
+}
+
+func TestLoader(t *testing.T) {
+	errBoom := errors.New("boom")
+	var loads int32
+	loader := LoaderFunc(func(ctx context.Context, key string) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		switch key {
+		case "missing":
+			return nil, ErrNotFound
+		case "broken":
+			return nil, errBoom
+		}
+		return "value of " + key, nil
+	})
+	urls := []string{"http://127.0.0.1:5103", "http://127.0.0.1:5104"}
+	a, _ := NewCachePeer(Config{SelfURL: urls[0], Peers: urls, GroupName: "loader", Loader: loader})
+	b, _ := NewCachePeer(Config{SelfURL: urls[1], Peers: urls, GroupName: "loader", Loader: loader})
+	assert.NoError(t, a.Start(context.Background()))
+	defer a.Stop(context.Background())
+	assert.NoError(t, b.Start(context.Background()))
+	defer b.Stop(context.Background())
+
+	t.Run("cold-keys-are-loaded", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			var v string
+			key := fmt.Sprintf("key-%d", i)
+			assert.NoError(t, a.Get(key, &v))
+			assert.Equal(t, "value of "+key, v)
+		}
+		assert.Equal(t, int32(10), atomic.LoadInt32(&loads))
+		// loaded values are cached by their owner
+		var v string
+		assert.NoError(t, b.Get("key-0", &v))
+		assert.Equal(t, int32(10), atomic.LoadInt32(&loads))
+	})
+	t.Run("errors-reach-the-caller", func(t *testing.T) {
+		var v string
+		assert.True(t, errors.Is(a.Get("missing", &v), ErrNotFound))
+		assert.True(t, errors.Is(b.Get("broken", &v), errBoom))
+	})
+	t.Run("no-loader", func(t *testing.T) {
+		peer, _ := NewCachePeer(Config{SelfURL: "http://127.0.0.1:5105", GroupName: "loader"})
+		assert.NoError(t, peer.Start(context.Background()))
+		defer peer.Stop(context.Background())
+		var v string
+		assert.Equal(t, ErrNotFound, peer.Get("cold", &v))
+	})
+}
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	loader := LoaderFunc(func(ctx context.Context, key string) (interface{}, error) {
+		if key == "slow" {
+			<-release
+		}
+		return key, nil
+	})
+	peer, _ := NewCachePeer(Config{SelfURL: "http://127.0.0.1:5106", GroupName: "lifecycle", Loader: loader})
+	t.Run("not-started", func(t *testing.T) {
+		var v string
+		assert.Equal(t, ErrNotStarted, peer.Get("key", &v))
+		assert.Equal(t, ErrNotStarted, peer.Stop(ctx))
+		assert.Nil(t, peer.Addr())
+		assert.False(t, peer.Ready())
+	})
+	t.Run("start", func(t *testing.T) {
+		assert.NoError(t, peer.Start(ctx))
+		assert.Equal(t, ErrAlreadyStarted, peer.Start(ctx))
+		assert.True(t, peer.Ready())
+		assert.Equal(t, "127.0.0.1:5106", peer.Addr().String())
+	})
+	t.Run("bind-errors-are-synchronous", func(t *testing.T) {
+		other, _ := NewCachePeer(Config{SelfURL: "http://127.0.0.1:5106", GroupName: "lifecycle-other"})
+		assert.Error(t, other.Start(ctx))
+		assert.False(t, other.Ready())
+	})
+	t.Run("health-and-ready", func(t *testing.T) {
+		for _, path := range []string{DefaultHealthPath, DefaultReadyPath} {
+			res, err := http.Get("http://127.0.0.1:5106" + path)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			_ = res.Body.Close()
+		}
+	})
+	t.Run("stop-drains-in-flight-requests", func(t *testing.T) {
+		// the slow request is served by the peer HTTP server
+		result := make(chan error, 1)
+		go func() {
+			res, err := http.Get("http://127.0.0.1:5106" + DefaultBasePath + groupName(peer.Config().SelfURL, "lifecycle") + "/slow")
+			if err == nil {
+				if res.StatusCode != http.StatusOK {
+					err = fmt.Errorf("unexpected status %d", res.StatusCode)
+				}
+				_ = res.Body.Close()
+			}
+			result <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- peer.Stop(ctx)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		assert.False(t, peer.Ready())
+		close(release)
+		assert.NoError(t, <-result)
+		assert.NoError(t, <-stopped)
+		_, err := http.Get("http://127.0.0.1:5106" + DefaultHealthPath)
+		assert.Error(t, err)
+	})
+	t.Run("restart", func(t *testing.T) {
+		assert.NoError(t, peer.Start(ctx))
+		assert.NoError(t, peer.Set("key", "value"))
+		assert.NoError(t, peer.Restart(ctx))
+		defer peer.Stop(ctx)
+		assert.True(t, peer.Ready())
+		// the cache is empty after a restart, so the value is loaded again
+		var v string
+		assert.NoError(t, peer.Get("key", &v))
+		assert.Equal(t, "key", v)
 	})
 }
@@ -0,0 +1,152 @@
+package gcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// codec identifiers embedded as first byte of every cached value
+const (
+	codecJSON byte = iota + 1
+	codecJSONIter
+	codecGob
+	codecRaw
+)
+
+var (
+	// ErrCodecMismatch is returned when a cached value was
+	// encoded with a different codec than the one decoding it
+	ErrCodecMismatch = errors.New("gcache: value was encoded with a different codec")
+	errEmptyValue    = errors.New("gcache: empty encoded value")
+	errRawType       = errors.New("gcache: raw codec only supports []byte and string values")
+)
+
+// Codec encodes the values stored in the cache. Every codec has a unique
+// identifier that is embedded in the encoded values, so that reading a value
+// with a different codec is detected instead of silently decoded wrong.
+type Codec interface {
+	// ID returns the unique identifier of the codec
+	ID() byte
+	// Name returns the human readable name of the codec
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes values using encoding/json
+	JSONCodec Codec = jsonCodec{}
+	// JSONIterCodec encodes values using jsoniter fastest configuration, as io.ToJSON does
+	JSONIterCodec Codec = jsonIterCodec{}
+	// GobCodec encodes values using encoding/gob. It keeps the type fidelity
+	// of values such as time.Time, but interface values must be registered with gob.
+	GobCodec Codec = gobCodec{}
+	// RawCodec stores []byte and string values as they are
+	RawCodec Codec = rawCodec{}
+)
+
+// codecNames is used to report the codec found in mismatched values
+var codecNames = map[byte]string{
+	codecJSON:     "json",
+	codecJSONIter: "jsoniter",
+	codecGob:      "gob",
+	codecRaw:      "raw",
+}
+
+// encode marshals v and prefixes the result with the codec identifier
+func encode(c Codec, v interface{}) ([]byte, error) {
+	raw, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(raw)+1)
+	out = append(out, c.ID())
+	return append(out, raw...), nil
+}
+
+// decode checks the codec identifier of data and unmarshals it into v
+func decode(c Codec, data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errEmptyValue
+	}
+	if data[0] != c.ID() {
+		name, found := codecNames[data[0]]
+		if !found {
+			name = fmt.Sprintf("unknown (%d)", data[0])
+		}
+		return fmt.Errorf("%w: found %s, expected %s", ErrCodecMismatch, name, c.Name())
+	}
+	return c.Unmarshal(data[1:], v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte                                   { return codecJSON }
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type jsonIterCodec struct{}
+
+var jsoniterAPI = jsoniter.ConfigFastest
+
+func (jsonIterCodec) ID() byte                              { return codecJSONIter }
+func (jsonIterCodec) Name() string                          { return "jsoniter" }
+func (jsonIterCodec) Marshal(v interface{}) ([]byte, error) { return jsoniterAPI.Marshal(v) }
+func (jsonIterCodec) Unmarshal(data []byte, v interface{}) error {
+	return jsoniterAPI.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte     { return codecGob }
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) ID() byte     { return codecRaw }
+func (rawCodec) Name() string { return "raw" }
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case []byte:
+		return value, nil
+	case *[]byte:
+		return *value, nil
+	case string:
+		return []byte(value), nil
+	case *string:
+		return []byte(*value), nil
+	default:
+		return nil, errRawType
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch dst := v.(type) {
+	case *[]byte:
+		*dst = append((*dst)[:0], data...)
+	case *string:
+		*dst = string(data)
+	default:
+		return errRawType
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package gcache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type codecItem struct {
+	Name    string
+	Created time.Time
+	Payload []byte
+}
+
+func TestCodecs(t *testing.T) {
+	item := codecItem{
+		Name:    "john",
+		Created: time.Date(2021, 10, 22, 13, 59, 29, 123456789, time.UTC),
+		Payload: []byte{0, 1, 2, 255},
+	}
+	for _, c := range []Codec{JSONCodec, JSONIterCodec, GobCodec} {
+		t.Run(c.Name(), func(t *testing.T) {
+			raw, err := encode(c, item)
+			assert.NoError(t, err)
+			assert.Equal(t, c.ID(), raw[0])
+			var out codecItem
+			assert.NoError(t, decode(c, raw, &out))
+			assert.Equal(t, item.Name, out.Name)
+			assert.True(t, item.Created.Equal(out.Created))
+			assert.Equal(t, item.Payload, out.Payload)
+		})
+	}
+	t.Run("raw", func(t *testing.T) {
+		raw, err := encode(RawCodec, []byte("hello"))
+		assert.NoError(t, err)
+		var b []byte
+		assert.NoError(t, decode(RawCodec, raw, &b))
+		assert.Equal(t, []byte("hello"), b)
+		var s string
+		assert.NoError(t, decode(RawCodec, raw, &s))
+		assert.Equal(t, "hello", s)
+		_, err = encode(RawCodec, 42)
+		assert.Equal(t, errRawType, err)
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		raw, err := encode(GobCodec, item)
+		assert.NoError(t, err)
+		var out codecItem
+		err = decode(JSONCodec, raw, &out)
+		assert.True(t, errors.Is(err, ErrCodecMismatch))
+		assert.Contains(t, err.Error(), "found gob, expected json")
+		assert.Equal(t, errEmptyValue, decode(JSONCodec, nil, &out))
+	})
+}
@@ -0,0 +1,137 @@
+package gcache
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultSelfURL is the base URL other peers use to reach this peer
+	DefaultSelfURL = "http://0.0.0.0:5000"
+	// DefaultGroupName is the name of the default cache group
+	DefaultGroupName = "cache"
+	// DefaultCacheBytes is the max cache size of a group: 64Mb
+	DefaultCacheBytes = int64(64 << 20)
+	// DefaultTTL is the expiration of the items stored with Set
+	DefaultTTL = 5 * time.Minute
+	// DefaultTimeout is the timeout of every cache operation
+	DefaultTimeout = 500 * time.Millisecond
+	// DefaultBasePath is the HTTP path that serves peer requests
+	DefaultBasePath = "/_groupcache/"
+	// DefaultHealthPath is the HTTP path that reports the peer health
+	DefaultHealthPath = "/_gcache/health"
+	// DefaultReadyPath is the HTTP path that reports the peer readiness
+	DefaultReadyPath = "/_gcache/ready"
+)
+
+var (
+	// ErrNotStarted is returned when using a peer that is not started
+	ErrNotStarted = errors.New("gcache: peer is not started")
+	// ErrAlreadyStarted is returned when starting a peer twice
+	ErrAlreadyStarted = errors.New("gcache: peer is already started")
+	errInvalidSelfURL = errors.New("gcache: self url must be a valid absolute http url")
+)
+
+// Config holds the settings of a CachePeer.
+// Zero values are replaced by their defaults.
+type Config struct {
+	// SelfURL is the base URL of this peer, for example "http://10.0.0.1:5000".
+	// It must be exactly the same value used in the Peers list of every peer
+	// of the cluster, so that the pool can identify which peer is our instance.
+	SelfURL string
+	// ListenAddr is the address the peer HTTP server listens on.
+	// It defaults to the host of SelfURL.
+	ListenAddr string
+	// BasePath is the HTTP path that serves peer requests
+	BasePath string
+	// HealthPath is the HTTP path that reports the peer health
+	HealthPath string
+	// ReadyPath is the HTTP path that reports the peer readiness
+	ReadyPath string
+	// Peers is the initial list of peer base URLs of the cluster.
+	// If not empty, it should include SelfURL.
+	Peers []string
+	// GroupName is the name of the default cache group, used by
+	// the Get, Set and Remove methods of the peer
+	GroupName string
+	// Groups are additional named groups created with the peer.
+	// Their zero fields default to the values of this config.
+	Groups []GroupConfig
+	// CacheBytes is the max size of every cache group in bytes
+	CacheBytes int64
+	// DefaultTTL is the expiration of the items stored with Set
+	DefaultTTL time.Duration
+	// GetTimeout is the timeout of Get calls
+	GetTimeout time.Duration
+	// SetTimeout is the timeout of Set calls
+	SetTimeout time.Duration
+	// RemoveTimeout is the timeout of Remove calls
+	RemoveTimeout time.Duration
+	// Loader computes the values missing in the cache. If nil,
+	// Get returns ErrNotFound for the keys that are not cached.
+	Loader Loader
+	// LocalTTL enables an in-process L1 cache in front of every group,
+	// keeping the values read by this peer for given duration. It should
+	// be short, since peers are only partially notified of changes.
+	LocalTTL time.Duration
+	// TLS enables mutual TLS between peers. SelfURL and the
+	// peer URLs must use the https scheme.
+	TLS *PeerTLS
+	// Transport is used to call other peers. It defaults to
+	// http.DefaultTransport, or to a transport using the client
+	// config of TLS when set.
+	Transport http.RoundTripper
+	// Codec encodes the cached values. It defaults to JSONCodec.
+	// Every peer of the cluster must use the same codec.
+	Codec Codec
+}
+
+// withDefaults returns a copy of the config with the defaults applied
+func (c Config) withDefaults() (Config, error) {
+	if c.SelfURL == "" {
+		c.SelfURL = DefaultSelfURL
+	}
+	u, err := url.Parse(c.SelfURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return c, errInvalidSelfURL
+	}
+	if c.TLS != nil && u.Scheme != "https" {
+		return c, errTLSScheme
+	}
+	if c.ListenAddr == "" {
+		c.ListenAddr = u.Host
+	}
+	if c.BasePath == "" {
+		c.BasePath = DefaultBasePath
+	}
+	if c.HealthPath == "" {
+		c.HealthPath = DefaultHealthPath
+	}
+	if c.ReadyPath == "" {
+		c.ReadyPath = DefaultReadyPath
+	}
+	if c.GroupName == "" {
+		c.GroupName = DefaultGroupName
+	}
+	if c.CacheBytes == 0 {
+		c.CacheBytes = DefaultCacheBytes
+	}
+	if c.DefaultTTL == 0 {
+		c.DefaultTTL = DefaultTTL
+	}
+	if c.GetTimeout == 0 {
+		c.GetTimeout = DefaultTimeout
+	}
+	if c.SetTimeout == 0 {
+		c.SetTimeout = DefaultTimeout
+	}
+	if c.RemoveTimeout == 0 {
+		c.RemoveTimeout = DefaultTimeout
+	}
+	if c.Codec == nil {
+		c.Codec = JSONCodec
+	}
+	return c, nil
+}
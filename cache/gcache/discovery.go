@@ -0,0 +1,216 @@
+package gcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDiscoveryInterval is the polling interval of the file and DNS providers
+const DefaultDiscoveryInterval = 10 * time.Second
+
+var (
+	errNoDNSName = errors.New("gcache: dns discovery requires a name to resolve")
+)
+
+// Discovery is a peer discovery provider. It watches the cluster
+// membership and reports the full list of peer URLs whenever it changes.
+type Discovery interface {
+	// Run calls update with the initial list of peers, and again every
+	// time the list changes, until ctx is done. Errors that prevent
+	// getting the initial list are returned.
+	Run(ctx context.Context, update func(peers []string)) error
+}
+
+// Discover keeps the peers of the cluster updated with the membership
+// reported by given provider. It blocks until ctx is done.
+func (peer *CachePeer) Discover(ctx context.Context, d Discovery) error {
+	return d.Run(ctx, func(peers []string) {
+		peer.SetPeers(peers...)
+	})
+}
+
+// membership remembers the last reported list of peers, so that
+// update is only called when the list changes
+type membership struct {
+	last   []string
+	update func(peers []string)
+}
+
+// set sorts peers and reports them if they changed
+func (m *membership) set(peers []string) {
+	sort.Strings(peers)
+	if m.last != nil && equalPeers(m.last, peers) {
+		return
+	}
+	m.last = peers
+	m.update(append([]string(nil), peers...))
+}
+
+func equalPeers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// StaticDiscovery reports a fixed list of peers
+type StaticDiscovery struct {
+	Peers []string
+}
+
+// Run implements Discovery
+func (d StaticDiscovery) Run(ctx context.Context, update func(peers []string)) error {
+	m := membership{update: update}
+	m.set(append([]string(nil), d.Peers...))
+	<-ctx.Done()
+	return nil
+}
+
+// FileDiscovery reads the list of peers from a file, one URL per line, and
+// polls it for changes. Empty lines and lines starting with # are ignored.
+type FileDiscovery struct {
+	Path string
+	// Interval is the polling interval. It defaults to DefaultDiscoveryInterval.
+	Interval time.Duration
+}
+
+// Run implements Discovery. If the file cannot be read after the first
+// time, the last known list of peers is kept.
+func (d FileDiscovery) Run(ctx context.Context, update func(peers []string)) error {
+	m := membership{update: update}
+	peers, err := d.read()
+	if err != nil {
+		return err
+	}
+	m.set(peers)
+	return poll(ctx, d.Interval, func() {
+		if peers, err := d.read(); err == nil {
+			m.set(peers)
+		}
+	})
+}
+
+func (d FileDiscovery) read() ([]string, error) {
+	raw, err := ioutil.ReadFile(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	peers := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+	return peers, scanner.Err()
+}
+
+// Resolver is the subset of net.Resolver used by DNSDiscovery
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNSDiscovery polls DNS for the list of peers. If Service is set, the SRV
+// records of _service._proto.name are used, taking the port of every target.
+// Otherwise, the A and AAAA records of Name are used together with Port.
+type DNSDiscovery struct {
+	Name    string
+	Service string
+	// Proto is the SRV protocol. It defaults to tcp.
+	Proto string
+	// Port of the peers found with A records
+	Port int
+	// Scheme of the peer URLs. It defaults to http.
+	Scheme string
+	// Interval is the polling interval. It defaults to DefaultDiscoveryInterval.
+	Interval time.Duration
+	// Resolver defaults to net.DefaultResolver
+	Resolver Resolver
+}
+
+// Run implements Discovery. If DNS cannot be resolved after the first
+// time, the last known list of peers is kept.
+func (d DNSDiscovery) Run(ctx context.Context, update func(peers []string)) error {
+	if d.Name == "" {
+		return errNoDNSName
+	}
+	m := membership{update: update}
+	peers, err := d.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	m.set(peers)
+	return poll(ctx, d.Interval, func() {
+		if peers, err := d.lookup(ctx); err == nil {
+			m.set(peers)
+		}
+	})
+}
+
+func (d DNSDiscovery) lookup(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	peers := []string{}
+	if d.Service != "" {
+		proto := d.Proto
+		if proto == "" {
+			proto = "tcp"
+		}
+		_, records, err := resolver.LookupSRV(ctx, d.Service, proto, d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			peers = append(peers, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+		return peers, nil
+	}
+	addrs, err := resolver.LookupHost(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		peers = append(peers, scheme+"://"+net.JoinHostPort(addr, strconv.Itoa(d.Port)))
+	}
+	return peers, nil
+}
+
+// poll calls f every interval until ctx is done
+func poll(ctx context.Context, interval time.Duration, f func()) error {
+	if interval <= 0 {
+		interval = DefaultDiscoveryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			f()
+		}
+	}
+}
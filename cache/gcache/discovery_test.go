@@ -0,0 +1,187 @@
+package gcache
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder keeps the last list of peers reported by a provider
+type recorder struct {
+	mu    sync.Mutex
+	peers []string
+	calls int
+}
+
+func (r *recorder) update(peers []string) {
+	r.mu.Lock()
+	r.peers = peers
+	r.calls++
+	r.mu.Unlock()
+}
+
+func (r *recorder) last() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.peers
+}
+
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+type fakeResolver struct {
+	mu    sync.Mutex
+	srv   []*net.SRV
+	hosts []string
+}
+
+func (f *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return "_" + service + "._" + proto + "." + name, f.srv, nil
+}
+
+func (f *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hosts, nil
+}
+
+func (f *fakeResolver) set(hosts ...string) {
+	f.mu.Lock()
+	f.hosts = hosts
+	f.mu.Unlock()
+}
+
+func TestDiscovery(t *testing.T) {
+	t.Run("static", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		peer, _ := NewCachePeer(Config{SelfURL: "http://127.0.0.1:5107"})
+		done := make(chan error)
+		go func() {
+			done <- peer.Discover(ctx, StaticDiscovery{Peers: []string{"http://127.0.0.1:5108", "http://127.0.0.1:5107"}})
+		}()
+		assert.Eventually(t, func() bool {
+			return len(peer.Peers()) == 2
+		}, time.Second, 10*time.Millisecond)
+		cancel()
+		assert.NoError(t, <-done)
+	})
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "peers")
+		assert.Error(t, FileDiscovery{Path: path}.Run(context.Background(), func([]string) {}))
+		assert.NoError(t, ioutil.WriteFile(path, []byte("# cluster\nhttp://b:5000\n\nhttp://a:5000\n"), 0644))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var r recorder
+		go FileDiscovery{Path: path, Interval: 10 * time.Millisecond}.Run(ctx, r.update)
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"http://a:5000", "http://b:5000"}, r.last())
+		}, time.Second, 10*time.Millisecond)
+		assert.NoError(t, ioutil.WriteFile(path, []byte("http://c:5000\n"), 0644))
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"http://c:5000"}, r.last())
+		}, time.Second, 10*time.Millisecond)
+		// unchanged content is not reported again
+		calls := r.count()
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, calls, r.count())
+	})
+	t.Run("dns-srv", func(t *testing.T) {
+		resolver := &fakeResolver{srv: []*net.SRV{
+			{Target: "b.cache.local.", Port: 5001},
+			{Target: "a.cache.local.", Port: 5000},
+		}}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var r recorder
+		go DNSDiscovery{Name: "cache.local", Service: "gcache", Resolver: resolver}.Run(ctx, r.update)
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"http://a.cache.local:5000", "http://b.cache.local:5001"}, r.last())
+		}, time.Second, 10*time.Millisecond)
+	})
+	t.Run("dns-a", func(t *testing.T) {
+		resolver := &fakeResolver{hosts: []string{"10.0.0.1"}}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var r recorder
+		go DNSDiscovery{Name: "cache.local", Port: 5000, Scheme: "https", Interval: 10 * time.Millisecond, Resolver: resolver}.Run(ctx, r.update)
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"https://10.0.0.1:5000"}, r.last())
+		}, time.Second, 10*time.Millisecond)
+		resolver.set("10.0.0.2", "10.0.0.1")
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"https://10.0.0.1:5000", "https://10.0.0.2:5000"}, r.last())
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, errNoDNSName, DNSDiscovery{}.Run(ctx, r.update))
+	})
+	t.Run("gossip", func(t *testing.T) {
+		urls := []string{"http://127.0.0.1:6001", "http://127.0.0.1:6002", "http://127.0.0.1:6003"}
+		var nodes []*GossipDiscovery
+		var recorders []*recorder
+		var cancels []context.CancelFunc
+		for i, url := range urls {
+			cfg := GossipConfig{Self: url, Interval: 20 * time.Millisecond}
+			if i > 0 {
+				// every member only knows the first one
+				cfg.Seeds = []string{nodes[0].Addr()}
+			}
+			d, err := NewGossipDiscovery(cfg)
+			assert.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			r := &recorder{}
+			go d.Run(ctx, r.update)
+			nodes = append(nodes, d)
+			recorders = append(recorders, r)
+			cancels = append(cancels, cancel)
+		}
+		defer func() {
+			for _, cancel := range cancels {
+				cancel()
+			}
+		}()
+		for _, r := range recorders {
+			r := r
+			assert.Eventually(t, func() bool {
+				return assert.ObjectsAreEqual(urls, r.last())
+			}, 2*time.Second, 10*time.Millisecond)
+		}
+		// the last member leaves the cluster
+		cancels[2]()
+		for _, r := range recorders[:2] {
+			r := r
+			assert.Eventually(t, func() bool {
+				return assert.ObjectsAreEqual(urls[:2], r.last())
+			}, 2*time.Second, 10*time.Millisecond)
+		}
+		// the second member dies without leaving
+		_ = nodes[1].conn.Close()
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(urls[:1], recorders[0].last())
+		}, 2*time.Second, 10*time.Millisecond)
+		_, err := NewGossipDiscovery(GossipConfig{})
+		assert.Equal(t, errNoGossipSelf, err)
+	})
+}
+
+func TestReadBackoff(t *testing.T) {
+	var waits []time.Duration
+	var wait time.Duration
+	for i := 0; i < 6; i++ {
+		wait = readBackoff(wait, 100*time.Millisecond)
+		waits = append(waits, wait)
+	}
+	assert.Equal(t, []time.Duration{
+		5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond,
+		40 * time.Millisecond, 80 * time.Millisecond, 100 * time.Millisecond,
+	}, waits)
+}
@@ -0,0 +1,288 @@
+// Package gcachetest runs clusters of gcache peers inside the test process,
+// listening on ephemeral localhost ports, so that ownership, fallback and
+// failure scenarios can be tested with go test.
+package gcachetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zerjioang/zgo/cache/gcache"
+)
+
+// DefaultReadyTimeout is the time a peer has to become ready after being started
+const DefaultReadyTimeout = 5 * time.Second
+
+var (
+	// ErrPartitioned is returned by the requests sent across a network partition
+	ErrPartitioned = errors.New("gcachetest: peer is unreachable due to a network partition")
+	errNoPeers     = errors.New("gcachetest: a cluster needs at least one peer")
+	errNotReady    = errors.New("gcachetest: peer did not become ready")
+)
+
+// Cluster is a set of peers running in the test process. Peers are
+// identified by their index, from 0 to Len()-1.
+type Cluster struct {
+	peers []*gcache.CachePeer
+	urls  []string
+	hosts map[string]int
+
+	mu sync.RWMutex
+	// blocked holds the links cut by a partition, in both directions
+	blocked map[[2]int]bool
+}
+
+// NewCluster starts n peers with given config and waits for them to be
+// ready. SelfURL, ListenAddr, Peers and Transport are set by the cluster,
+// the rest of the config is shared by every peer.
+func NewCluster(n int, config gcache.Config) (*Cluster, error) {
+	if n <= 0 {
+		return nil, errNoPeers
+	}
+	scheme := "http"
+	if config.TLS != nil {
+		scheme = "https"
+	}
+	addrs, err := reservePorts(n)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{
+		hosts:   map[string]int{},
+		blocked: map[[2]int]bool{},
+	}
+	for i, addr := range addrs {
+		c.urls = append(c.urls, scheme+"://"+addr)
+		c.hosts[addr] = i
+	}
+	base := config.Transport
+	if base == nil {
+		base = http.DefaultTransport
+		if config.TLS != nil {
+			base = &http.Transport{TLSClientConfig: config.TLS.ClientConfig()}
+		}
+	}
+	for i, addr := range addrs {
+		cfg := config
+		cfg.SelfURL = c.urls[i]
+		cfg.ListenAddr = addr
+		cfg.Peers = c.urls
+		cfg.Transport = &linkTransport{cluster: c, from: i, next: base}
+		peer, err := gcache.NewCachePeer(cfg)
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		c.peers = append(c.peers, peer)
+		if err := c.Start(i); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// reservePorts finds n free localhost ports. They are released before
+// returning, so that the peers can bind them, and reused on restarts.
+func reservePorts(n int) ([]string, error) {
+	listeners := make([]net.Listener, 0, n)
+	defer func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}()
+	addrs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs, nil
+}
+
+// Len returns the number of peers of the cluster
+func (c *Cluster) Len() int {
+	return len(c.peers)
+}
+
+// Peer returns the peer with given index
+func (c *Cluster) Peer(i int) *gcache.CachePeer {
+	return c.peers[i]
+}
+
+// Peers returns every peer of the cluster
+func (c *Cluster) Peers() []*gcache.CachePeer {
+	return append([]*gcache.CachePeer(nil), c.peers...)
+}
+
+// URL returns the self URL of the peer with given index
+func (c *Cluster) URL(i int) string {
+	return c.urls[i]
+}
+
+// URLs returns the self URL of every peer
+func (c *Cluster) URLs() []string {
+	return append([]string(nil), c.urls...)
+}
+
+// Owner returns the index of the peer that owns given key
+func (c *Cluster) Owner(key string) int {
+	return c.index(c.peers[0].Owner(key))
+}
+
+// KeyOwnedBy returns a key with given prefix owned by the peer with given index
+func (c *Cluster) KeyOwnedBy(i int, prefix string) string {
+	for n := 0; ; n++ {
+		key := fmt.Sprintf("%s%d", prefix, n)
+		if c.Owner(key) == i {
+			return key
+		}
+	}
+}
+
+func (c *Cluster) index(url string) int {
+	for i, u := range c.urls {
+		if u == url {
+			return i
+		}
+	}
+	return -1
+}
+
+// Start starts a stopped peer and waits for it to be ready
+func (c *Cluster) Start(i int) error {
+	peer := c.peers[i]
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultReadyTimeout)
+	defer cancel()
+	if err := peer.Start(ctx); err != nil {
+		return err
+	}
+	return waitReady(ctx, peer)
+}
+
+// waitReady waits until the peer reports itself ready and accepts connections
+func waitReady(ctx context.Context, peer *gcache.CachePeer) error {
+	var d net.Dialer
+	for {
+		if peer.Ready() {
+			if conn, err := d.DialContext(ctx, "tcp", peer.Config().ListenAddr); err == nil {
+				return conn.Close()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return errNotReady
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Stop gracefully stops a peer, waiting for its in-flight requests
+func (c *Cluster) Stop(i int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultReadyTimeout)
+	defer cancel()
+	return c.peers[i].Stop(ctx)
+}
+
+// Crash stops a peer abruptly, closing its connections without
+// waiting for the in-flight requests
+func (c *Cluster) Crash(i int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = c.peers[i].Stop(ctx)
+}
+
+// Restart restarts a peer on the same address, with an empty cache
+func (c *Cluster) Restart(i int) error {
+	if err := c.Stop(i); err != nil && err != gcache.ErrNotStarted {
+		return err
+	}
+	return c.Start(i)
+}
+
+// Partition splits the cluster in the given groups of peers. Peers in
+// different groups cannot reach each other, while peers not listed in any
+// group keep reaching everybody. It replaces any previous partition.
+func (c *Cluster) Partition(groups ...[]int) {
+	blocked := map[[2]int]bool{}
+	for gi, g := range groups {
+		for _, other := range groups[gi+1:] {
+			for _, i := range g {
+				for _, j := range other {
+					blocked[[2]int{i, j}] = true
+					blocked[[2]int{j, i}] = true
+				}
+			}
+		}
+	}
+	c.mu.Lock()
+	c.blocked = blocked
+	c.mu.Unlock()
+}
+
+// Isolate cuts the links between a peer and every other peer
+func (c *Cluster) Isolate(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for j := range c.peers {
+		if j != i {
+			c.blocked[[2]int{i, j}] = true
+			c.blocked[[2]int{j, i}] = true
+		}
+	}
+}
+
+// Block cuts the link between two peers in both directions
+func (c *Cluster) Block(i, j int) {
+	c.mu.Lock()
+	c.blocked[[2]int{i, j}] = true
+	c.blocked[[2]int{j, i}] = true
+	c.mu.Unlock()
+}
+
+// Heal restores every link between peers
+func (c *Cluster) Heal() {
+	c.mu.Lock()
+	c.blocked = map[[2]int]bool{}
+	c.mu.Unlock()
+}
+
+// reachable returns true if peer i can send requests to peer j
+func (c *Cluster) reachable(i, j int) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.blocked[[2]int{i, j}]
+}
+
+// Close stops every running peer
+func (c *Cluster) Close() error {
+	var err error
+	for i := range c.peers {
+		if e := c.Stop(i); e != nil && e != gcache.ErrNotStarted && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// linkTransport drops the requests of a peer sent across a partition
+type linkTransport struct {
+	cluster *Cluster
+	from    int
+	next    http.RoundTripper
+}
+
+func (t *linkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if to, found := t.cluster.hosts[req.URL.Host]; found && !t.cluster.reachable(t.from, to) {
+		return nil, ErrPartitioned
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,113 @@
+package gcachetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zerjioang/zgo/cache/gcache"
+)
+
+// countingLoader counts the loads of every peer
+type countingLoader struct {
+	mu    sync.Mutex
+	loads map[string]int
+}
+
+func (l *countingLoader) Load(ctx context.Context, key string) (interface{}, error) {
+	l.mu.Lock()
+	l.loads[key]++
+	l.mu.Unlock()
+	return "value of " + key, nil
+}
+
+func (l *countingLoader) count(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loads[key]
+}
+
+func TestCluster(t *testing.T) {
+	loader := &countingLoader{loads: map[string]int{}}
+	c, err := NewCluster(3, gcache.Config{GroupName: "harness", Loader: loader})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	t.Run("self-identification", func(t *testing.T) {
+		assert.Equal(t, 3, c.Len())
+		for i, peer := range c.Peers() {
+			assert.True(t, peer.Ready())
+			assert.Equal(t, c.URL(i), peer.Config().SelfURL)
+			assert.Equal(t, c.Peer(i).Addr().String(), peer.Config().ListenAddr)
+		}
+		key := c.KeyOwnedBy(2, "owned-")
+		assert.Equal(t, 2, c.Owner(key))
+	})
+	t.Run("owner-loads-once", func(t *testing.T) {
+		key := c.KeyOwnedBy(1, "once-")
+		for _, peer := range c.Peers() {
+			var v string
+			assert.NoError(t, peer.Get(key, &v))
+			assert.Equal(t, "value of "+key, v)
+		}
+		assert.Equal(t, 1, loader.count(key))
+	})
+	t.Run("crash-falls-back-to-local-load", func(t *testing.T) {
+		key := c.KeyOwnedBy(2, "crash-")
+		c.Crash(2)
+		assert.False(t, c.Peer(2).Ready())
+		var v string
+		assert.NoError(t, c.Peer(0).Get(key, &v))
+		assert.Equal(t, "value of "+key, v)
+		assert.Equal(t, 1, loader.count(key))
+
+		assert.NoError(t, c.Restart(2))
+		assert.True(t, c.Peer(2).Ready())
+		// the restarted owner has an empty cache
+		assert.NoError(t, c.Peer(1).Get(key, &v))
+		assert.Equal(t, 2, loader.count(key))
+	})
+	t.Run("partition", func(t *testing.T) {
+		key := c.KeyOwnedBy(1, "partition-")
+		c.Partition([]int{0}, []int{1, 2})
+		var v string
+		// peer 0 cannot reach the owner and loads the key by itself
+		assert.NoError(t, c.Peer(0).Get(key, &v))
+		assert.Equal(t, 1, loader.count(key))
+		assert.NoError(t, c.Peer(2).Get(key, &v))
+		assert.Equal(t, 2, loader.count(key))
+
+		c.Heal()
+		other := c.KeyOwnedBy(1, "healed-")
+		assert.NoError(t, c.Peer(0).Get(other, &v))
+		assert.NoError(t, c.Peer(2).Get(other, &v))
+		assert.Equal(t, 1, loader.count(other))
+	})
+	t.Run("isolate", func(t *testing.T) {
+		c.Isolate(0)
+		defer c.Heal()
+		key := c.KeyOwnedBy(1, "isolated-")
+		assert.NoError(t, c.Peer(2).Set(key, "from 2"))
+		var v string
+		assert.NoError(t, c.Peer(0).Get(key, &v))
+		assert.Equal(t, "value of "+key, v)
+		assert.NoError(t, c.Peer(2).Get(key, &v))
+		assert.Equal(t, "from 2", v)
+	})
+}
+
+func ExampleNewCluster() {
+	c, err := NewCluster(2, gcache.Config{GroupName: "example"})
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+	key := c.KeyOwnedBy(1, "key-")
+	_ = c.Peer(0).Set(key, "value")
+	var v string
+	_ = c.Peer(1).Get(key, &v)
+	fmt.Println(v)
+	// Output: value
+}
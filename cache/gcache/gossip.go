@@ -0,0 +1,312 @@
+package gcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultGossipInterval is the interval between gossip rounds
+	DefaultGossipInterval = time.Second
+	// DefaultGossipFanout is the number of members contacted every round
+	DefaultGossipFanout = 3
+	// maxGossipPacket is the size of the UDP read buffer
+	maxGossipPacket = 64 << 10
+	// minGossipReadBackoff is the wait after a failed read, doubled on
+	// every consecutive failure up to the gossip interval
+	minGossipReadBackoff = 5 * time.Millisecond
+)
+
+var (
+	errNoGossipSelf = errors.New("gcache: gossip discovery requires the self peer url")
+)
+
+// GossipConfig holds the settings of a GossipDiscovery
+type GossipConfig struct {
+	// Self is the peer URL advertised to the other members
+	Self string
+	// BindAddr is the UDP address to listen on. It defaults to 127.0.0.1:0.
+	BindAddr string
+	// AdvertiseAddr is the UDP address other members use to reach us.
+	// It defaults to the bound address.
+	AdvertiseAddr string
+	// Seeds are UDP addresses of members used to join the cluster
+	Seeds []string
+	// Interval between gossip rounds. It defaults to DefaultGossipInterval.
+	Interval time.Duration
+	// FailTimeout is the time after which a silent member is
+	// considered dead. It defaults to five intervals.
+	FailTimeout time.Duration
+	// Fanout is the number of members contacted every round.
+	// It defaults to DefaultGossipFanout.
+	Fanout int
+}
+
+// GossipDiscovery is a lightweight UDP gossip membership protocol. Every
+// round, each member increments its heartbeat and sends its view of the
+// cluster to a few random members. Views are merged keeping the highest
+// heartbeat of every member, and members whose heartbeat does not change
+// for FailTimeout are removed. Members leaving gracefully announce it.
+type GossipDiscovery struct {
+	config GossipConfig
+	conn   *net.UDPConn
+	rnd    *rand.Rand
+
+	mu      sync.Mutex
+	self    gossipMember
+	members map[string]*gossipState
+	view    *membership
+}
+
+// gossipMember is the wire representation of a member
+type gossipMember struct {
+	URL       string `json:"url"`
+	Addr      string `json:"addr"`
+	Heartbeat int64  `json:"hb"`
+	Left      bool   `json:"left,omitempty"`
+}
+
+type gossipState struct {
+	gossipMember
+	seen time.Time
+}
+
+type gossipMessage struct {
+	Members []gossipMember `json:"members"`
+}
+
+// NewGossipDiscovery binds the UDP address of the gossip protocol.
+// Gossip starts when the provider is run.
+func NewGossipDiscovery(config GossipConfig) (*GossipDiscovery, error) {
+	if config.Self == "" {
+		return nil, errNoGossipSelf
+	}
+	if config.BindAddr == "" {
+		config.BindAddr = "127.0.0.1:0"
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultGossipInterval
+	}
+	if config.FailTimeout <= 0 {
+		config.FailTimeout = 5 * config.Interval
+	}
+	if config.Fanout <= 0 {
+		config.Fanout = DefaultGossipFanout
+	}
+	addr, err := net.ResolveUDPAddr("udp", config.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.AdvertiseAddr == "" {
+		config.AdvertiseAddr = conn.LocalAddr().String()
+	}
+	d := GossipDiscovery{
+		config: config,
+		conn:   conn,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		self: gossipMember{
+			URL:  config.Self,
+			Addr: config.AdvertiseAddr,
+			// start from the current time, so that a restarted member
+			// is never shadowed by the heartbeats of its previous run
+			Heartbeat: time.Now().UnixNano(),
+		},
+		members: map[string]*gossipState{},
+	}
+	return &d, nil
+}
+
+// Addr returns the UDP address the gossip protocol listens on
+func (d *GossipDiscovery) Addr() string {
+	return d.conn.LocalAddr().String()
+}
+
+// Run implements Discovery. When ctx is done, the member announces
+// it is leaving and the UDP socket is closed.
+func (d *GossipDiscovery) Run(ctx context.Context, update func(peers []string)) error {
+	d.mu.Lock()
+	d.view = &membership{update: update}
+	d.refresh(time.Now())
+	d.mu.Unlock()
+
+	go d.receive()
+	d.gossip()
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			d.leave()
+			return d.conn.Close()
+		case now := <-ticker.C:
+			d.mu.Lock()
+			d.self.Heartbeat++
+			d.refresh(now)
+			d.mu.Unlock()
+			d.gossip()
+		}
+	}
+}
+
+// refresh removes dead members and reports the alive ones.
+// It must be called with the lock held.
+func (d *GossipDiscovery) refresh(now time.Time) {
+	peers := []string{d.self.URL}
+	for url, m := range d.members {
+		if now.Sub(m.seen) > d.config.FailTimeout {
+			if now.Sub(m.seen) > 2*d.config.FailTimeout {
+				// forget the member, once its last heartbeats stopped circulating
+				delete(d.members, url)
+			}
+			continue
+		}
+		if !m.Left {
+			peers = append(peers, url)
+		}
+	}
+	d.view.set(peers)
+}
+
+// snapshot returns the message describing our view of the cluster and
+// the addresses of the members to gossip with
+func (d *GossipDiscovery) snapshot() (gossipMessage, []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	msg := gossipMessage{Members: []gossipMember{d.self}}
+	var targets []string
+	known := map[string]bool{}
+	for _, m := range d.members {
+		if now.Sub(m.seen) > d.config.FailTimeout {
+			// do not spread the members we consider dead
+			continue
+		}
+		msg.Members = append(msg.Members, m.gossipMember)
+		known[m.Addr] = true
+		if !m.Left {
+			targets = append(targets, m.Addr)
+		}
+	}
+	for _, seed := range d.config.Seeds {
+		if !known[seed] && seed != d.self.Addr {
+			targets = append(targets, seed)
+		}
+	}
+	d.rnd.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	if len(targets) > d.config.Fanout {
+		targets = targets[:d.config.Fanout]
+	}
+	return msg, targets
+}
+
+// gossip sends our view of the cluster to some random members
+func (d *GossipDiscovery) gossip() {
+	msg, targets := d.snapshot()
+	d.send(msg, targets)
+}
+
+// leave announces every known member that we are leaving the cluster
+func (d *GossipDiscovery) leave() {
+	d.mu.Lock()
+	d.self.Heartbeat++
+	d.self.Left = true
+	d.mu.Unlock()
+	msg, _ := d.snapshot()
+	var targets []string
+	d.mu.Lock()
+	for _, m := range d.members {
+		if !m.Left {
+			targets = append(targets, m.Addr)
+		}
+	}
+	d.mu.Unlock()
+	d.send(msg, targets)
+}
+
+func (d *GossipDiscovery) send(msg gossipMessage, targets []string) {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	for _, target := range targets {
+		addr, err := net.ResolveUDPAddr("udp", target)
+		if err != nil {
+			continue
+		}
+		_, _ = d.conn.WriteToUDP(raw, addr)
+	}
+}
+
+// receive merges the views sent by other members until the socket is closed
+func (d *GossipDiscovery) receive() {
+	buf := make([]byte, maxGossipPacket)
+	var wait time.Duration
+	for {
+		n, _, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// do not spin on a socket that keeps failing
+			wait = readBackoff(wait, d.config.Interval)
+			time.Sleep(wait)
+			continue
+		}
+		wait = 0
+		var msg gossipMessage
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+		d.merge(msg)
+	}
+}
+
+// readBackoff returns the wait after a failed read, given the previous one
+func readBackoff(prev, max time.Duration) time.Duration {
+	next := 2 * prev
+	if next < minGossipReadBackoff {
+		next = minGossipReadBackoff
+	}
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+// merge keeps the highest heartbeat of every member
+func (d *GossipDiscovery) merge(msg gossipMessage) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, gm := range msg.Members {
+		if gm.URL == d.self.URL || gm.URL == "" {
+			continue
+		}
+		m, found := d.members[gm.URL]
+		if !found {
+			if gm.Left {
+				continue
+			}
+			d.members[gm.URL] = &gossipState{gossipMember: gm, seen: now}
+			continue
+		}
+		if gm.Heartbeat > m.Heartbeat {
+			m.gossipMember = gm
+			m.seen = now
+		}
+	}
+	if d.view != nil {
+		d.refresh(now)
+	}
+}
@@ -0,0 +1,268 @@
+package gcache
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/mailgun/groupcache/v2"
+	"github.com/zerjioang/zgo/cache"
+	"github.com/zerjioang/zgo/timer"
+)
+
+var (
+	// ErrGroupExists is returned when registering a group name twice in the same peer
+	ErrGroupExists   = errors.New("gcache: group already registered")
+	errNoGroupName   = errors.New("gcache: group name cannot be empty")
+	errInvalidGroup  = errors.New("gcache: group name cannot contain '/'")
+	errGroupNotFound = errors.New("gcache: group not found")
+)
+
+// GroupConfig holds the policy of a named cache group.
+// Zero values are replaced by the defaults of the peer config.
+type GroupConfig struct {
+	Name string
+	// CacheBytes is the max size of the group in bytes
+	CacheBytes int64
+	// DefaultTTL is the expiration of the items stored with Set
+	DefaultTTL time.Duration
+	// Loader computes the values missing in the group
+	Loader Loader
+	// Codec encodes the values of the group
+	Codec Codec
+	// LocalTTL enables an in-process L1 cache in front of the group,
+	// keeping the values read by this peer for given duration.
+	// A negative value disables it when the peer config enables it.
+	LocalTTL time.Duration
+}
+
+// Group is a named cache namespace of a peer, with its own capacity,
+// TTL, loader and codec. Every peer of the cluster must register the
+// same groups with the same codec.
+type Group struct {
+	// stats is accessed atomically and kept first for 64 bit alignment
+	stats  tierStats
+	peer   *CachePeer
+	config GroupConfig
+	// local is the L1 cache of the group, nil if disabled
+	local *cache.Cache
+	// cache is the groupcache group. It is nil while the peer is stopped,
+	// and guarded by the peer lock.
+	cache *groupcache.Group
+}
+
+// groupConfig returns the group config with the defaults of the peer applied
+func (c Config) groupConfig(g GroupConfig) (GroupConfig, error) {
+	if g.Name == "" {
+		return g, errNoGroupName
+	}
+	for _, r := range g.Name {
+		if r == '/' {
+			return g, errInvalidGroup
+		}
+	}
+	if g.CacheBytes == 0 {
+		g.CacheBytes = c.CacheBytes
+	}
+	if g.DefaultTTL == 0 {
+		g.DefaultTTL = c.DefaultTTL
+	}
+	if g.Loader == nil {
+		g.Loader = c.Loader
+	}
+	if g.Codec == nil {
+		g.Codec = c.Codec
+	}
+	if g.LocalTTL == 0 {
+		g.LocalTTL = c.LocalTTL
+	}
+	return g, nil
+}
+
+// AddGroup registers a new named group in the peer. Groups can be added
+// before or after the peer is started.
+func (peer *CachePeer) AddGroup(config GroupConfig) (*Group, error) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.pool == nil {
+		cfg, err := Config{}.withDefaults()
+		if err != nil {
+			return nil, err
+		}
+		if err := peer.init(cfg); err != nil {
+			return nil, err
+		}
+	}
+	g, err := peer.addGroup(config)
+	if err != nil {
+		return nil, err
+	}
+	if peer.cacheServer != nil {
+		g.create()
+	}
+	return g, nil
+}
+
+// addGroup registers a group. It must be called with the peer lock held.
+func (peer *CachePeer) addGroup(config GroupConfig) (*Group, error) {
+	cfg, err := peer.config.groupConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := peer.groups[cfg.Name]; found {
+		return nil, ErrGroupExists
+	}
+	g := &Group{
+		peer:   peer,
+		config: cfg,
+	}
+	g.newLocal()
+	peer.groups[cfg.Name] = g
+	return g, nil
+}
+
+// Group returns the group registered with given name, or nil if there is none
+func (peer *CachePeer) Group(name string) *Group {
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	return peer.groups[name]
+}
+
+// Groups returns the sorted names of the registered groups
+func (peer *CachePeer) Groups() []string {
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+	names := make([]string, 0, len(peer.groups))
+	for name := range peer.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// create registers the group in groupcache. It must be called with the peer lock held.
+func (g *Group) create() {
+	name := groupName(g.peer.config.SelfURL, g.config.Name)
+	registerGroup(name, g.peer.pool)
+	g.cache = groupcache.NewGroup(name, g.config.CacheBytes, groupcache.GetterFunc(g.load))
+}
+
+// destroy removes the group from groupcache, dropping its content.
+// It must be called with the peer lock held.
+func (g *Group) destroy() {
+	if g.cache != nil {
+		deregisterGroup(g.cache.Name())
+		g.cache = nil
+	}
+	if g.local != nil {
+		g.local.Flush()
+	}
+}
+
+// group returns the groupcache group of a started peer
+func (g *Group) group() (*groupcache.Group, error) {
+	if g == nil {
+		return nil, errGroupNotFound
+	}
+	g.peer.mu.RLock()
+	defer g.peer.mu.RUnlock()
+	if g.cache == nil {
+		return nil, ErrNotStarted
+	}
+	return g.cache, nil
+}
+
+// Name returns the name of the group
+func (g *Group) Name() string {
+	return g.config.Name
+}
+
+// Config returns the configuration of the group with the defaults applied
+func (g *Group) Config() GroupConfig {
+	return g.config
+}
+
+// Set stores the value in the group using the default TTL
+func (g *Group) Set(ctx context.Context, id string, value interface{}) error {
+	return g.SetWithTTL(ctx, id, value, g.config.DefaultTTL)
+}
+
+// SetWithTTL stores the value in the group to expire after given duration.
+// When the group has an L1 cache, the key is invalidated from the L1 of
+// every peer, and an error is returned if any of them could not be reached.
+func (g *Group) SetWithTTL(ctx context.Context, id string, value interface{}, ttl time.Duration) error {
+	group, err := g.group()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, g.peer.config.SetTimeout)
+	defer cancel()
+	raw, err := encode(g.config.Codec, value)
+	if err != nil {
+		return err
+	}
+	defer g.invalidate(id)
+	if err := group.Set(ctx, id, raw, timer.Time().Add(ttl), true); err != nil {
+		return err
+	}
+	if g.local == nil {
+		return nil
+	}
+	return g.invalidatePeers(ctx, group.Name(), id)
+}
+
+// Get reads the value of given key into dest, loading it if missing
+func (g *Group) Get(ctx context.Context, id string, dest interface{}) error {
+	group, err := g.group()
+	if err != nil {
+		return err
+	}
+	if data, found := g.getLocal(id); found {
+		return decode(g.config.Codec, data, dest)
+	}
+	ctx, cancel := context.WithTimeout(ctx, g.peer.config.GetTimeout)
+	defer cancel()
+	ctx, loaded := markLoad(ctx)
+	var data []byte
+	reader := groupcache.AllocatingByteSliceSink(&data)
+	if err := group.Get(ctx, id, reader); err != nil {
+		return err
+	}
+	g.countL2(*loaded)
+	// handle readed data
+	if len(data) != 0 {
+		g.setLocal(id, data)
+		return decode(g.config.Codec, data, dest)
+	}
+	return nil
+}
+
+// Remove removes the key from the owner peer and from the hot cache of every peer
+func (g *Group) Remove(ctx context.Context, id string) error {
+	group, err := g.group()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, g.peer.config.RemoveTimeout)
+	defer cancel()
+	defer g.invalidate(id)
+	return group.Remove(ctx, id)
+}
+
+// load computes the value of a key missing in the cache using the group loader
+func (g *Group) load(ctx context.Context, id string, dest groupcache.Sink) error {
+	if g.config.Loader == nil {
+		return ErrNotFound
+	}
+	reportLoad(ctx)
+	value, err := g.config.Loader.Load(ctx, id)
+	if err != nil {
+		return err
+	}
+	raw, err := encode(g.config.Codec, value)
+	if err != nil {
+		return err
+	}
+	return dest.SetBytes(raw, timer.Time().Add(g.config.DefaultTTL))
+}
@@ -0,0 +1,91 @@
+package gcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type user struct {
+	ID   string
+	Name string
+}
+
+func TestGroups(t *testing.T) {
+	users := LoaderFunc(func(ctx context.Context, key string) (interface{}, error) {
+		return user{ID: key, Name: "user " + key}, nil
+	})
+	sessions := GroupConfig{Name: "sessions", DefaultTTL: time.Minute, Codec: RawCodec}
+	urls := []string{"http://127.0.0.1:5109", "http://127.0.0.1:5110"}
+	peers := make([]*CachePeer, len(urls))
+	for i, url := range urls {
+		peer, err := NewCachePeer(Config{
+			SelfURL: url,
+			Peers:   urls,
+			Groups:  []GroupConfig{{Name: "users", CacheBytes: 1 << 20, Loader: users}},
+		})
+		assert.NoError(t, err)
+		// groups can also be added after creation
+		_, err = peer.AddGroup(sessions)
+		assert.NoError(t, err)
+		assert.NoError(t, peer.Start(context.Background()))
+		defer peer.Stop(context.Background())
+		peers[i] = peer
+	}
+	a, b := peers[0], peers[1]
+	ctx := context.Background()
+
+	t.Run("config", func(t *testing.T) {
+		assert.Equal(t, []string{DefaultGroupName, "sessions", "users"}, a.Groups())
+		cfg := a.Group("users").Config()
+		assert.Equal(t, int64(1<<20), cfg.CacheBytes)
+		assert.Equal(t, DefaultTTL, cfg.DefaultTTL)
+		assert.Equal(t, JSONCodec, cfg.Codec)
+		cfg = a.Group("sessions").Config()
+		assert.Equal(t, DefaultCacheBytes, cfg.CacheBytes)
+		assert.Nil(t, cfg.Loader)
+
+		_, err := a.AddGroup(GroupConfig{Name: "users"})
+		assert.Equal(t, ErrGroupExists, err)
+		_, err = a.AddGroup(GroupConfig{})
+		assert.Equal(t, errNoGroupName, err)
+		_, err = NewCachePeer(Config{SelfURL: urls[0], Groups: []GroupConfig{{Name: DefaultGroupName}}})
+		assert.Equal(t, ErrGroupExists, err)
+	})
+	t.Run("typed-access", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			id := fmt.Sprintf("%d", i)
+			var u user
+			assert.NoError(t, b.Group("users").Get(ctx, id, &u))
+			assert.Equal(t, user{ID: id, Name: "user " + id}, u)
+		}
+	})
+	t.Run("isolated-namespaces", func(t *testing.T) {
+		assert.NoError(t, a.Group("sessions").Set(ctx, "1", "token"))
+		var token string
+		assert.NoError(t, b.Group("sessions").Get(ctx, "1", &token))
+		assert.Equal(t, "token", token)
+		// the same key in another group is resolved by its own loader
+		var u user
+		assert.NoError(t, b.Group("users").Get(ctx, "1", &u))
+		assert.Equal(t, "user 1", u.Name)
+		assert.Equal(t, ErrNotFound, a.Get("1", &token))
+	})
+	t.Run("added-while-started", func(t *testing.T) {
+		for _, peer := range peers {
+			_, err := peer.AddGroup(GroupConfig{Name: "late", Codec: GobCodec})
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, a.Group("late").Set(ctx, "k", 42))
+		var v int
+		assert.NoError(t, b.Group("late").Get(ctx, "k", &v))
+		assert.Equal(t, 42, v)
+	})
+	t.Run("unknown-group", func(t *testing.T) {
+		var v string
+		assert.Equal(t, errGroupNotFound, a.Group("unknown").Get(ctx, "k", &v))
+	})
+}
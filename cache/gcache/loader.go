@@ -0,0 +1,48 @@
+package gcache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/zerjioang/zgo/storage"
+)
+
+var (
+	// ErrNotFound is returned by Get when the key is not in the
+	// cache and there is no loader able to compute its value
+	ErrNotFound = errors.New("gcache: item not found")
+)
+
+// Loader computes the value of a key that is missing in the cache.
+// It is called by the peer that owns the key, and the loaded value is
+// stored in the cache of that peer using the default TTL.
+//
+// If the owner peer fails to load the value, groupcache retries the load
+// in the calling peer, so the error returned to the caller is always the
+// one returned by its own loader and can be checked with errors.Is.
+type Loader interface {
+	Load(ctx context.Context, key string) (interface{}, error)
+}
+
+// LoaderFunc is an adapter to allow the use of ordinary functions as loaders
+type LoaderFunc func(ctx context.Context, key string) (interface{}, error)
+
+// Load calls f(ctx, key)
+func (f LoaderFunc) Load(ctx context.Context, key string) (interface{}, error) {
+	return f(ctx, key)
+}
+
+// RepositoryLoader returns a loader that reads the item with id equal to
+// the cache key from given repository. Missing rows are reported as ErrNotFound.
+func RepositoryLoader(repo storage.Repository, gen storage.Generator) Loader {
+	return LoaderFunc(func(ctx context.Context, key string) (interface{}, error) {
+		item, err := repo.ReadByKey("", ctx, gen, key)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return nil, ErrNotFound
+			}
+			return nil, err
+		}
+		return item, nil
+	})
+}
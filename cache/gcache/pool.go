@@ -0,0 +1,258 @@
+package gcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mailgun/groupcache/v2"
+	pb "github.com/mailgun/groupcache/v2/groupcachepb"
+	"github.com/zerjioang/zgo/cache/lru"
+	"github.com/zerjioang/zgo/cache/lru/consistent"
+)
+
+// groupcache keeps a process wide registry of groups and only allows one
+// peer picker per process. To allow several peers in the same process, every
+// group is registered under a name prefixed with the namespace of its peer,
+// and the picker of each group is looked up in the pools registry below.
+var (
+	registerPicker sync.Once
+	poolsMu        sync.RWMutex
+	pools          = map[string]*peerPool{}
+)
+
+// serverHandler serves peer requests for every registered group. The zero
+// value HTTPPool only resolves the group by name and serves it, which is all
+// we need, since picking peers is done by peerPool.
+var serverHandler = &groupcache.HTTPPool{}
+
+// namespace returns the group name prefix of the peer with given self URL
+func namespace(self string) string {
+	return strconv.FormatUint(lru.Hash64a(self), 36)
+}
+
+// groupName returns the registered groupcache name of a group
+func groupName(self, name string) string {
+	return namespace(self) + "." + name
+}
+
+// localName returns the user provided name of a registered group
+func localName(registered string) string {
+	return registered[strings.IndexByte(registered, '.')+1:]
+}
+
+// registerGroup binds the registered group name to given pool
+func registerGroup(registered string, pool *peerPool) {
+	registerPicker.Do(func() {
+		groupcache.RegisterPerGroupPeerPicker(func(name string) groupcache.PeerPicker {
+			poolsMu.RLock()
+			defer poolsMu.RUnlock()
+			if p, found := pools[name]; found {
+				return p
+			}
+			return groupcache.NoPeers{}
+		})
+	})
+	poolsMu.Lock()
+	pools[registered] = pool
+	poolsMu.Unlock()
+}
+
+// deregisterGroup removes the group from groupcache and from the pools registry
+func deregisterGroup(registered string) {
+	groupcache.DeregisterGroup(registered)
+	poolsMu.Lock()
+	delete(pools, registered)
+	poolsMu.Unlock()
+}
+
+// peerPool keeps track of the peers in the cluster and identifies
+// which peer owns a key. It implements groupcache.PeerPicker.
+type peerPool struct {
+	self      string
+	basePath  string
+	transport http.RoundTripper
+	mu        sync.RWMutex
+	ring      *consistent.Ring
+	clients   map[string]*peerClient
+}
+
+var _ groupcache.PeerPicker = (*peerPool)(nil)
+
+func newPeerPool(self, basePath string, transport http.RoundTripper) *peerPool {
+	p := peerPool{
+		self:      self,
+		basePath:  basePath,
+		transport: transport,
+		ring:      consistent.NewRing(0),
+		clients:   map[string]*peerClient{},
+	}
+	return &p
+}
+
+// Set replaces the list of peers of the pool
+func (p *peerPool) Set(peers ...string) {
+	ring := consistent.NewRing(0)
+	clients := make(map[string]*peerClient, len(peers))
+	for _, peer := range peers {
+		if _, err := ring.AddNode(peer, 1); err != nil {
+			// ignore empty and duplicated peers
+			continue
+		}
+		clients[peer] = &peerClient{
+			baseURL:   peer + p.basePath,
+			namespace: namespace(peer),
+			transport: p.transport,
+		}
+	}
+	p.mu.Lock()
+	p.ring = ring
+	p.clients = clients
+	p.mu.Unlock()
+}
+
+// Peers returns the sorted list of peers of the pool
+func (p *peerPool) Peers() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ring.Nodes()
+}
+
+// Owner returns the peer that owns the specific key
+func (p *peerPool) Owner(key string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ring.Get(key)
+}
+
+// PickPeer returns the peer that owns the specific key and true to
+// indicate that a remote peer was nominated. It returns nil, false
+// if the key owner is the current peer.
+func (p *peerPool) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	owner := p.ring.Get(key)
+	if owner == "" || owner == p.self {
+		return nil, false
+	}
+	return p.clients[owner], true
+}
+
+// GetAll returns all the remote peers in the pool
+func (p *peerPool) GetAll() []groupcache.ProtoGetter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]groupcache.ProtoGetter, 0, len(p.clients))
+	for peer, c := range p.clients {
+		if peer != p.self {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// remotes returns the clients of the remote peers but given one
+func (p *peerPool) remotes(except string) []*peerClient {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]*peerClient, 0, len(p.clients))
+	for peer, c := range p.clients {
+		if peer != p.self && peer != except {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// peerClient sends the requests of a group to the same group
+// of a remote peer. It implements groupcache.ProtoGetter.
+type peerClient struct {
+	baseURL   string
+	namespace string
+	transport http.RoundTripper
+}
+
+var _ groupcache.ProtoGetter = (*peerClient)(nil)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func (c *peerClient) GetURL() string {
+	return c.baseURL
+}
+
+// remoteGroup returns the name the given local group is registered with in the remote peer
+func (c *peerClient) remoteGroup(group string) string {
+	return c.namespace + "." + localName(group)
+}
+
+func (c *peerClient) do(ctx context.Context, method, group, key string, body io.Reader) (*http.Response, error) {
+	u := c.baseURL + url.QueryEscape(c.remoteGroup(group)) + "/" + url.QueryEscape(key)
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("peer %s returned status %d: %s", c.baseURL, res.StatusCode, bytes.TrimSpace(msg))
+	}
+	return res, nil
+}
+
+func (c *peerClient) Get(ctx context.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	res, err := c.do(ctx, http.MethodGet, in.GetGroup(), in.GetKey(), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	defer bufferPool.Put(b)
+	if _, err := io.Copy(b, res.Body); err != nil {
+		return fmt.Errorf("reading response body: %v", err)
+	}
+	if err := proto.Unmarshal(b.Bytes(), out); err != nil {
+		return fmt.Errorf("decoding response body: %v", err)
+	}
+	return nil
+}
+
+func (c *peerClient) Set(ctx context.Context, in *pb.SetRequest) error {
+	group := c.remoteGroup(in.GetGroup())
+	body, err := proto.Marshal(&pb.SetRequest{
+		Group:  &group,
+		Key:    in.Key,
+		Value:  in.Value,
+		Expire: in.Expire,
+	})
+	if err != nil {
+		return fmt.Errorf("while marshaling SetRequest body: %w", err)
+	}
+	res, err := c.do(ctx, http.MethodPut, in.GetGroup(), in.GetKey(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (c *peerClient) Remove(ctx context.Context, in *pb.GetRequest) error {
+	res, err := c.do(ctx, http.MethodDelete, in.GetGroup(), in.GetKey(), nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
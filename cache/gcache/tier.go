@@ -0,0 +1,188 @@
+package gcache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	pb "github.com/mailgun/groupcache/v2/groupcachepb"
+	"github.com/zerjioang/zgo/cache"
+)
+
+// A group with a LocalTTL is a two tier cache. The first tier (L1) is an
+// in-process cache.Cache holding the encoded values read by this peer for a
+// short time, so hot keys owned by remote peers do not need an HTTP round trip.
+// The second tier (L2) is the distributed groupcache group.
+//
+// Set and Remove invalidate the L1 entry of every peer of the peer list: the
+// owner when receiving the write, and the rest of the peers with a removal
+// request. Peers missing from the list of the writer, or unreachable, may
+// serve the previous value until their L1 entry expires, which is why
+// LocalTTL should be kept short.
+
+// TierStats are the hit statistics of a cache tier
+type TierStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRatio returns the ratio of lookups that were hits, or 0 if there were none
+func (s TierStats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// GroupStats are the statistics of every tier of a group.
+// L1 misses are the lookups that reached L2. L2 misses are the lookups
+// of this peer that ran the loader locally; values loaded by a remote
+// owner are reported as L2 hits.
+type GroupStats struct {
+	L1 TierStats
+	L2 TierStats
+}
+
+// tierStats holds the counters of a group, updated atomically
+type tierStats struct {
+	l1Hits, l1Misses uint64
+	l2Hits, l2Misses uint64
+}
+
+// loadMarker is the context key that flags lookups of this peer,
+// so that the loader can report them as L2 misses
+type loadMarker struct{}
+
+// Stats returns the hit statistics of the group
+func (g *Group) Stats() GroupStats {
+	return GroupStats{
+		L1: TierStats{
+			Hits:   atomic.LoadUint64(&g.stats.l1Hits),
+			Misses: atomic.LoadUint64(&g.stats.l1Misses),
+		},
+		L2: TierStats{
+			Hits:   atomic.LoadUint64(&g.stats.l2Hits),
+			Misses: atomic.LoadUint64(&g.stats.l2Misses),
+		},
+	}
+}
+
+// Stats returns the hit statistics of the default group
+func (peer *CachePeer) Stats() GroupStats {
+	return peer.defaultGroup().Stats()
+}
+
+// newLocal creates the L1 cache of the group, if enabled
+func (g *Group) newLocal() {
+	if g.config.LocalTTL > 0 {
+		g.local = cache.New(g.config.LocalTTL, g.config.LocalTTL)
+	}
+}
+
+// getLocal reads the encoded value of given key from L1
+func (g *Group) getLocal(id string) ([]byte, bool) {
+	if g.local == nil {
+		return nil, false
+	}
+	if v, found := g.local.Get(id); found {
+		atomic.AddUint64(&g.stats.l1Hits, 1)
+		return v.([]byte), true
+	}
+	atomic.AddUint64(&g.stats.l1Misses, 1)
+	return nil, false
+}
+
+// setLocal stores the encoded value of given key in L1
+func (g *Group) setLocal(id string, data []byte) {
+	if g.local != nil {
+		g.local.SetDefault(id, data)
+	}
+}
+
+// invalidate removes given key from L1
+func (g *Group) invalidate(id string) {
+	if g.local != nil {
+		g.local.Delete(id)
+	}
+}
+
+// invalidatePeers removes given key from the L1 of every remote peer but the
+// owner, which already invalidated it when receiving the new value. The
+// removal also drops the copies kept in their groupcache hot cache.
+func (g *Group) invalidatePeers(ctx context.Context, group, id string) error {
+	clients := g.peer.pool.remotes(g.peer.pool.Owner(id))
+	errs := make(chan error, len(clients))
+	for _, c := range clients {
+		go func(c *peerClient) {
+			errs <- c.Remove(ctx, &pb.GetRequest{Group: &group, Key: &id})
+		}(c)
+	}
+	var err error
+	for range clients {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// markLoad flags the lookups of this peer, so that they can be reported as L2 misses
+func markLoad(ctx context.Context) (context.Context, *bool) {
+	loaded := new(bool)
+	return context.WithValue(ctx, loadMarker{}, loaded), loaded
+}
+
+// reportLoad flags the lookup of ctx as loaded by this peer
+func reportLoad(ctx context.Context) {
+	if loaded, ok := ctx.Value(loadMarker{}).(*bool); ok {
+		*loaded = true
+	}
+}
+
+// countL2 records the result of a successful L2 lookup
+func (g *Group) countL2(loaded bool) {
+	if loaded {
+		atomic.AddUint64(&g.stats.l2Misses, 1)
+	} else {
+		atomic.AddUint64(&g.stats.l2Hits, 1)
+	}
+}
+
+// invalidating wraps the groupcache handler of the peer, so that the keys
+// set or removed by other peers are invalidated from the L1 of this peer
+func (peer *CachePeer) invalidating(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+			if group, key, ok := requestKey(r); ok {
+				peer.mu.RLock()
+				g := peer.groups[localName(group)]
+				peer.mu.RUnlock()
+				if g != nil {
+					g.invalidate(key)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestKey returns the group and key of a peer request. Peers send them
+// query escaped, so they are read from the escaped path: the decoded path
+// cannot tell an escaped space, sent as '+', from a literal '+'.
+func requestKey(r *http.Request) (group, key string, ok bool) {
+	parts := strings.SplitN(r.URL.EscapedPath(), "/", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	group, err := url.QueryUnescape(parts[0])
+	if err != nil {
+		return "", "", false
+	}
+	if key, err = url.QueryUnescape(parts[1]); err != nil {
+		return "", "", false
+	}
+	return group, key, true
+}
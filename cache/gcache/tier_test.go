@@ -0,0 +1,109 @@
+package gcache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTiers(t *testing.T) {
+	var loads int32
+	loader := LoaderFunc(func(ctx context.Context, key string) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		return "value of " + key, nil
+	})
+	urls := []string{"http://127.0.0.1:5111", "http://127.0.0.1:5112", "http://127.0.0.1:5113"}
+	peers := make([]*CachePeer, len(urls))
+	for i, url := range urls {
+		peer, err := NewCachePeer(Config{SelfURL: url, Peers: urls, GroupName: "tiers", Loader: loader, LocalTTL: time.Minute})
+		assert.NoError(t, err)
+		assert.NoError(t, peer.Start(context.Background()))
+		defer peer.Stop(context.Background())
+		peers[i] = peer
+	}
+	a, b, c := peers[0], peers[1], peers[2]
+	// ownedByB returns a key owned by b, derived from base
+	ownedByB := func(base string) string {
+		for i := 0; ; i++ {
+			key := fmt.Sprintf("%s-%d", base, i)
+			if a.Owner(key) == urls[1] {
+				return key
+			}
+		}
+	}
+	key := ownedByB("key")
+
+	t.Run("hot-keys-are-served-locally", func(t *testing.T) {
+		var v string
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, a.Get(key, &v))
+			assert.Equal(t, "value of "+key, v)
+		}
+		stats := a.Stats()
+		assert.Equal(t, TierStats{Hits: 9, Misses: 1}, stats.L1)
+		assert.Equal(t, 0.9, stats.L1.HitRatio())
+		// the value was loaded by the remote owner
+		assert.Equal(t, TierStats{Hits: 1}, stats.L2)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&loads))
+
+		assert.NoError(t, b.Get("local-key", &v))
+		_, remote := b.pool.PickPeer("local-key")
+		if !remote {
+			assert.Equal(t, TierStats{Misses: 1}, b.Stats().L2)
+		}
+	})
+	t.Run("set-invalidates-local-tier", func(t *testing.T) {
+		var v string
+		assert.NoError(t, b.Get(key, &v))
+		assert.NoError(t, a.Set(key, "updated"))
+		// both the caller and the owner see the new value
+		assert.NoError(t, a.Get(key, &v))
+		assert.Equal(t, "updated", v)
+		assert.NoError(t, b.Get(key, &v))
+		assert.Equal(t, "updated", v)
+	})
+	t.Run("set-invalidates-every-peer", func(t *testing.T) {
+		var v string
+		assert.NoError(t, c.Get(key, &v))
+		_, cached := c.defaultGroup().local.Get(key)
+		assert.True(t, cached)
+		// c is neither the caller nor the owner
+		assert.NoError(t, a.Set(key, "updated again"))
+		_, cached = c.defaultGroup().local.Get(key)
+		assert.False(t, cached)
+		assert.NoError(t, c.Get(key, &v))
+		assert.Equal(t, "updated again", v)
+	})
+	t.Run("remove-invalidates-every-peer", func(t *testing.T) {
+		var v string
+		assert.NoError(t, a.Get(key, &v))
+		assert.NoError(t, b.Get(key, &v))
+		assert.NoError(t, b.Remove(key))
+		assert.NoError(t, a.Get(key, &v))
+		assert.Equal(t, "value of "+key, v)
+	})
+	t.Run("escaped-keys-are-invalidated", func(t *testing.T) {
+		for _, base := range []string{"with space", "with+plus", "with%percent", "with/slash"} {
+			owned := ownedByB(base)
+			var v string
+			assert.NoError(t, b.Get(owned, &v))
+			_, cached := b.defaultGroup().local.Get(owned)
+			assert.True(t, cached, owned)
+			// the set is sent to the owner, which must drop its local copy
+			assert.NoError(t, a.Set(owned, "updated"))
+			_, cached = b.defaultGroup().local.Get(owned)
+			assert.False(t, cached, owned)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		g, err := a.AddGroup(GroupConfig{Name: "no-l1", LocalTTL: -1})
+		assert.NoError(t, err)
+		var v string
+		assert.NoError(t, g.Get(context.Background(), key, &v))
+		assert.Equal(t, TierStats{}, g.Stats().L1)
+	})
+}
@@ -0,0 +1,145 @@
+package gcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errTLSScheme  = errors.New("gcache: peers secured with tls must use https urls")
+	errNoPeerCert = errors.New("gcache: peer did not present a certificate")
+	errNoTLSCert  = errors.New("gcache: tls requires a peer certificate")
+	errNoTLSRoots = errors.New("gcache: tls requires the cluster ca certificates")
+)
+
+// PeerTLS secures the peer HTTP pool with mutual TLS. Every peer presents
+// its certificate both when serving and when calling other peers, and only
+// accepts the peers whose certificate is signed by the cluster CA, usually
+// minted with keygen.NewCA and CA.Issue.
+//
+// Certificates and roots are read on every handshake, so they can be
+// rotated with Rotate while the peer is running.
+type PeerTLS struct {
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	roots *x509.CertPool
+}
+
+// NewPeerTLS creates the TLS settings of a peer from its certificate
+// and the pool of cluster CA certificates
+func NewPeerTLS(cert tls.Certificate, roots *x509.CertPool) (*PeerTLS, error) {
+	t := &PeerTLS{}
+	if err := t.Rotate(cert, roots); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Rotate replaces the certificate of the peer and the trusted roots.
+// New connections use them immediately, established ones are kept.
+// To rotate the cluster CA without downtime, first trust both the old and
+// the new CA in every peer, then issue the new certificates, and finally
+// remove the old CA.
+func (t *PeerTLS) Rotate(cert tls.Certificate, roots *x509.CertPool) error {
+	if len(cert.Certificate) == 0 {
+		return errNoTLSCert
+	}
+	if roots == nil {
+		return errNoTLSRoots
+	}
+	t.mu.Lock()
+	t.cert = &cert
+	t.roots = roots
+	t.mu.Unlock()
+	return nil
+}
+
+// RotateCertificate replaces the certificate of the peer keeping the trusted roots
+func (t *PeerTLS) RotateCertificate(cert tls.Certificate) error {
+	t.mu.RLock()
+	roots := t.roots
+	t.mu.RUnlock()
+	return t.Rotate(cert, roots)
+}
+
+func (t *PeerTLS) current() (*tls.Certificate, *x509.CertPool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cert, t.roots
+}
+
+// verify checks the chain presented by a peer against the current roots
+func (t *PeerTLS) verify(certs []*x509.Certificate, usage x509.ExtKeyUsage, host string) error {
+	if len(certs) == 0 {
+		return errNoPeerCert
+	}
+	_, roots := t.current()
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+// ServerConfig returns the TLS config of the peer HTTP server, which
+// requires every client to present a certificate signed by the cluster CA
+func (t *PeerTLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		// the client chain is verified below against the current roots,
+		// since ClientCAs cannot be replaced once the server is running
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return t.verify(cs.PeerCertificates, x509.ExtKeyUsageClientAuth, "")
+		},
+	}
+}
+
+// ClientConfig returns the TLS config used to call other peers, which
+// only accepts servers with a certificate signed by the cluster CA
+// and valid for the peer host
+func (t *PeerTLS) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		// the server chain is verified below against the current roots,
+		// since RootCAs cannot be replaced once the transport is created
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return t.verify(cs.PeerCertificates, x509.ExtKeyUsageServerAuth, cs.ServerName)
+		},
+	}
+}
+
+// transport returns the HTTP transport used to call other peers
+func (t *PeerTLS) transport() http.RoundTripper {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     t.ClientConfig(),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
@@ -0,0 +1,104 @@
+package gcache
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zerjioang/zgo/crypto/keygen"
+)
+
+func TestTLS(t *testing.T) {
+	ca, err := keygen.NewCA("cluster", time.Hour)
+	assert.NoError(t, err)
+	issue := func(ca *keygen.CA) tls.Certificate {
+		cert, err := ca.Issue("peer", []string{"127.0.0.1", "localhost"}, time.Hour)
+		assert.NoError(t, err)
+		return cert.TLS()
+	}
+
+	urls := []string{"https://127.0.0.1:5113", "https://127.0.0.1:5114"}
+	peers := make([]*CachePeer, len(urls))
+	for i, url := range urls {
+		secure, err := NewPeerTLS(issue(ca), ca.Pool())
+		assert.NoError(t, err)
+		peer, err := NewCachePeer(Config{SelfURL: url, Peers: urls, GroupName: "tls", TLS: secure, GetTimeout: time.Second, SetTimeout: time.Second})
+		assert.NoError(t, err)
+		assert.NoError(t, peer.Start(context.Background()))
+		defer peer.Stop(context.Background())
+		peers[i] = peer
+	}
+	a, b := peers[0], peers[1]
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("key-%d", i)
+		if _, remote := a.pool.PickPeer(key); remote {
+			break
+		}
+	}
+
+	t.Run("https-required", func(t *testing.T) {
+		secure, _ := NewPeerTLS(issue(ca), ca.Pool())
+		_, err := NewCachePeer(Config{SelfURL: "http://127.0.0.1:5115", TLS: secure})
+		assert.Equal(t, errTLSScheme, err)
+	})
+	t.Run("peers-authenticate-each-other", func(t *testing.T) {
+		assert.NoError(t, a.Set(key, "secret"))
+		var v string
+		assert.NoError(t, b.Get(key, &v))
+		assert.Equal(t, "secret", v)
+	})
+	t.Run("unknown-certificates-are-rejected", func(t *testing.T) {
+		// plain http and tls clients without a certificate
+		res, err := http.Get("http://127.0.0.1:5114" + DefaultHealthPath)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		res.Body.Close()
+		insecure := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		_, err = insecure.Get("https://127.0.0.1:5114" + DefaultHealthPath)
+		assert.Error(t, err)
+
+		// a peer with a certificate of another CA
+		rogueCA, err := keygen.NewCA("rogue", time.Hour)
+		assert.NoError(t, err)
+		rogueTLS, _ := NewPeerTLS(issue(rogueCA), rogueCA.Pool())
+		client := &http.Client{Transport: rogueTLS.transport()}
+		_, err = client.Get("https://127.0.0.1:5114" + DefaultHealthPath)
+		assert.Error(t, err)
+
+		// a peer with a valid certificate
+		trusted, _ := NewPeerTLS(issue(ca), ca.Pool())
+		client = &http.Client{Transport: trusted.transport()}
+		res, err = client.Get("https://127.0.0.1:5114" + DefaultHealthPath)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+	})
+	t.Run("rotation-without-restart", func(t *testing.T) {
+		next, err := keygen.NewCA("cluster-next", time.Hour)
+		assert.NoError(t, err)
+		// trust both CAs, then move every peer to the new one
+		both := ca.Pool()
+		both.AddCert(next.Cert)
+		for _, peer := range peers {
+			assert.NoError(t, peer.Config().TLS.Rotate(issue(next), both))
+		}
+		for _, peer := range peers {
+			assert.NoError(t, peer.Config().TLS.Rotate(issue(next), next.Pool()))
+		}
+		// clients of the old CA are no longer accepted
+		old, _ := NewPeerTLS(issue(ca), ca.Pool())
+		client := &http.Client{Transport: old.transport()}
+		_, err = client.Get("https://127.0.0.1:5113" + DefaultHealthPath)
+		assert.Error(t, err)
+
+		assert.NoError(t, a.Set(key, "rotated"))
+		var v string
+		assert.NoError(t, b.Get(key, &v))
+		assert.Equal(t, "rotated", v)
+	})
+}
@@ -0,0 +1,166 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package lru
+
+import (
+	"sync"
+
+	cache "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// Default2QRecentRatio is the ratio of the 2Q cache dedicated
+	// to recently added entries that have only been accessed once.
+	Default2QRecentRatio = cache.Default2QRecentRatio
+	// Default2QGhostEntries is the default ratio of ghost
+	// entries kept to track entries recently evicted
+	Default2QGhostEntries = cache.Default2QGhostEntries
+)
+
+// Policy is the method set shared by every cache replacement
+// policy implemented in this package
+type Policy interface {
+	Add(key, value interface{}) (evicted bool)
+	Get(key interface{}) (value interface{}, ok bool)
+	Delete(key interface{})
+}
+
+// compilation time interface implementation check
+var _ Policy = (*Cache)(nil)
+var _ Policy = (*ShardedCache)(nil)
+var _ Policy = (*ARCCache)(nil)
+var _ Policy = (*TwoQueueCache)(nil)
+
+// ARCCache is an Adaptive Replacement Cache. It tracks both recency and
+// frequency of use, and uses two ghost lists of recently evicted keys to
+// adapt the size of each one to the current workload. This avoids a burst
+// of one-time accesses (a scan) flushing the frequently used entries.
+type ARCCache struct {
+	mu   sync.Mutex
+	size int
+	c    *cache.ARCCache
+}
+
+// NewARC creates an ARC cache of the given size
+func NewARC(size uint) *ARCCache {
+	ch, err := cache.NewARC(int(size))
+	if err != nil {
+		panic(err)
+	}
+	c := ARCCache{
+		size: int(size),
+		c:    ch,
+	}
+	return &c
+}
+
+// Add adds a value to the cache.  Returns true if an eviction occurred.
+func (c *ARCCache) Add(key, value interface{}) (evicted bool) {
+	c.mu.Lock()
+	evicted = !c.c.Contains(key) && c.c.Len() == c.size
+	c.c.Add(key, value)
+	c.mu.Unlock()
+	return evicted
+}
+
+// Get looks up a key's value from the cache.
+func (c *ARCCache) Get(key interface{}) (value interface{}, ok bool) {
+	return c.c.Get(key)
+}
+
+// Peek looks up a key's value from the cache without updating its recentness or frequency.
+func (c *ARCCache) Peek(key interface{}) (value interface{}, ok bool) {
+	return c.c.Peek(key)
+}
+
+// Delete removes the provided key from the cache.
+func (c *ARCCache) Delete(key interface{}) {
+	// Add reports evictions from the length of the cache, so
+	// removals must not run between its check and its insertion
+	c.mu.Lock()
+	c.c.Remove(key)
+	c.mu.Unlock()
+}
+
+// Keys returns a slice of the keys in the cache.
+func (c *ARCCache) Keys() []interface{} {
+	return c.c.Keys()
+}
+
+// Len returns the number of items in the cache.
+func (c *ARCCache) Len() int {
+	return c.c.Len()
+}
+
+// TwoQueueCache is a 2Q cache. It keeps entries seen only once in a
+// recent queue, separated from the frequently used ones, and remembers
+// recently evicted keys in a ghost queue so that a key coming back soon
+// after its eviction is promoted to the frequent queue.
+type TwoQueueCache struct {
+	mu   sync.Mutex
+	size int
+	c    *cache.TwoQueueCache
+}
+
+// New2Q creates a 2Q cache of the given size. recentRatio is the fraction of
+// the cache dedicated to entries accessed only once and ghostRatio the number
+// of evicted keys remembered, as a fraction of the cache size.
+func New2Q(size uint, recentRatio, ghostRatio float64) *TwoQueueCache {
+	ch, err := cache.New2QParams(int(size), recentRatio, ghostRatio)
+	if err != nil {
+		panic(err)
+	}
+	c := TwoQueueCache{
+		size: int(size),
+		c:    ch,
+	}
+	return &c
+}
+
+// Add adds a value to the cache.  Returns true if an eviction occurred.
+func (c *TwoQueueCache) Add(key, value interface{}) (evicted bool) {
+	c.mu.Lock()
+	evicted = !c.c.Contains(key) && c.c.Len() == c.size
+	c.c.Add(key, value)
+	c.mu.Unlock()
+	return evicted
+}
+
+// Get looks up a key's value from the cache.
+func (c *TwoQueueCache) Get(key interface{}) (value interface{}, ok bool) {
+	return c.c.Get(key)
+}
+
+// Peek looks up a key's value from the cache without updating its recentness or frequency.
+func (c *TwoQueueCache) Peek(key interface{}) (value interface{}, ok bool) {
+	return c.c.Peek(key)
+}
+
+// Delete removes the provided key from the cache.
+func (c *TwoQueueCache) Delete(key interface{}) {
+	// Add reports evictions from the length of the cache, so
+	// removals must not run between its check and its insertion
+	c.mu.Lock()
+	c.c.Remove(key)
+	c.mu.Unlock()
+}
+
+// Keys returns a slice of the keys in the cache.
+func (c *TwoQueueCache) Keys() []interface{} {
+	return c.c.Keys()
+}
+
+// Len returns the number of items in the cache.
+func (c *TwoQueueCache) Len() int {
+	return c.c.Len()
+}
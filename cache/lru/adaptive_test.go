@@ -0,0 +1,70 @@
+package lru
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// scanTrace returns an access trace made of a small set of hot keys that are
+// read repeatedly, interleaved with long scans of keys that are read only once
+func scanTrace(rounds, hot, scan int) []int {
+	var trace []int
+	next := hot
+	for r := 0; r < rounds; r++ {
+		for i := 0; i < 2; i++ {
+			for k := 0; k < hot; k++ {
+				trace = append(trace, k)
+			}
+		}
+		for k := 0; k < scan; k++ {
+			trace = append(trace, next)
+			next++
+		}
+	}
+	return trace
+}
+
+// hitRatio replays the trace against the given cache, adding every missed key
+func hitRatio(c Policy, trace []int) float64 {
+	hits := 0
+	for _, k := range trace {
+		if _, ok := c.Get(k); ok {
+			hits++
+			continue
+		}
+		c.Add(k, k)
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+func TestAdaptiveCaches(t *testing.T) {
+	t.Run("method-set", func(t *testing.T) {
+		for name, c := range map[string]Policy{
+			"arc": NewARC(2),
+			"2q":  New2Q(2, Default2QRecentRatio, Default2QGhostEntries),
+		} {
+			t.Run(name, func(t *testing.T) {
+				assert.False(t, c.Add("a", 1))
+				assert.False(t, c.Add("b", 2))
+				assert.False(t, c.Add("a", 3))
+				v, ok := c.Get("a")
+				assert.True(t, ok)
+				assert.Equal(t, 3, v)
+				assert.True(t, c.Add("c", 4))
+				c.Delete("a")
+				_, ok = c.Get("a")
+				assert.False(t, ok)
+			})
+		}
+	})
+	t.Run("scan-resistance", func(t *testing.T) {
+		trace := scanTrace(50, 64, 256)
+		lru := hitRatio(NewLRUCache(128), trace)
+		arc := hitRatio(NewARC(128), trace)
+		twoQ := hitRatio(New2Q(128, Default2QRecentRatio, Default2QGhostEntries), trace)
+		t.Logf("hit ratio lru=%.3f arc=%.3f 2q=%.3f", lru, arc, twoQ)
+		assert.Greater(t, arc, lru)
+		assert.Greater(t, twoQ, lru)
+	})
+}
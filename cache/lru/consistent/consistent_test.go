@@ -0,0 +1,184 @@
+package consistent
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keys(n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = "key-" + strconv.Itoa(i)
+	}
+	return out
+}
+
+func owners(r *Ring, ks []string) map[string]string {
+	out := make(map[string]string, len(ks))
+	for _, k := range ks {
+		out[k] = r.Get(k)
+	}
+	return out
+}
+
+func inRanges(ranges []Range, h uint64) (Range, bool) {
+	for _, rg := range ranges {
+		if rg.Contains(h) {
+			return rg, true
+		}
+	}
+	return Range{}, false
+}
+
+func TestRing(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		r := NewRing(0)
+		assert.Equal(t, "", r.Get("foo"))
+		assert.Nil(t, r.GetN("foo", 2))
+	})
+	t.Run("errors", func(t *testing.T) {
+		r := NewRing(10)
+		_, err := r.AddNode("", 1)
+		assert.Equal(t, errEmptyNode, err)
+		_, err = r.AddNode("a", 0)
+		assert.Equal(t, errInvalidWeight, err)
+		_, err = r.AddNode("a", 1)
+		assert.NoError(t, err)
+		_, err = r.AddNode("a", 1)
+		assert.Equal(t, errNodeExists, err)
+		_, err = r.RemoveNode("b")
+		assert.Equal(t, errNodeNotFound, err)
+	})
+	t.Run("first-node-owns-everything", func(t *testing.T) {
+		r := NewRing(10)
+		moved, err := r.AddNode("a", 1)
+		assert.NoError(t, err)
+		assert.Len(t, moved, 1)
+		assert.Equal(t, "", moved[0].From)
+		assert.Equal(t, "a", moved[0].To)
+		assert.True(t, moved[0].Contains(0))
+		assert.True(t, moved[0].Contains(^uint64(0)))
+	})
+	t.Run("add-reports-moved-ranges", func(t *testing.T) {
+		r := NewRing(0)
+		for _, n := range []string{"a", "b", "c"} {
+			_, _ = r.AddNode(n, 1)
+		}
+		ks := keys(10000)
+		before := owners(r, ks)
+		moved, err := r.AddNode("d", 1)
+		assert.NoError(t, err)
+		after := owners(r, ks)
+		changed := 0
+		for _, k := range ks {
+			rg, found := inRanges(moved, Hash(k))
+			if before[k] != after[k] {
+				changed++
+				assert.True(t, found, k)
+				assert.Equal(t, before[k], rg.From)
+				assert.Equal(t, "d", after[k])
+			} else {
+				assert.False(t, found, k)
+			}
+		}
+		// roughly a quarter of the keys move to the new node
+		assert.InDelta(t, 2500, changed, 500)
+	})
+	t.Run("remove-reports-moved-ranges", func(t *testing.T) {
+		r := NewRing(0)
+		for _, n := range []string{"a", "b", "c", "d"} {
+			_, _ = r.AddNode(n, 1)
+		}
+		ks := keys(10000)
+		before := owners(r, ks)
+		moved, err := r.RemoveNode("b")
+		assert.NoError(t, err)
+		after := owners(r, ks)
+		for _, k := range ks {
+			rg, found := inRanges(moved, Hash(k))
+			assert.Equal(t, before[k] == "b", found, k)
+			if found {
+				assert.Equal(t, "b", rg.From)
+				assert.Equal(t, after[k], rg.To)
+			} else {
+				assert.Equal(t, before[k], after[k])
+			}
+		}
+		assert.Equal(t, []string{"a", "c", "d"}, r.Nodes())
+	})
+	t.Run("weights", func(t *testing.T) {
+		r := NewRing(0)
+		_, _ = r.AddNode("small", 1)
+		_, _ = r.AddNode("big", 3)
+		count := map[string]int{}
+		for _, k := range keys(20000) {
+			count[r.Get(k)]++
+		}
+		assert.InDelta(t, 15000, count["big"], 1500)
+	})
+	t.Run("get-n", func(t *testing.T) {
+		r := NewRing(0)
+		for _, n := range []string{"a", "b", "c"} {
+			_, _ = r.AddNode(n, 1)
+		}
+		replicas := r.GetN("foo", 5)
+		assert.Len(t, replicas, 3)
+		assert.Equal(t, r.Get("foo"), replicas[0])
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, replicas)
+	})
+}
+
+func TestRendezvous(t *testing.T) {
+	r := NewRendezvous("a", "b", "c")
+	ks := keys(10000)
+	before := map[string]string{}
+	for _, k := range ks {
+		before[k] = r.Get(k)
+		top := r.GetN(k, 2)
+		assert.Len(t, top, 2)
+		assert.Equal(t, before[k], top[0])
+	}
+	assert.NoError(t, r.AddNode("d", 1))
+	changed := 0
+	for _, k := range ks {
+		if now := r.Get(k); now != before[k] {
+			changed++
+			assert.Equal(t, "d", now)
+		}
+	}
+	assert.InDelta(t, 2500, changed, 500)
+	assert.NoError(t, r.RemoveNode("d"))
+	for _, k := range ks {
+		assert.Equal(t, before[k], r.Get(k))
+	}
+	assert.Equal(t, errNodeNotFound, r.RemoveNode("d"))
+}
+
+func TestJumpHash(t *testing.T) {
+	assert.Equal(t, -1, JumpHash(1, 0))
+	ks := keys(10000)
+	changed := 0
+	for _, k := range ks {
+		b := JumpHashString(k, 10)
+		assert.True(t, b >= 0 && b < 10)
+		if n := JumpHashString(k, 11); n != b {
+			changed++
+			assert.Equal(t, 10, n)
+		}
+	}
+	assert.InDelta(t, 10000/11, changed, 200)
+}
+
+func BenchmarkRingGet(b *testing.B) {
+	r := NewRing(0)
+	for i := 0; i < 16; i++ {
+		_, _ = r.AddNode("node-"+strconv.Itoa(i), 1)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = r.Get("this is a sample content")
+	}
+}
@@ -0,0 +1,38 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package consistent
+
+import "github.com/zerjioang/zgo/cache/lru"
+
+// JumpHash implements the jump consistent hash algorithm from Lamping and
+// Veach. It maps key to a bucket in [0, buckets) using no memory, and
+// growing the number of buckets from n to n+1 only moves 1/(n+1) of the keys.
+// Buckets can only be added or removed at the end.
+// It returns -1 if buckets is not positive.
+func JumpHash(key uint64, buckets int) int {
+	if buckets <= 0 {
+		return -1
+	}
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// JumpHashString returns the jump hash bucket of the FNV-1a hash of given key
+func JumpHashString(key string, buckets int) int {
+	return JumpHash(lru.Hash64a(key), buckets)
+}
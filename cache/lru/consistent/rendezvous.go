@@ -0,0 +1,138 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package consistent
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/zerjioang/zgo/cache/lru"
+)
+
+// Rendezvous implements weighted highest random weight (HRW) hashing.
+// Every node gets a score for each key and the highest score wins, so
+// adding or removing a node only moves the keys it wins or owned.
+// It is safe for concurrent use.
+type Rendezvous struct {
+	mu      sync.RWMutex
+	nodes   []string
+	hashes  []uint64
+	weights []float64
+}
+
+// NewRendezvous creates a HRW hasher with given nodes, all of weight 1
+func NewRendezvous(nodes ...string) *Rendezvous {
+	r := Rendezvous{}
+	for _, node := range nodes {
+		_ = r.AddNode(node, 1)
+	}
+	return &r
+}
+
+// AddNode adds a node with given weight
+func (r *Rendezvous) AddNode(node string, weight float64) error {
+	if node == "" {
+		return errEmptyNode
+	}
+	if weight <= 0 {
+		return errInvalidWeight
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.index(node) != -1 {
+		return errNodeExists
+	}
+	r.nodes = append(r.nodes, node)
+	r.hashes = append(r.hashes, lru.Hash64a(node))
+	r.weights = append(r.weights, weight)
+	return nil
+}
+
+// RemoveNode removes given node
+func (r *Rendezvous) RemoveNode(node string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(node)
+	if i == -1 {
+		return errNodeNotFound
+	}
+	r.nodes = append(r.nodes[:i], r.nodes[i+1:]...)
+	r.hashes = append(r.hashes[:i], r.hashes[i+1:]...)
+	r.weights = append(r.weights[:i], r.weights[i+1:]...)
+	return nil
+}
+
+func (r *Rendezvous) index(node string) int {
+	for i, n := range r.nodes {
+		if n == node {
+			return i
+		}
+	}
+	return -1
+}
+
+// score returns the weighted score of node i for given key hash
+func (r *Rendezvous) score(i int, key uint64) float64 {
+	// map the combined hash to a float in (0, 1)
+	u := (float64(mix(key^r.hashes[i])>>11) + 0.5) / (1 << 53)
+	return -r.weights[i] / math.Log(u)
+}
+
+// Get returns the node that owns given key, or an empty string if there are no nodes.
+func (r *Rendezvous) Get(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h := lru.Hash64a(key)
+	best, bestScore := "", -1.0
+	for i, node := range r.nodes {
+		if s := r.score(i, h); s > bestScore {
+			best, bestScore = node, s
+		}
+	}
+	return best
+}
+
+// GetN returns up to n nodes for given key ordered by decreasing score
+func (r *Rendezvous) GetN(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n <= 0 {
+		return nil
+	}
+	h := lru.Hash64a(key)
+	idx := make([]int, len(r.nodes))
+	scores := make([]float64, len(r.nodes))
+	for i := range r.nodes {
+		idx[i] = i
+		scores[i] = r.score(i, h)
+	}
+	sort.Slice(idx, func(a, b int) bool {
+		return scores[idx[a]] > scores[idx[b]]
+	})
+	if n > len(idx) {
+		n = len(idx)
+	}
+	out := make([]string, n)
+	for i := range out {
+		out[i] = r.nodes[idx[i]]
+	}
+	return out
+}
+
+// Nodes returns the list of nodes in insertion order
+func (r *Rendezvous) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.nodes...)
+}
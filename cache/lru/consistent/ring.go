@@ -0,0 +1,253 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package consistent
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/zerjioang/zgo/cache/lru"
+)
+
+// DefaultReplicas is the number of virtual nodes created for a node of weight 1
+const DefaultReplicas = 160
+
+var (
+	errEmptyNode     = errors.New("consistent: node name cannot be empty")
+	errInvalidWeight = errors.New("consistent: node weight must be greater than zero")
+	errNodeExists    = errors.New("consistent: node already exists")
+	errNodeNotFound  = errors.New("consistent: node not found")
+)
+
+// Range is a section of the hash space that changed of owner after a node
+// was added to or removed from the ring. It covers every hash h where
+// Start < h <= End, wrapping around zero when Start >= End.
+type Range struct {
+	Start uint64
+	End   uint64
+	// From is the node that owned the range before the change.
+	// It is empty if the ring had no nodes.
+	From string
+	// To is the node that owns the range after the change.
+	// It is empty if the ring has no nodes left.
+	To string
+}
+
+// Contains returns true if given hash falls inside the range
+func (r Range) Contains(h uint64) bool {
+	if r.Start < r.End {
+		return h > r.Start && h <= r.End
+	}
+	return h > r.Start || h <= r.End
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// Ring is a consistent hashing ring with weighted virtual nodes.
+// It is safe for concurrent use.
+type Ring struct {
+	mu       sync.RWMutex
+	replicas int
+	weights  map[string]int
+	points   []point
+}
+
+// NewRing creates an empty ring that places replicas virtual nodes per unit
+// of weight. If replicas is zero, DefaultReplicas is used.
+func NewRing(replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := Ring{
+		replicas: replicas,
+		weights:  map[string]int{},
+	}
+	return &r
+}
+
+// Hash returns the position of given key in the hash space.
+// It is the FNV-1a hash of the key with its bits mixed, so that
+// similar keys, such as virtual node names, are spread uniformly.
+func Hash(key string) uint64 {
+	return mix(lru.Hash64a(key))
+}
+
+// mix is the splitmix64 finalizer
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// AddNode adds a node with given weight to the ring and
+// returns the hash ranges that moved to the new node.
+func (r *Ring) AddNode(node string, weight int) ([]Range, error) {
+	if node == "" {
+		return nil, errEmptyNode
+	}
+	if weight <= 0 {
+		return nil, errInvalidWeight
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.weights[node]; found {
+		return nil, errNodeExists
+	}
+	r.weights[node] = weight
+	n := r.replicas * weight
+	for i := 0; i < n; i++ {
+		r.points = append(r.points, point{hash: Hash(node + "#" + strconv.Itoa(i)), node: node})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	moved := r.ranges(node)
+	for i := range moved {
+		moved[i].From, moved[i].To = moved[i].To, node
+	}
+	return moved, nil
+}
+
+// RemoveNode removes a node from the ring and returns the hash ranges
+// it owned together with the node that owns each of them now.
+func (r *Ring) RemoveNode(node string) ([]Range, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.weights[node]; !found {
+		return nil, errNodeNotFound
+	}
+	moved := r.ranges(node)
+	for i := range moved {
+		moved[i].From = node
+	}
+	delete(r.weights, node)
+	kept := r.points[:0]
+	for _, p := range r.points {
+		if p.node != node {
+			kept = append(kept, p)
+		}
+	}
+	r.points = kept
+	return moved, nil
+}
+
+// ranges returns the hash ranges owned by node, merging the contiguous ones.
+// The To field of every range is set to the node that would own it if node
+// was not in the ring. It must be called with the lock held.
+func (r *Ring) ranges(node string) []Range {
+	var out []Range
+	n := len(r.points)
+	for i, p := range r.points {
+		if p.node != node {
+			continue
+		}
+		prev := r.points[(i-1+n)%n].hash
+		if k := len(out); k > 0 && out[k-1].End == prev {
+			// contiguous with the previous range
+			out[k-1].End = p.hash
+			continue
+		}
+		out = append(out, Range{Start: prev, End: p.hash, To: r.successor(i, node)})
+	}
+	// the first and last ranges may be contiguous across zero
+	if k := len(out); k > 1 && out[k-1].End == out[0].Start {
+		out[0].Start = out[k-1].Start
+		out = out[:k-1]
+	}
+	return out
+}
+
+// successor returns the owner of the first point after index i that does not
+// belong to the excluded node. It must be called with the lock held.
+func (r *Ring) successor(i int, exclude string) string {
+	n := len(r.points)
+	for j := 1; j < n; j++ {
+		if p := r.points[(i+j)%n]; p.node != exclude {
+			return p.node
+		}
+	}
+	return ""
+}
+
+// search returns the index of the point that owns given hash
+func (r *Ring) search(h uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// Get returns the node that owns given key, or an empty string if the ring is empty.
+func (r *Ring) Get(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+	return r.points[r.search(Hash(key))].node
+}
+
+// GetN returns up to n distinct nodes for given key, walking the ring
+// clockwise from the key position. The first node is the key owner and
+// the others are the suggested replicas.
+func (r *Ring) GetN(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.weights) {
+		n = len(r.weights)
+	}
+	out := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	start := r.search(Hash(key))
+	for j := 0; j < len(r.points) && len(out) < n; j++ {
+		p := r.points[(start+j)%len(r.points)]
+		if _, found := seen[p.node]; !found {
+			seen[p.node] = struct{}{}
+			out = append(out, p.node)
+		}
+	}
+	return out
+}
+
+// Nodes returns the sorted list of nodes in the ring
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	out := make([]string, 0, len(r.weights))
+	for node := range r.weights {
+		out = append(out, node)
+	}
+	r.mu.RUnlock()
+	sort.Strings(out)
+	return out
+}
+
+// Len returns the number of nodes in the ring
+func (r *Ring) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.weights)
+}
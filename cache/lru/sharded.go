@@ -0,0 +1,226 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package lru
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/zerjioang/zgo/timer"
+)
+
+const (
+	// NoExpiration disables the expiration of an entry
+	NoExpiration time.Duration = -1
+	// DefaultExpiration uses the TTL the sharded cache was created with
+	DefaultExpiration time.Duration = 0
+)
+
+// ShardedCache is a LRU cache split in N independently locked segments.
+// Keys are assigned to a segment using their FNV-1a hash, so that concurrent
+// access to different keys rarely contends on the same lock.
+type ShardedCache struct {
+	shards []*shard
+	ttl    time.Duration
+}
+
+type shard struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+// entry is the value stored in every segment LRU
+type entry struct {
+	value      interface{}
+	expiration int64
+}
+
+// expired returns true if the entry has expired.
+func (e *entry) expired(now int64) bool {
+	return e.expiration > 0 && now > e.expiration
+}
+
+// NewShardedLRUCache creates a new sharded LRU cache with a total capacity of
+// size items split across the given number of shards. If ttl is greater than
+// zero, entries added with DefaultExpiration expire after it.
+func NewShardedLRUCache(size uint, shards uint, ttl time.Duration) *ShardedCache {
+	if shards == 0 {
+		shards = 1
+	}
+	if size < shards {
+		panic("lru: sharded cache size must be greater or equal than the number of shards")
+	}
+	c := ShardedCache{
+		shards: make([]*shard, shards),
+		ttl:    ttl,
+	}
+	for i := range c.shards {
+		l, err := simplelru.NewLRU(shardSize(size, shards, uint(i)), nil)
+		if err != nil {
+			panic(err)
+		}
+		c.shards[i] = &shard{lru: l}
+	}
+	return &c
+}
+
+// shardSize returns the capacity of shard i when total capacity size is split
+// across n shards. The remainder is given to the first shards.
+func shardSize(size, n, i uint) int {
+	s := size / n
+	if i < size%n {
+		s++
+	}
+	return int(s)
+}
+
+// hashKey returns the FNV-1a hash of given key.
+func hashKey(key interface{}) uint64 {
+	switch k := key.(type) {
+	case string:
+		return Hash64a(k)
+	case []byte:
+		return Hash64aSlice(k)
+	case fmt.Stringer:
+		return Hash64a(k.String())
+	default:
+		return Hash64a(fmt.Sprint(k))
+	}
+}
+
+func (c *ShardedCache) shard(key interface{}) *shard {
+	return c.shards[hashKey(key)%uint64(len(c.shards))]
+}
+
+// Add adds a value to the cache using the default TTL.
+// Returns true if an eviction occurred.
+func (c *ShardedCache) Add(key, value interface{}) (evicted bool) {
+	return c.AddWithTTL(key, value, DefaultExpiration)
+}
+
+// AddWithTTL adds a value to the cache that expires after given duration.
+// If the duration is 0 (DefaultExpiration), the cache's default TTL is used.
+// If it is -1 (NoExpiration), the item never expires.
+// Returns true if an eviction occurred.
+func (c *ShardedCache) AddWithTTL(key, value interface{}, d time.Duration) (evicted bool) {
+	if d == DefaultExpiration {
+		d = c.ttl
+	}
+	e := &entry{value: value}
+	if d > 0 {
+		e.expiration = timer.Time().Add(d).UnixNano()
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	evicted = s.lru.Add(key, e)
+	s.mu.Unlock()
+	return evicted
+}
+
+// Get looks up a key's value from the cache, updating its recentness.
+func (c *ShardedCache) Get(key interface{}) (value interface{}, ok bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	v, found := s.lru.Get(key)
+	if !found {
+		s.mu.Unlock()
+		return nil, false
+	}
+	e := v.(*entry)
+	if e.expired(timer.Time().UnixNano()) {
+		s.lru.Remove(key)
+		s.mu.Unlock()
+		return nil, false
+	}
+	s.mu.Unlock()
+	return e.value, true
+}
+
+// Peek looks up a key's value from the cache without updating its recentness.
+func (c *ShardedCache) Peek(key interface{}) (value interface{}, ok bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	v, found := s.lru.Peek(key)
+	s.mu.Unlock()
+	if !found {
+		return nil, false
+	}
+	e := v.(*entry)
+	if e.expired(timer.Time().UnixNano()) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Delete removes the provided key from the cache.
+func (c *ShardedCache) Delete(key interface{}) {
+	s := c.shard(key)
+	s.mu.Lock()
+	s.lru.Remove(key)
+	s.mu.Unlock()
+}
+
+// Keys returns a slice of the non expired keys in the cache.
+// Keys are ordered from oldest to newest inside each shard.
+func (c *ShardedCache) Keys() []interface{} {
+	now := timer.Time().UnixNano()
+	keys := make([]interface{}, 0, c.Len())
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for _, k := range s.lru.Keys() {
+			if v, ok := s.lru.Peek(k); ok && !v.(*entry).expired(now) {
+				keys = append(keys, k)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return keys
+}
+
+// Len returns the number of items in the cache.
+// This may include items that have expired but have not yet been removed.
+func (c *ShardedCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Resize changes the total cache capacity, splitting it again across the
+// existing shards. Returns the number of evicted items.
+func (c *ShardedCache) Resize(size uint) (evicted int) {
+	n := uint(len(c.shards))
+	if size < n {
+		size = n
+	}
+	for i, s := range c.shards {
+		s.mu.Lock()
+		evicted += s.lru.Resize(shardSize(size, n, uint(i)))
+		s.mu.Unlock()
+	}
+	return evicted
+}
+
+// Purge removes all the items from the cache.
+func (c *ShardedCache) Purge() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.lru.Purge()
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,97 @@
+package lru
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedCache(t *testing.T) {
+	t.Run("add-get-delete", func(t *testing.T) {
+		c := NewShardedLRUCache(64, 4, 0)
+		c.Add("foo", 1)
+		v, ok := c.Get("foo")
+		assert.True(t, ok)
+		assert.Equal(t, 1, v)
+		c.Delete("foo")
+		_, ok = c.Get("foo")
+		assert.False(t, ok)
+	})
+	t.Run("capacity-split", func(t *testing.T) {
+		c := NewShardedLRUCache(10, 4, 0)
+		assert.Equal(t, 3, shardSize(10, 4, 0))
+		assert.Equal(t, 2, shardSize(10, 4, 3))
+		for i := 0; i < 100; i++ {
+			c.Add(strconv.Itoa(i), i)
+		}
+		assert.Equal(t, 10, c.Len())
+		assert.Len(t, c.Keys(), 10)
+	})
+	t.Run("peek-does-not-promote", func(t *testing.T) {
+		c := NewShardedLRUCache(2, 1, 0)
+		c.Add("a", 1)
+		c.Add("b", 2)
+		v, ok := c.Peek("a")
+		assert.True(t, ok)
+		assert.Equal(t, 1, v)
+		c.Add("c", 3)
+		_, ok = c.Peek("a")
+		assert.False(t, ok)
+	})
+	t.Run("ttl", func(t *testing.T) {
+		c := NewShardedLRUCache(16, 2, 0)
+		c.AddWithTTL("short", 1, 50*time.Millisecond)
+		c.AddWithTTL("forever", 2, NoExpiration)
+		time.Sleep(300 * time.Millisecond)
+		_, ok := c.Get("short")
+		assert.False(t, ok)
+		_, ok = c.Peek("forever")
+		assert.True(t, ok)
+		assert.Equal(t, []interface{}{"forever"}, c.Keys())
+	})
+	t.Run("resize", func(t *testing.T) {
+		c := NewShardedLRUCache(100, 4, 0)
+		for i := 0; i < 100; i++ {
+			c.Add(i, i)
+		}
+		before := c.Len()
+		evicted := c.Resize(20)
+		assert.Equal(t, before-c.Len(), evicted)
+		assert.LessOrEqual(t, c.Len(), 20)
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		c := NewShardedLRUCache(1024, 16, time.Minute)
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					k := strconv.Itoa(g*1000 + i)
+					c.Add(k, i)
+					c.Get(k)
+				}
+			}(g)
+		}
+		wg.Wait()
+		assert.Equal(t, 1024, c.Len())
+	})
+}
+
+func BenchmarkShardedCache(b *testing.B) {
+	c := NewShardedLRUCache(4096, 32, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := strconv.Itoa(i & 8191)
+			c.Add(k, i)
+			c.Get(k)
+			i++
+		}
+	})
+}
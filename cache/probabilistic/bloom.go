@@ -0,0 +1,304 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package probabilistic
+
+import (
+	"math"
+)
+
+const (
+	// DefaultBloomGrowth is the capacity multiplier applied
+	// to every new filter of a scalable bloom filter
+	DefaultBloomGrowth = 2
+	// DefaultBloomTightening is the false positive rate multiplier
+	// applied to every new filter of a scalable bloom filter
+	DefaultBloomTightening = 0.85
+)
+
+// BloomFilter is a fixed size bloom filter. Membership tests may return
+// false positives at the configured rate, but never false negatives.
+// It is not safe for concurrent use.
+type BloomFilter struct {
+	capacity uint64
+	m        uint64
+	k        uint64
+	n        uint64
+	bits     []uint64
+}
+
+// NewBloomFilter creates a bloom filter sized to hold capacity items
+// with the given false positive rate
+func NewBloomFilter(capacity uint, fpRate float64) *BloomFilter {
+	if capacity == 0 {
+		capacity = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		panic(errInvalidParams)
+	}
+	n := float64(capacity)
+	m := uint64(math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Ceil(float64(m) / n * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	// round m up to a full word
+	m = (m + 63) &^ 63
+	f := BloomFilter{
+		capacity: uint64(capacity),
+		m:        m,
+		k:        k,
+		bits:     make([]uint64, m/64),
+	}
+	return &f
+}
+
+// Add adds data to the filter
+func (f *BloomFilter) Add(data []byte) {
+	h1, h2 := hashes(data)
+	for i := uint64(0); i < f.k; i++ {
+		p := (h1 + i*h2) % f.m
+		f.bits[p>>6] |= 1 << (p & 63)
+	}
+	f.n++
+}
+
+// AddString adds a string to the filter
+func (f *BloomFilter) AddString(s string) {
+	f.Add([]byte(s))
+}
+
+// Test returns true if data may be in the filter,
+// and false if it is definitely not.
+func (f *BloomFilter) Test(data []byte) bool {
+	h1, h2 := hashes(data)
+	return f.test(h1, h2)
+}
+
+// TestString returns true if a string may be in the filter
+func (f *BloomFilter) TestString(s string) bool {
+	return f.Test([]byte(s))
+}
+
+func (f *BloomFilter) test(h1, h2 uint64) bool {
+	for i := uint64(0); i < f.k; i++ {
+		p := (h1 + i*h2) % f.m
+		if f.bits[p>>6]&(1<<(p&63)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns the number of items added to the filter
+func (f *BloomFilter) Count() uint64 {
+	return f.n
+}
+
+// Capacity returns the number of items the filter was sized for
+func (f *BloomFilter) Capacity() uint64 {
+	return f.capacity
+}
+
+// Merge adds every item of other to the filter.
+// Both filters must have been created with the same parameters.
+func (f *BloomFilter) Merge(other *BloomFilter) error {
+	if f.m != other.m || f.k != other.k {
+		return errIncompatible
+	}
+	for i, w := range other.bits {
+		f.bits[i] |= w
+	}
+	f.n += other.n
+	return nil
+}
+
+func (f *BloomFilter) clone() *BloomFilter {
+	c := *f
+	c.bits = append([]uint64(nil), f.bits...)
+	return &c
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (f *BloomFilter) MarshalBinary() ([]byte, error) {
+	e := newEncoder(tagBloom, 32+len(f.bits)*8)
+	f.encode(e)
+	return e.buf, nil
+}
+
+func (f *BloomFilter) encode(e *encoder) {
+	e.u64(f.capacity)
+	e.u64(f.m)
+	e.u64(f.k)
+	e.u64(f.n)
+	for _, w := range f.bits {
+		e.u64(w)
+	}
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (f *BloomFilter) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data, tagBloom)
+	f.decode(d)
+	return d.done()
+}
+
+func (f *BloomFilter) decode(d *decoder) {
+	f.capacity = d.u64()
+	f.m = d.u64()
+	f.k = d.u64()
+	f.n = d.u64()
+	if d.err == nil && (f.m == 0 || f.m%64 != 0 || f.k == 0 || f.m/8 > uint64(len(d.buf))) {
+		d.err = errInvalidData
+		return
+	}
+	f.bits = make([]uint64, f.m/64)
+	for i := range f.bits {
+		f.bits[i] = d.u64()
+	}
+}
+
+// ScalableBloomFilter is a bloom filter that grows as items are added,
+// keeping its false positive rate bounded. When the current filter is full,
+// a new one with a larger capacity and a tighter false positive rate is
+// appended. It is not safe for concurrent use.
+type ScalableBloomFilter struct {
+	capacity   uint64
+	fpRate     float64
+	growth     uint64
+	tightening float64
+	filters    []*BloomFilter
+}
+
+// NewScalableBloomFilter creates a scalable bloom filter whose first filter holds
+// capacity items, with an overall false positive rate close to fpRate
+func NewScalableBloomFilter(capacity uint, fpRate float64) *ScalableBloomFilter {
+	f := ScalableBloomFilter{
+		capacity:   uint64(capacity),
+		fpRate:     fpRate,
+		growth:     DefaultBloomGrowth,
+		tightening: DefaultBloomTightening,
+	}
+	f.grow()
+	return &f
+}
+
+// grow appends a new filter
+func (f *ScalableBloomFilter) grow() {
+	i := len(f.filters)
+	capacity := f.capacity * uint64(math.Pow(float64(f.growth), float64(i)))
+	// the first filter rate is chosen so that the sum of the geometric
+	// series of the rates of every filter converges to fpRate
+	rate := f.fpRate * (1 - f.tightening) * math.Pow(f.tightening, float64(i))
+	f.filters = append(f.filters, NewBloomFilter(uint(capacity), rate))
+}
+
+// Add adds data to the filter
+func (f *ScalableBloomFilter) Add(data []byte) {
+	h1, h2 := hashes(data)
+	for _, bf := range f.filters {
+		if bf.test(h1, h2) {
+			return
+		}
+	}
+	last := f.filters[len(f.filters)-1]
+	if last.n >= last.capacity {
+		f.grow()
+		last = f.filters[len(f.filters)-1]
+	}
+	last.Add(data)
+}
+
+// AddString adds a string to the filter
+func (f *ScalableBloomFilter) AddString(s string) {
+	f.Add([]byte(s))
+}
+
+// Test returns true if data may be in the filter,
+// and false if it is definitely not.
+func (f *ScalableBloomFilter) Test(data []byte) bool {
+	h1, h2 := hashes(data)
+	for _, bf := range f.filters {
+		if bf.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestString returns true if a string may be in the filter
+func (f *ScalableBloomFilter) TestString(s string) bool {
+	return f.Test([]byte(s))
+}
+
+// Count returns the number of distinct items added to the filter
+func (f *ScalableBloomFilter) Count() uint64 {
+	var n uint64
+	for _, bf := range f.filters {
+		n += bf.n
+	}
+	return n
+}
+
+// Merge adds every item of other to the filter.
+// Both filters must have been created with the same parameters.
+func (f *ScalableBloomFilter) Merge(other *ScalableBloomFilter) error {
+	if f.capacity != other.capacity || f.fpRate != other.fpRate ||
+		f.growth != other.growth || f.tightening != other.tightening {
+		return errIncompatible
+	}
+	// filters at the same position have the same shape
+	for i, bf := range other.filters {
+		if i < len(f.filters) {
+			if err := f.filters[i].Merge(bf); err != nil {
+				return err
+			}
+			continue
+		}
+		f.filters = append(f.filters, bf.clone())
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (f *ScalableBloomFilter) MarshalBinary() ([]byte, error) {
+	e := newEncoder(tagScalableBloom, 64)
+	e.u64(f.capacity)
+	e.f64(f.fpRate)
+	e.u64(f.growth)
+	e.f64(f.tightening)
+	e.u32(uint32(len(f.filters)))
+	for _, bf := range f.filters {
+		bf.encode(e)
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (f *ScalableBloomFilter) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data, tagScalableBloom)
+	f.capacity = d.u64()
+	f.fpRate = d.f64()
+	f.growth = d.u64()
+	f.tightening = d.f64()
+	n := d.u32()
+	if d.err == nil && n == 0 {
+		return errInvalidData
+	}
+	f.filters = nil
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		bf := &BloomFilter{}
+		bf.decode(d)
+		f.filters = append(f.filters, bf)
+	}
+	return d.done()
+}
@@ -0,0 +1,231 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package probabilistic
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// HeavyHitter is one of the most frequent items seen by a CountMinSketch
+type HeavyHitter struct {
+	Key   string
+	Count uint64
+}
+
+// CountMinSketch estimates item frequencies in a stream. Estimations never
+// underestimate, and overestimate by at most epsilon times the total count
+// with probability 1-delta. It optionally tracks the k most frequent items.
+// It is not safe for concurrent use.
+type CountMinSketch struct {
+	width  uint32
+	depth  uint32
+	total  uint64
+	counts []uint64
+	k      uint32
+	top    topK
+}
+
+// NewCountMinSketch creates a count-min sketch with given error bounds.
+// If k is greater than zero, the k most frequent items are tracked.
+func NewCountMinSketch(epsilon, delta float64, k uint) *CountMinSketch {
+	if epsilon <= 0 || delta <= 0 || delta >= 1 {
+		panic(errInvalidParams)
+	}
+	width := uint32(math.Ceil(math.E / epsilon))
+	depth := uint32(math.Ceil(math.Log(1 / delta)))
+	if depth == 0 {
+		depth = 1
+	}
+	s := CountMinSketch{
+		width:  width,
+		depth:  depth,
+		counts: make([]uint64, width*depth),
+		k:      uint32(k),
+		top:    topK{index: map[string]int{}},
+	}
+	return &s
+}
+
+// Add increments the count of data and returns its new estimated count
+func (s *CountMinSketch) Add(data []byte, count uint64) uint64 {
+	h1, h2 := hashes(data)
+	est := uint64(math.MaxUint64)
+	for i := uint32(0); i < s.depth; i++ {
+		p := i*s.width + uint32((h1+uint64(i)*h2)%uint64(s.width))
+		s.counts[p] += count
+		if s.counts[p] < est {
+			est = s.counts[p]
+		}
+	}
+	s.total += count
+	if s.k > 0 {
+		s.top.update(string(data), est, int(s.k))
+	}
+	return est
+}
+
+// AddString increments the count of a string
+func (s *CountMinSketch) AddString(key string, count uint64) uint64 {
+	return s.Add([]byte(key), count)
+}
+
+// Count returns the estimated count of data
+func (s *CountMinSketch) Count(data []byte) uint64 {
+	h1, h2 := hashes(data)
+	est := uint64(math.MaxUint64)
+	for i := uint32(0); i < s.depth; i++ {
+		p := i*s.width + uint32((h1+uint64(i)*h2)%uint64(s.width))
+		if s.counts[p] < est {
+			est = s.counts[p]
+		}
+	}
+	return est
+}
+
+// CountString returns the estimated count of a string
+func (s *CountMinSketch) CountString(key string) uint64 {
+	return s.Count([]byte(key))
+}
+
+// Total returns the sum of every count added
+func (s *CountMinSketch) Total() uint64 {
+	return s.total
+}
+
+// TopK returns the tracked most frequent items sorted by decreasing count
+func (s *CountMinSketch) TopK() []HeavyHitter {
+	out := append([]HeavyHitter(nil), s.top.items...)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count == out[j].Count {
+			return out[i].Key < out[j].Key
+		}
+		return out[i].Count > out[j].Count
+	})
+	return out
+}
+
+// Merge adds every count of other to the sketch.
+// Both sketches must have been created with the same parameters.
+func (s *CountMinSketch) Merge(other *CountMinSketch) error {
+	if s.width != other.width || s.depth != other.depth || s.k != other.k {
+		return errIncompatible
+	}
+	for i, c := range other.counts {
+		s.counts[i] += c
+	}
+	s.total += other.total
+	if s.k > 0 {
+		// candidates of both sides are estimated again against the merged counters
+		candidates := append(append([]HeavyHitter(nil), s.top.items...), other.top.items...)
+		s.top = topK{index: map[string]int{}}
+		for _, c := range candidates {
+			s.top.update(c.Key, s.CountString(c.Key), int(s.k))
+		}
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (s *CountMinSketch) MarshalBinary() ([]byte, error) {
+	e := newEncoder(tagCountMin, 24+len(s.counts)*8)
+	e.u32(s.width)
+	e.u32(s.depth)
+	e.u64(s.total)
+	for _, c := range s.counts {
+		e.u64(c)
+	}
+	e.u32(s.k)
+	e.u32(uint32(len(s.top.items)))
+	for _, hh := range s.top.items {
+		e.bytes([]byte(hh.Key))
+		e.u64(hh.Count)
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (s *CountMinSketch) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data, tagCountMin)
+	width := d.u32()
+	depth := d.u32()
+	total := d.u64()
+	if d.err != nil || width == 0 || depth == 0 || uint64(width)*uint64(depth)*8 > uint64(len(d.buf)) {
+		return errInvalidData
+	}
+	counts := make([]uint64, width*depth)
+	for i := range counts {
+		counts[i] = d.u64()
+	}
+	k := d.u32()
+	n := d.u32()
+	if d.err == nil && n > k {
+		return errInvalidData
+	}
+	top := topK{index: map[string]int{}}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		key := string(d.bytes())
+		top.update(key, d.u64(), int(k))
+	}
+	if err := d.done(); err != nil {
+		return err
+	}
+	s.width, s.depth, s.total, s.counts, s.k, s.top = width, depth, total, counts, k, top
+	return nil
+}
+
+// topK is a min heap of the most frequent items, indexed by key
+type topK struct {
+	items []HeavyHitter
+	index map[string]int
+}
+
+func (t *topK) Len() int           { return len(t.items) }
+func (t *topK) Less(i, j int) bool { return t.items[i].Count < t.items[j].Count }
+func (t *topK) Swap(i, j int) {
+	t.items[i], t.items[j] = t.items[j], t.items[i]
+	t.index[t.items[i].Key] = i
+	t.index[t.items[j].Key] = j
+}
+func (t *topK) Push(x interface{}) {
+	hh := x.(HeavyHitter)
+	t.index[hh.Key] = len(t.items)
+	t.items = append(t.items, hh)
+}
+func (t *topK) Pop() interface{} {
+	last := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	delete(t.index, last.Key)
+	return last
+}
+
+// update sets the estimated count of key, replacing the
+// least frequent item if key is not tracked and k are
+func (t *topK) update(key string, count uint64, k int) {
+	if i, found := t.index[key]; found {
+		t.items[i].Count = count
+		heap.Fix(t, i)
+		return
+	}
+	if len(t.items) < k {
+		heap.Push(t, HeavyHitter{Key: key, Count: count})
+		return
+	}
+	if count > t.items[0].Count {
+		delete(t.index, t.items[0].Key)
+		t.items[0] = HeavyHitter{Key: key, Count: count}
+		t.index[key] = 0
+		heap.Fix(t, 0)
+	}
+}
@@ -0,0 +1,239 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package probabilistic
+
+const (
+	// cuckooBucketSize is the number of fingerprints stored per bucket
+	cuckooBucketSize = 4
+	// cuckooMaxKicks is the number of relocations attempted before
+	// an insertion is considered failed
+	cuckooMaxKicks = 500
+)
+
+// CuckooFilter is a membership filter that, unlike a bloom filter, supports
+// deleting items. It stores a 16 bit fingerprint of every item in one of two
+// candidate buckets, giving a false positive rate close to 0.01%.
+// It is not safe for concurrent use.
+type CuckooFilter struct {
+	buckets []uint16
+	mask    uint64
+	count   uint64
+	// xorshift state used to pick the fingerprint to relocate
+	rnd uint64
+}
+
+// NewCuckooFilter creates a cuckoo filter able to hold at least capacity items
+func NewCuckooFilter(capacity uint) *CuckooFilter {
+	n := uint64(1)
+	// keep the load factor under 95%
+	for n*cuckooBucketSize*95/100 < uint64(capacity) {
+		n <<= 1
+	}
+	f := CuckooFilter{
+		buckets: make([]uint16, n*cuckooBucketSize),
+		mask:    n - 1,
+		rnd:     0x9e3779b97f4a7c15,
+	}
+	return &f
+}
+
+// fingerprint returns the fingerprint and the two candidate buckets of data
+func (f *CuckooFilter) fingerprint(data []byte) (uint16, uint64, uint64) {
+	h, _ := hashes(data)
+	fp := uint16(h >> 48)
+	if fp == 0 {
+		// zero marks an empty slot
+		fp = 1
+	}
+	i1 := h & f.mask
+	return fp, i1, f.alt(i1, fp)
+}
+
+// alt returns the alternate bucket of a fingerprint stored in bucket i
+func (f *CuckooFilter) alt(i uint64, fp uint16) uint64 {
+	return (i ^ mix(uint64(fp))) & f.mask
+}
+
+func (f *CuckooFilter) bucket(i uint64) []uint16 {
+	return f.buckets[i*cuckooBucketSize : (i+1)*cuckooBucketSize]
+}
+
+func (f *CuckooFilter) insertInto(i uint64, fp uint16) bool {
+	b := f.bucket(i)
+	for j := range b {
+		if b[j] == 0 {
+			b[j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+func (f *CuckooFilter) contains(i uint64, fp uint16) bool {
+	for _, v := range f.bucket(i) {
+		if v == fp {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *CuckooFilter) next() uint64 {
+	f.rnd ^= f.rnd << 13
+	f.rnd ^= f.rnd >> 7
+	f.rnd ^= f.rnd << 17
+	return f.rnd
+}
+
+// Insert adds data to the filter. It returns false if the filter is full.
+// Inserting the same item twice stores it twice, so it must be deleted twice.
+func (f *CuckooFilter) Insert(data []byte) bool {
+	fp, i1, i2 := f.fingerprint(data)
+	return f.insert(fp, i1, i2)
+}
+
+// InsertString adds a string to the filter
+func (f *CuckooFilter) InsertString(s string) bool {
+	return f.Insert([]byte(s))
+}
+
+func (f *CuckooFilter) insert(fp uint16, i1, i2 uint64) bool {
+	if f.insertInto(i1, fp) || f.insertInto(i2, fp) {
+		f.count++
+		return true
+	}
+	// both buckets are full: relocate existing fingerprints,
+	// keeping track of them to undo the moves on failure
+	type move struct {
+		i uint64
+		j uint64
+		v uint16
+	}
+	var moves []move
+	i := i1
+	if f.next()&1 == 1 {
+		i = i2
+	}
+	for k := 0; k < cuckooMaxKicks; k++ {
+		j := f.next() % cuckooBucketSize
+		b := f.bucket(i)
+		moves = append(moves, move{i: i, j: j, v: b[j]})
+		fp, b[j] = b[j], fp
+		i = f.alt(i, fp)
+		if f.insertInto(i, fp) {
+			f.count++
+			return true
+		}
+	}
+	// undo the relocations so that no item is lost
+	for k := len(moves) - 1; k >= 0; k-- {
+		m := moves[k]
+		f.bucket(m.i)[m.j] = m.v
+	}
+	return false
+}
+
+// Lookup returns true if data may be in the filter,
+// and false if it is definitely not.
+func (f *CuckooFilter) Lookup(data []byte) bool {
+	fp, i1, i2 := f.fingerprint(data)
+	return f.contains(i1, fp) || f.contains(i2, fp)
+}
+
+// LookupString returns true if a string may be in the filter
+func (f *CuckooFilter) LookupString(s string) bool {
+	return f.Lookup([]byte(s))
+}
+
+// Delete removes one copy of data from the filter. It returns false if it
+// was not found. Deleting an item that was never inserted may remove
+// another item sharing the same fingerprint.
+func (f *CuckooFilter) Delete(data []byte) bool {
+	fp, i1, i2 := f.fingerprint(data)
+	for _, i := range [2]uint64{i1, i2} {
+		b := f.bucket(i)
+		for j := range b {
+			if b[j] == fp {
+				b[j] = 0
+				f.count--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DeleteString removes one copy of a string from the filter
+func (f *CuckooFilter) DeleteString(s string) bool {
+	return f.Delete([]byte(s))
+}
+
+// Count returns the number of items in the filter
+func (f *CuckooFilter) Count() uint64 {
+	return f.count
+}
+
+// Merge inserts every item of other into the filter. Both filters must
+// have the same number of buckets. If the filter becomes full, an error
+// is returned and the items merged so far are kept.
+func (f *CuckooFilter) Merge(other *CuckooFilter) error {
+	if f.mask != other.mask {
+		return errIncompatible
+	}
+	for i := uint64(0); i <= other.mask; i++ {
+		for _, fp := range other.bucket(i) {
+			if fp == 0 {
+				continue
+			}
+			if !f.insert(fp, i, f.alt(i, fp)) {
+				return errFilterFull
+			}
+		}
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (f *CuckooFilter) MarshalBinary() ([]byte, error) {
+	e := newEncoder(tagCuckoo, 24+len(f.buckets)*2)
+	e.u64(f.mask + 1)
+	e.u64(f.count)
+	e.u64(f.rnd)
+	for _, v := range f.buckets {
+		e.buf = append(e.buf, byte(v>>8), byte(v))
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (f *CuckooFilter) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data, tagCuckoo)
+	n := d.u64()
+	count := d.u64()
+	rnd := d.u64()
+	// n is checked against the data left before multiplying, so that
+	// crafted sizes cannot overflow
+	if d.err != nil || n == 0 || n&(n-1) != 0 || n > uint64(len(d.buf))/(cuckooBucketSize*2) ||
+		n*cuckooBucketSize*2 != uint64(len(d.buf)) || rnd == 0 {
+		return errInvalidData
+	}
+	f.mask = n - 1
+	f.count = count
+	f.rnd = rnd
+	f.buckets = make([]uint16, n*cuckooBucketSize)
+	for i := range f.buckets {
+		b := d.next(2)
+		f.buckets[i] = uint16(b[0])<<8 | uint16(b[1])
+	}
+	return d.done()
+}
@@ -0,0 +1,128 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package probabilistic
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// encoder writes big endian fixed size values. Every serialized
+// structure starts with its type tag and the format version.
+type encoder struct {
+	buf []byte
+}
+
+func newEncoder(tag byte, size int) *encoder {
+	e := &encoder{buf: make([]byte, 0, size+2)}
+	e.buf = append(e.buf, tag, formatVersion)
+	return e
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) u64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) f64(v float64) {
+	e.u64(math.Float64bits(v))
+}
+
+// bytes writes a length prefixed byte slice
+func (e *encoder) bytes(v []byte) {
+	e.u32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// decoder reads the values written by encoder. Once an error
+// is found, every following read returns a zero value.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func newDecoder(data []byte, tag byte) *decoder {
+	d := &decoder{buf: data}
+	if len(data) < 2 || data[0] != tag || data[1] != formatVersion {
+		d.err = errInvalidData
+		return d
+	}
+	d.buf = data[2:]
+	return d
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errInvalidData
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) f64() float64 {
+	return math.Float64frombits(d.u64())
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.u32()
+	if b := d.next(int(n)); b != nil {
+		return append([]byte(nil), b...)
+	}
+	return nil
+}
+
+// done returns the first error found, or errInvalidData
+// if there are unread bytes left
+func (d *decoder) done() error {
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = errInvalidData
+	}
+	return d.err
+}
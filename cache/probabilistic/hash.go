@@ -0,0 +1,74 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package probabilistic provides memory efficient approximate data structures
+// for membership, cardinality and frequency queries. Every structure can be
+// merged with another one of the same shape and serialized with
+// encoding.BinaryMarshaler, so it can be stored in a cache.Cache snapshot.
+package probabilistic
+
+import (
+	"encoding/gob"
+	"errors"
+
+	"github.com/zerjioang/zgo/cache/lru"
+)
+
+// binary format version shared by every structure
+const formatVersion = 1
+
+// type tags written as first byte of every serialized structure
+const (
+	tagBloom byte = iota + 1
+	tagScalableBloom
+	tagCuckoo
+	tagHyperLogLog
+	tagCountMin
+)
+
+var (
+	errInvalidData   = errors.New("probabilistic: invalid serialized data")
+	errIncompatible  = errors.New("probabilistic: cannot merge structures with different parameters")
+	errInvalidParams = errors.New("probabilistic: invalid parameters")
+	errFilterFull    = errors.New("probabilistic: filter is full")
+)
+
+func init() {
+	// register the types so that they can be restored
+	// from a cache.Cache snapshot using gob
+	gob.Register(&BloomFilter{})
+	gob.Register(&ScalableBloomFilter{})
+	gob.Register(&CuckooFilter{})
+	gob.Register(&HyperLogLog{})
+	gob.Register(&CountMinSketch{})
+}
+
+// hashes returns two 64 bit hashes of data. The first one is the FNV-1a hash
+// and the second one is derived from it, so that k hash functions can be
+// simulated using double hashing as h1 + i*h2.
+func hashes(data []byte) (uint64, uint64) {
+	h1 := mix(lru.Hash64aSlice(data))
+	h2 := mix(h1 ^ 0x9e3779b97f4a7c15)
+	// make sure h2 is odd, so that it never cycles over a subset
+	return h1, h2 | 1
+}
+
+// mix is the splitmix64 finalizer. FNV-1a output is not uniform enough
+// in its high bits for short keys, which HyperLogLog relies on.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,172 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package probabilistic
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	// MinPrecision is the lowest HyperLogLog precision allowed
+	MinPrecision = 4
+	// MaxPrecision is the highest HyperLogLog precision allowed
+	MaxPrecision = 18
+	// DefaultPrecision uses 16KB of registers for a standard error of 0.81%
+	DefaultPrecision = 14
+)
+
+// linear counting thresholds per precision, as published in the HyperLogLog++ paper
+var hllThreshold = [...]float64{
+	10, 20, 40, 80, 220, 400, 900, 1800, 3100, 6500, 11500, 20000, 50000, 120000, 350000,
+}
+
+// HyperLogLog estimates the number of distinct items added to it using
+// 2^precision registers of one byte. It follows HyperLogLog++: it uses a
+// 64 bit hash, so no large range correction is needed, and switches to
+// linear counting for small cardinalities. It is not safe for concurrent use.
+type HyperLogLog struct {
+	p         uint8
+	registers []uint8
+}
+
+// NewHyperLogLog creates a HyperLogLog with given precision,
+// that must be between MinPrecision and MaxPrecision.
+// The standard error of the estimation is 1.04/sqrt(2^precision).
+func NewHyperLogLog(precision uint8) (*HyperLogLog, error) {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, errInvalidParams
+	}
+	h := HyperLogLog{
+		p:         precision,
+		registers: make([]uint8, 1<<precision),
+	}
+	return &h, nil
+}
+
+// Add adds data to the HyperLogLog
+func (h *HyperLogLog) Add(data []byte) {
+	x, _ := hashes(data)
+	h.insert(x)
+}
+
+// AddString adds a string to the HyperLogLog
+func (h *HyperLogLog) AddString(s string) {
+	h.Add([]byte(s))
+}
+
+func (h *HyperLogLog) insert(x uint64) {
+	idx := x >> (64 - h.p)
+	// the sentinel bit bounds the rank to 64-p+1
+	w := x<<h.p | 1<<(h.p-1)
+	rho := uint8(bits.LeadingZeros64(w)) + 1
+	if rho > h.registers[idx] {
+		h.registers[idx] = rho
+	}
+}
+
+// Count returns the estimated number of distinct items
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	q := 64 - int(h.p)
+	// histogram of register values
+	c := make([]float64, q+2)
+	for _, r := range h.registers {
+		c[r]++
+	}
+	if c[0] > 0 {
+		lc := m * math.Log(m/c[0])
+		if lc <= hllThreshold[h.p-MinPrecision] {
+			return uint64(lc + 0.5)
+		}
+	}
+	// the raw HyperLogLog estimate is biased for cardinalities under 5m.
+	// Instead of the HyperLogLog++ empirical bias tables, the improved
+	// estimator of Otmar Ertl is used, which is unbiased over the whole range.
+	z := m * hllTau(1-c[q+1]/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + c[k])
+	}
+	z += m * hllSigma(c[0]/m)
+	return uint64(m*m/(2*math.Ln2*z) + 0.5)
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// Merge adds every item of other to the HyperLogLog.
+// Both must have the same precision.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if h.p != other.p {
+		return errIncompatible
+	}
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	e := newEncoder(tagHyperLogLog, 1+len(h.registers))
+	e.u8(h.p)
+	e.buf = append(e.buf, h.registers...)
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	d := newDecoder(data, tagHyperLogLog)
+	p := d.u8()
+	if d.err != nil || p < MinPrecision || p > MaxPrecision {
+		return errInvalidData
+	}
+	registers := d.next(1 << p)
+	if err := d.done(); err != nil {
+		return err
+	}
+	h.p = p
+	h.registers = append([]uint8(nil), registers...)
+	return nil
+}
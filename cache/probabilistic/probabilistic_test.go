@@ -0,0 +1,226 @@
+package probabilistic
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zerjioang/zgo/cache"
+)
+
+func TestBloomFilter(t *testing.T) {
+	t.Run("no-false-negatives", func(t *testing.T) {
+		f := NewBloomFilter(1000, 0.01)
+		for i := 0; i < 1000; i++ {
+			f.AddString(strconv.Itoa(i))
+		}
+		for i := 0; i < 1000; i++ {
+			assert.True(t, f.TestString(strconv.Itoa(i)))
+		}
+		fp := 0
+		for i := 1000; i < 11000; i++ {
+			if f.TestString(strconv.Itoa(i)) {
+				fp++
+			}
+		}
+		assert.Less(t, fp, 200)
+	})
+	t.Run("merge", func(t *testing.T) {
+		a := NewBloomFilter(100, 0.01)
+		b := NewBloomFilter(100, 0.01)
+		a.AddString("a")
+		b.AddString("b")
+		assert.NoError(t, a.Merge(b))
+		assert.True(t, a.TestString("a"))
+		assert.True(t, a.TestString("b"))
+		assert.Equal(t, errIncompatible, a.Merge(NewBloomFilter(1000, 0.01)))
+	})
+}
+
+func TestScalableBloomFilter(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01)
+	for i := 0; i < 5000; i++ {
+		f.AddString(strconv.Itoa(i))
+	}
+	assert.Greater(t, len(f.filters), 1)
+	for i := 0; i < 5000; i++ {
+		assert.True(t, f.TestString(strconv.Itoa(i)))
+	}
+	fp := 0
+	for i := 5000; i < 25000; i++ {
+		if f.TestString(strconv.Itoa(i)) {
+			fp++
+		}
+	}
+	assert.Less(t, fp, 400)
+
+	other := NewScalableBloomFilter(100, 0.01)
+	other.AddString("other")
+	assert.NoError(t, other.Merge(f))
+	assert.True(t, other.TestString("other"))
+	assert.True(t, other.TestString("4999"))
+}
+
+func TestCuckooFilter(t *testing.T) {
+	t.Run("insert-lookup-delete", func(t *testing.T) {
+		f := NewCuckooFilter(10000)
+		for i := 0; i < 10000; i++ {
+			assert.True(t, f.InsertString(strconv.Itoa(i)))
+		}
+		assert.Equal(t, uint64(10000), f.Count())
+		for i := 0; i < 10000; i++ {
+			assert.True(t, f.LookupString(strconv.Itoa(i)))
+		}
+		for i := 0; i < 5000; i++ {
+			assert.True(t, f.DeleteString(strconv.Itoa(i)))
+		}
+		assert.Equal(t, uint64(5000), f.Count())
+		for i := 5000; i < 10000; i++ {
+			assert.True(t, f.LookupString(strconv.Itoa(i)))
+		}
+		fp := 0
+		for i := 0; i < 5000; i++ {
+			if f.LookupString(strconv.Itoa(i)) {
+				fp++
+			}
+		}
+		assert.Less(t, fp, 10)
+	})
+	t.Run("full", func(t *testing.T) {
+		f := NewCuckooFilter(8)
+		inserted := 0
+		for i := 0; i < 100; i++ {
+			if f.InsertString(strconv.Itoa(i)) {
+				inserted++
+			}
+		}
+		assert.Equal(t, uint64(inserted), f.Count())
+		assert.LessOrEqual(t, inserted, len(f.buckets))
+	})
+	t.Run("merge", func(t *testing.T) {
+		a := NewCuckooFilter(100)
+		b := NewCuckooFilter(100)
+		a.InsertString("a")
+		b.InsertString("b")
+		assert.NoError(t, a.Merge(b))
+		assert.True(t, a.LookupString("a"))
+		assert.True(t, a.LookupString("b"))
+		assert.True(t, a.DeleteString("b"))
+		assert.False(t, a.LookupString("b"))
+	})
+}
+
+func TestHyperLogLog(t *testing.T) {
+	_, err := NewHyperLogLog(2)
+	assert.Equal(t, errInvalidParams, err)
+	for _, n := range []int{10, 1000, 50000, 500000} {
+		h, err := NewHyperLogLog(DefaultPrecision)
+		assert.NoError(t, err)
+		for i := 0; i < n; i++ {
+			h.AddString("visitor-" + strconv.Itoa(i))
+			// duplicates do not change the estimation
+			h.AddString("visitor-" + strconv.Itoa(i/2))
+		}
+		assert.InEpsilon(t, n, h.Count(), 0.03, "n=%d", n)
+	}
+	t.Run("merge", func(t *testing.T) {
+		a, _ := NewHyperLogLog(DefaultPrecision)
+		b, _ := NewHyperLogLog(DefaultPrecision)
+		for i := 0; i < 20000; i++ {
+			a.AddString(strconv.Itoa(i))
+			b.AddString(strconv.Itoa(i + 10000))
+		}
+		assert.NoError(t, a.Merge(b))
+		assert.InEpsilon(t, 30000, a.Count(), 0.03)
+		c, _ := NewHyperLogLog(10)
+		assert.Equal(t, errIncompatible, a.Merge(c))
+	})
+}
+
+func TestCountMinSketch(t *testing.T) {
+	s := NewCountMinSketch(0.001, 0.01, 3)
+	for i := 0; i < 1000; i++ {
+		s.AddString(strconv.Itoa(i), 1)
+	}
+	s.AddString("hot", 500)
+	s.AddString("warm", 300)
+	s.AddString("mild", 200)
+	assert.GreaterOrEqual(t, s.CountString("hot"), uint64(500))
+	assert.LessOrEqual(t, s.CountString("hot"), uint64(500+0.001*float64(s.Total())+1))
+	top := s.TopK()
+	assert.Len(t, top, 3)
+	assert.Equal(t, "hot", top[0].Key)
+	assert.Equal(t, "warm", top[1].Key)
+	assert.Equal(t, "mild", top[2].Key)
+
+	other := NewCountMinSketch(0.001, 0.01, 3)
+	other.AddString("cold", 900)
+	assert.NoError(t, s.Merge(other))
+	assert.Equal(t, "cold", s.TopK()[0].Key)
+	assert.Equal(t, uint64(2900), s.Total())
+}
+
+func TestSerialization(t *testing.T) {
+	bf := NewBloomFilter(100, 0.01)
+	bf.AddString("a")
+	sbf := NewScalableBloomFilter(10, 0.01)
+	for i := 0; i < 100; i++ {
+		sbf.AddString(strconv.Itoa(i))
+	}
+	cf := NewCuckooFilter(100)
+	cf.InsertString("a")
+	hll, _ := NewHyperLogLog(10)
+	hll.AddString("a")
+	cms := NewCountMinSketch(0.01, 0.01, 2)
+	cms.AddString("a", 3)
+
+	t.Run("binary", func(t *testing.T) {
+		raw, err := sbf.MarshalBinary()
+		assert.NoError(t, err)
+		var restored ScalableBloomFilter
+		assert.NoError(t, restored.UnmarshalBinary(raw))
+		assert.Equal(t, sbf, &restored)
+
+		raw, _ = cms.MarshalBinary()
+		var restoredCms CountMinSketch
+		assert.NoError(t, restoredCms.UnmarshalBinary(raw))
+		assert.Equal(t, cms.TopK(), restoredCms.TopK())
+		assert.Equal(t, uint64(3), restoredCms.CountString("a"))
+
+		assert.Equal(t, errInvalidData, restoredCms.UnmarshalBinary(raw[:len(raw)-1]))
+		assert.Equal(t, errInvalidData, restored.UnmarshalBinary(raw))
+	})
+	t.Run("crafted-cuckoo-size", func(t *testing.T) {
+		// 2^61 buckets overflow the expected data length to zero
+		e := newEncoder(tagCuckoo, 24)
+		e.u64(1 << 61)
+		e.u64(0)
+		e.u64(1)
+		var restored CuckooFilter
+		assert.Equal(t, errInvalidData, restored.UnmarshalBinary(e.buf))
+	})
+	t.Run("cache-snapshot", func(t *testing.T) {
+		c := cache.New(cache.NoExpiration, 0)
+		c.Set("bloom", bf, cache.NoExpiration)
+		c.Set("scalable", sbf, cache.NoExpiration)
+		c.Set("cuckoo", cf, cache.NoExpiration)
+		c.Set("hll", hll, cache.NoExpiration)
+		c.Set("cms", cms, cache.NoExpiration)
+		var buf bytes.Buffer
+		assert.NoError(t, c.Save(&buf))
+
+		restored := cache.New(cache.NoExpiration, 0)
+		assert.NoError(t, restored.Load(&buf))
+		v, _ := restored.Get("bloom")
+		assert.True(t, v.(*BloomFilter).TestString("a"))
+		v, _ = restored.Get("scalable")
+		assert.True(t, v.(*ScalableBloomFilter).TestString("99"))
+		v, _ = restored.Get("cuckoo")
+		assert.True(t, v.(*CuckooFilter).LookupString("a"))
+		v, _ = restored.Get("hll")
+		assert.Equal(t, uint64(1), v.(*HyperLogLog).Count())
+		v, _ = restored.Get("cms")
+		assert.Equal(t, uint64(3), v.(*CountMinSketch).CountString("a"))
+	})
+}
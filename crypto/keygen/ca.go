@@ -0,0 +1,221 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package keygen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	errInvalidPEM = errors.New("invalid pem encoded data")
+	errNotCA      = errors.New("certificate is not a certificate authority")
+)
+
+// CA is a certificate authority used to issue the certificates of the
+// members of a cluster, so that members can authenticate each other
+type CA struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// Certificate is an issued certificate and its private key
+type Certificate struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// NewCA generates a new P-256 certificate authority valid for given duration
+func NewCA(commonName string, validity time.Duration) (*CA, error) {
+	k, err := newECKey()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		SubjectKeyId:          keyID(&k.PublicKey),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &k.PublicKey, k)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: k}, nil
+}
+
+// LoadCA loads a certificate authority from its PEM encoded certificate and key
+func LoadCA(certPEM, keyPEM []byte) (*CA, error) {
+	c, err := LoadCertificate(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Cert.IsCA {
+		return nil, errNotCA
+	}
+	return &CA{Cert: c.Cert, Key: c.Key}, nil
+}
+
+// Issue generates a new P-256 certificate signed by the CA, valid for given
+// duration, for both server and client authentication. Hosts are added to
+// the certificate as IP or DNS subject alternative names.
+func (ca *CA) Issue(commonName string, hosts []string, validity time.Duration) (*Certificate, error) {
+	k, err := newECKey()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: commonName},
+		NotBefore:      now.Add(-time.Minute),
+		NotAfter:       now.Add(validity),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		SubjectKeyId:   keyID(&k.PublicKey),
+		AuthorityKeyId: ca.Cert.SubjectKeyId,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.Cert, &k.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{Cert: cert, Key: k}, nil
+}
+
+// Pool returns a certificate pool that trusts the CA
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// CertPEM returns the PEM encoded certificate of the CA
+func (ca *CA) CertPEM() []byte {
+	return encodeCertPEM(ca.Cert)
+}
+
+// KeyPEM returns the PEM encoded private key of the CA
+func (ca *CA) KeyPEM() ([]byte, error) {
+	return encodeKeyPEM(ca.Key)
+}
+
+// LoadCertificate loads a certificate from its PEM encoded certificate and key
+func LoadCertificate(certPEM, keyPEM []byte) (*Certificate, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, errInvalidPEM
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errInvalidPEM
+	}
+	k, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{Cert: cert, Key: k}, nil
+}
+
+// CertPEM returns the PEM encoded certificate
+func (c *Certificate) CertPEM() []byte {
+	return encodeCertPEM(c.Cert)
+}
+
+// KeyPEM returns the PEM encoded private key
+func (c *Certificate) KeyPEM() ([]byte, error) {
+	return encodeKeyPEM(c.Key)
+}
+
+// TLS returns the certificate ready to be used in a tls.Config
+func (c *Certificate) TLS() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.Cert.Raw},
+		PrivateKey:  c.Key,
+		Leaf:        c.Cert,
+	}
+}
+
+// newECKey generates a random P-256 ECDSA private key
+func newECKey() (*ecdsa.PrivateKey, error) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if !elliptic.P256().IsOnCurve(k.X, k.Y) {
+		return nil, errNotInCurve
+	}
+	return k, nil
+}
+
+// keyID returns the subject key identifier of given public key: the SHA-1
+// hash of its marshalled bytes, as described in RFC 5280 section 4.2.1.2
+func keyID(pub *ecdsa.PublicKey) []byte {
+	h := sha1.Sum(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+	return h[:]
+}
+
+func encodeCertPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func encodeKeyPEM(k *ecdsa.PrivateKey) ([]byte, error) {
+	if k == nil {
+		return nil, errNilKey
+	}
+	raw, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: raw}), nil
+}
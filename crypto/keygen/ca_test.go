@@ -0,0 +1,67 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package keygen
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/sha1"
+	"crypto/x509"
+	"github.com/zerjioang/zgo/assert"
+	"testing"
+	"time"
+)
+
+func TestCA(t *testing.T) {
+	ca, err := NewCA("cluster", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ca.Cert.IsCA)
+
+	t.Run("issue", func(t *testing.T) {
+		cert, err := ca.Issue("peer", []string{"127.0.0.1", "cache.local"}, time.Hour)
+		assert.NoError(t, err)
+		_, err = cert.Cert.Verify(x509.VerifyOptions{
+			DNSName:   "cache.local",
+			Roots:     ca.Pool(),
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, cert.Cert.VerifyHostname("127.0.0.1"))
+	})
+	t.Run("key-ids", func(t *testing.T) {
+		cert, err := ca.Issue("peer", nil, time.Hour)
+		assert.NoError(t, err)
+		// key ids are derived from the public keys
+		pub := cert.Key.PublicKey
+		ski := sha1.Sum(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+		assert.True(t, bytes.Equal(ski[:], cert.Cert.SubjectKeyId))
+		assert.True(t, bytes.Equal(keyID(&ca.Key.PublicKey), ca.Cert.SubjectKeyId))
+		assert.True(t, bytes.Equal(ca.Cert.SubjectKeyId, cert.Cert.AuthorityKeyId))
+	})
+	t.Run("pem-roundtrip", func(t *testing.T) {
+		key, err := ca.KeyPEM()
+		assert.NoError(t, err)
+		loaded, err := LoadCA(ca.CertPEM(), key)
+		assert.NoError(t, err)
+		assert.True(t, loaded.Cert.Equal(ca.Cert))
+
+		cert, err := loaded.Issue("peer", nil, time.Hour)
+		assert.NoError(t, err)
+		key, err = cert.KeyPEM()
+		assert.NoError(t, err)
+		_, err = LoadCA(cert.CertPEM(), key)
+		assert.Equal(t, err, errNotCA)
+		_, err = LoadCertificate([]byte("garbage"), key)
+		assert.Equal(t, err, errInvalidPEM)
+	})
+}
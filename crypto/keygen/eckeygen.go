@@ -15,7 +15,6 @@ package keygen
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
@@ -37,13 +36,10 @@ var (
 // GenerateECKeys Generates strong P-256 key pair for development or production envs
 func GenerateECKeys(generateFiles bool) (*ecdsa.PrivateKey, error) {
 	// generates a random P-256 ECDSA private key. secp256r1
-	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	k, err := newECKey()
 	if err != nil {
 		return nil, err
 	}
-	if !elliptic.P256().IsOnCurve(k.X, k.Y) {
-		return nil, errNotInCurve
-	}
 	pKraw, err := exportPrivate(k)
 	if err != nil {
 		return nil, err
@@ -1,9 +1,10 @@
 module github.com/zerjioang/zgo
 
-go 1.17
+go 1.18
 
 require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/golang/protobuf v1.3.1
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/jackc/pgconn v1.10.1
 	github.com/json-iterator/go v1.1.12
@@ -23,7 +24,6 @@ require (
 	github.com/HdrHistogram/hdrhistogram-go v1.1.2 // indirect
 	github.com/andybalholm/brotli v1.0.4 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
 	github.com/jackc/pgio v1.0.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
@@ -0,0 +1,247 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// The writes of audited models made with Create, CreateNoWarnDuplicate,
+// Update, SoftDelete and Delete run in a transaction that reads the row
+// before and after the write, and stores an audit record with the actor of
+// the context, the changed fields and the resulting state of the row.
+// Writes that change nothing are not recorded.
+
+// AuditOp is the operation of an audit record
+type AuditOp string
+
+const (
+	AuditCreate     AuditOp = "create"
+	AuditUpdate     AuditOp = "update"
+	AuditSoftDelete AuditOp = "soft_delete"
+	AuditDelete     AuditOp = "delete"
+)
+
+type actorKey struct{}
+
+// WithActor returns a context whose audited writes are attributed to actor
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor of the context, if any
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// FieldChange is the JSON encoded value of a field before and after a write.
+// Before is empty for created rows, and After for deleted ones.
+type FieldChange struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditRecord is a write of an audited row
+type AuditRecord struct {
+	// ID orders the records of a row
+	ID       uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	Table    string    `gorm:"column:entity_table;not null;index:idx_zgo_audit_entity,priority:1" json:"table"`
+	EntityID string    `gorm:"not null;index:idx_zgo_audit_entity,priority:2" json:"entity_id"`
+	Op       AuditOp   `gorm:"not null" json:"op"`
+	Actor    string    `json:"actor,omitempty"`
+	At       time.Time `gorm:"not null" json:"at"`
+	// Changes holds the JSON encoded map of the changed fields to their FieldChange
+	Changes []byte `json:"changes,omitempty"`
+	// State holds the JSON encoded row after the write, or null if it was removed
+	State []byte `json:"state,omitempty"`
+}
+
+// TableName returns the name of the audit table
+func (AuditRecord) TableName() string {
+	return "zgo_audit"
+}
+
+// Diff returns the fields changed by the write, by their JSON name
+func (r AuditRecord) Diff() (map[string]FieldChange, error) {
+	changes := map[string]FieldChange{}
+	if len(r.Changes) == 0 {
+		return changes, nil
+	}
+	err := json.Unmarshal(r.Changes, &changes)
+	return changes, err
+}
+
+// MigrateAudit creates or updates the audit table
+func MigrateAudit(db *gorm.DB) error {
+	return db.AutoMigrate(&AuditRecord{})
+}
+
+// EnableAudit enables the audit of the writes of given models
+func (s *ORMDatabase) EnableAudit(models ...interface{}) error {
+	tables := make([]string, 0, len(models))
+	for _, model := range models {
+		table, err := s.tableOf(model)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, table)
+	}
+	s.auditMu.Lock()
+	if s.auditTables == nil {
+		s.auditTables = map[string]bool{}
+	}
+	for _, table := range tables {
+		s.auditTables[table] = true
+	}
+	s.auditMu.Unlock()
+	return nil
+}
+
+func (s *ORMDatabase) isAudited(table string) bool {
+	s.auditMu.RLock()
+	defer s.auditMu.RUnlock()
+	return s.auditTables[table]
+}
+
+// audited runs the write of obj, recording it if its table is audited
+func (s *ORMDatabase) audited(ctx context.Context, obj DbItem, op AuditOp, write func(db *gorm.DB) error) error {
+	sch, err := s.schemaOf(obj)
+	if err != nil || !s.isAudited(sch.Table) {
+		return write(s.session().WithContext(ctx))
+	}
+	id := obj.Id()
+	inv := s.deferred()
+	err = s.withInvalidator(inv).WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		before, err := readRow(tx, sch, obj, id)
+		if err != nil {
+			return err
+		}
+		if err := write(tx); err != nil {
+			return err
+		}
+		after, err := readRow(tx, sch, obj, id)
+		if err != nil {
+			return err
+		}
+		changes, err := diff(before, after)
+		if err != nil || len(changes) == 0 {
+			return err
+		}
+		record := AuditRecord{
+			Table:    sch.Table,
+			EntityID: id.String(),
+			Op:       op,
+			Actor:    ActorFromContext(ctx),
+			At:       time.Now(),
+			State:    after,
+		}
+		if record.Changes, err = json.Marshal(changes); err != nil {
+			return err
+		}
+		return CheckResult(tx.Session(&gorm.Session{NewDB: true}).Create(&record), false)
+	})
+	if err == nil {
+		inv.flush()
+	}
+	return err
+}
+
+// readRow returns the JSON encoded row with given id, including soft deleted
+// rows, or nil if there is none
+func readRow(tx *gorm.DB, sch *schema.Schema, obj DbItem, id ID) ([]byte, error) {
+	row := reflect.New(reflect.TypeOf(obj).Elem()).Interface()
+	read := tx.Session(&gorm.Session{NewDB: true}).Unscoped().
+		Where(map[string]interface{}{sch.PrioritizedPrimaryField.DBName: id}).
+		Limit(1).Find(row)
+	if err := CheckResult(read, false); err != nil {
+		return nil, err
+	}
+	if read.RowsAffected == 0 {
+		return nil, nil
+	}
+	return json.Marshal(row)
+}
+
+// diff returns the top level JSON fields that differ between two encoded rows
+func diff(before, after []byte) (map[string]FieldChange, error) {
+	var b, a map[string]json.RawMessage
+	if before != nil {
+		if err := json.Unmarshal(before, &b); err != nil {
+			return nil, err
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal(after, &a); err != nil {
+			return nil, err
+		}
+	}
+	changes := map[string]FieldChange{}
+	for name, value := range a {
+		if old, found := b[name]; !found || !bytes.Equal(old, value) {
+			changes[name] = FieldChange{Before: old, After: value}
+		}
+	}
+	for name, old := range b {
+		if _, found := a[name]; !found {
+			changes[name] = FieldChange{Before: old}
+		}
+	}
+	return changes, nil
+}
+
+// History returns the audit records of the row of obj, oldest first
+func (s *ORMDatabase) History(ctx context.Context, obj DbItem) ([]AuditRecord, error) {
+	table, err := s.tableOf(obj)
+	if err != nil {
+		return nil, err
+	}
+	var records []AuditRecord
+	tx := s.Db.WithContext(ctx).
+		Where(map[string]interface{}{"entity_table": table, "entity_id": obj.Id().String()}).
+		Order("id").Find(&records)
+	return records, CheckResult(tx, false)
+}
+
+// StateAt reconstructs the row of obj as it was at given time into a new
+// item created by gen. It returns ErrNotFound if the row did not exist then.
+func (s *ORMDatabase) StateAt(ctx context.Context, obj DbItem, at time.Time, gen Generator) (interface{}, error) {
+	table, err := s.tableOf(obj)
+	if err != nil {
+		return nil, err
+	}
+	var record AuditRecord
+	tx := s.Db.WithContext(ctx).
+		Where(map[string]interface{}{"entity_table": table, "entity_id": obj.Id().String()}).
+		Where("at <= ?", at).
+		Order("id DESC").Limit(1).Find(&record)
+	if err := CheckResult(tx, false); err != nil {
+		return nil, err
+	}
+	if tx.RowsAffected == 0 || len(record.State) == 0 || string(record.State) == "null" {
+		return nil, &DBError{Kind: ErrNotFound, Table: table}
+	}
+	item := gen()
+	if err := json.Unmarshal(record.State, item); err != nil {
+		return nil, fmt.Errorf("could not decode audited state: %w", err)
+	}
+	return item, nil
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/zerjioang/zgo/storage/storagetest"
+)
+
+var auditColumns = []string{"id", "entity_table", "entity_id", "op", "actor", "at", "changes", "state"}
+
+// queries returns the statements received by fake, up to the first parenthesis
+func queries(fake *storagetest.Database) []string {
+	var found []string
+	for _, s := range fake.Statements() {
+		found = append(found, strings.TrimSpace(strings.SplitN(s.SQL, "(", 2)[0]))
+	}
+	return found
+}
+
+func TestAudit(t *testing.T) {
+	ctx := WithActor(context.Background(), "alice")
+	read := `SELECT * FROM "test_items"`
+
+	t.Run("create", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		assert.NoError(t, db.EnableAudit(&testItem{}))
+		// the row does not exist before the insert
+		fake.On(read).Returns(testColumns).Times(1)
+		fake.On(read).Returns(testColumns, testRow("a", "created", 1))
+		assert.NoError(t, db.Create(ctx, &testItem{Item: Item{ID: "a"}, Name: "created", Score: 1}))
+		assert.Equal(t, []string{
+			"BEGIN",
+			`SELECT * FROM "test_items" WHERE "id" = $1 LIMIT 1`,
+			`INSERT INTO "test_items"`,
+			`SELECT * FROM "test_items" WHERE "id" = $1 LIMIT 1`,
+			`INSERT INTO "zgo_audit"`,
+			"COMMIT",
+		}, queries(fake))
+		insert := fake.Find(`INSERT INTO "zgo_audit"`)[0]
+		args := insert.Args
+		assert.Equal(t, []interface{}{"test_items", "a", string(AuditCreate), "alice"}, []interface{}{args[0], args[1], args[2], args[3]})
+		var changes map[string]FieldChange
+		assert.NoError(t, json.Unmarshal(args[5].([]byte), &changes))
+		assert.Equal(t, FieldChange{After: json.RawMessage(`"created"`)}, changes["Name"])
+		assert.Equal(t, FieldChange{After: json.RawMessage(`1`)}, changes["Score"])
+		var state map[string]interface{}
+		assert.NoError(t, json.Unmarshal(args[6].([]byte), &state))
+		assert.Equal(t, "created", state["Name"])
+	})
+	t.Run("update", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		assert.NoError(t, db.EnableAudit(&testItem{}))
+		fake.On(read).Returns(testColumns, testRow("a", "before", 1)).Times(1)
+		fake.On(read).Returns(testColumns, testRow("a", "after", 1))
+		assert.NoError(t, db.Update(ctx, &testItem{Item: Item{ID: "a"}, Name: "after"}))
+		insert := fake.Find(`INSERT INTO "zgo_audit"`)
+		if assert.Len(t, insert, 1) {
+			assert.Equal(t, string(AuditUpdate), insert[0].Args[2])
+			var changes map[string]FieldChange
+			assert.NoError(t, json.Unmarshal(insert[0].Args[5].([]byte), &changes))
+			// only the changed fields are recorded
+			assert.Equal(t, map[string]FieldChange{
+				"Name": {Before: json.RawMessage(`"before"`), After: json.RawMessage(`"after"`)},
+			}, changes)
+		}
+	})
+	t.Run("delete", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		assert.NoError(t, db.EnableAudit(&testItem{}))
+		fake.On(read).Returns(testColumns, testRow("a", "deleted", 1)).Times(1)
+		fake.On(read).Returns(testColumns)
+		assert.NoError(t, db.Delete(context.Background(), &testItem{Item: Item{ID: "a"}}))
+		insert := fake.Find(`INSERT INTO "zgo_audit"`)
+		if assert.Len(t, insert, 1) {
+			assert.Equal(t, string(AuditDelete), insert[0].Args[2])
+			// writes without actor are recorded anyway
+			assert.Equal(t, "", insert[0].Args[3])
+			assert.Nil(t, insert[0].Args[6])
+		}
+	})
+	t.Run("unchanged", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		assert.NoError(t, db.EnableAudit(&testItem{}))
+		fake.On(read).Returns(testColumns, testRow("a", "same", 1))
+		assert.NoError(t, db.Update(ctx, &testItem{Item: Item{ID: "a"}, Name: "same"}))
+		assert.Empty(t, fake.Find(`INSERT INTO "zgo_audit"`))
+		assert.Equal(t, "COMMIT", queries(fake)[len(queries(fake))-1])
+	})
+	t.Run("not-audited", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		assert.NoError(t, db.EnableAudit(&versionedItem{}))
+		assert.NoError(t, db.Create(ctx, &testItem{}))
+		assert.Equal(t, []string{`INSERT INTO "test_items"`}, queries(fake))
+	})
+	t.Run("failed-write", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		assert.NoError(t, db.EnableAudit(&testItem{}))
+		fake.On(`UPDATE "test_items"`).Fails(errors.New("connection reset"))
+		assert.Error(t, db.Update(ctx, &testItem{Item: Item{ID: "a"}, Name: "after"}))
+		assert.Empty(t, fake.Find(`INSERT INTO "zgo_audit"`))
+		assert.Equal(t, "ROLLBACK", queries(fake)[len(queries(fake))-1])
+	})
+}
+
+func TestCreateNoWarnDuplicate(t *testing.T) {
+	ctx := context.Background()
+	duplicate := &pgconn.PgError{Code: "23505"}
+
+	t.Run("not-audited", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`INSERT INTO "test_items"`).Fails(duplicate)
+		assert.NoError(t, db.CreateNoWarnDuplicate(ctx, &testItem{}))
+		assert.True(t, errors.Is(db.Create(ctx, &testItem{}), ErrDuplicate))
+		for _, insert := range fake.Find(`INSERT INTO "test_items"`) {
+			assert.NotContains(t, insert.SQL, "ON CONFLICT")
+		}
+	})
+	t.Run("audited", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		assert.NoError(t, db.EnableAudit(&testItem{}))
+		fake.On(`INSERT INTO "test_items"`).Fails(duplicate)
+		assert.NoError(t, db.CreateNoWarnDuplicate(ctx, &testItem{Item: Item{ID: "a"}}))
+		// the failed insert aborts the transaction, which is rolled back unrecorded
+		assert.Equal(t, []string{
+			"BEGIN",
+			`SELECT * FROM "test_items" WHERE "id" = $1 LIMIT 1`,
+			`INSERT INTO "test_items"`,
+			"ROLLBACK",
+		}, queries(fake))
+	})
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	updated := created.Add(time.Hour)
+	deleted := updated.Add(time.Hour)
+	record := func(id int64, op AuditOp, at time.Time, changes string, state string) []interface{} {
+		return []interface{}{id, "test_items", "a", string(op), "alice", at, []byte(changes), []byte(state)}
+	}
+	createdState := `{"id":"a","Name":"first","Score":1}`
+	updatedState := `{"id":"a","Name":"second","Score":1}`
+
+	t.Run("history", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "zgo_audit"`).Returns(auditColumns,
+			record(1, AuditCreate, created, `{"Name":{"after":"first"}}`, createdState),
+			record(2, AuditUpdate, updated, `{"Name":{"before":"first","after":"second"}}`, updatedState),
+		)
+		records, err := db.History(ctx, &testItem{Item: Item{ID: "a"}})
+		assert.NoError(t, err)
+		if assert.Len(t, records, 2) {
+			assert.Equal(t, AuditCreate, records[0].Op)
+			assert.Equal(t, "alice", records[0].Actor)
+			assert.Equal(t, AuditUpdate, records[1].Op)
+			changes, err := records[1].Diff()
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]FieldChange{
+				"Name": {Before: json.RawMessage(`"first"`), After: json.RawMessage(`"second"`)},
+			}, changes)
+		}
+		query := fake.Find(`FROM "zgo_audit"`)[0]
+		assert.Equal(t, `SELECT * FROM "zgo_audit" WHERE "entity_id" = $1 AND "entity_table" = $2 ORDER BY id`, query.SQL)
+		assert.Equal(t, []interface{}{"a", "test_items"}, []interface{}{query.Args[0], query.Args[1]})
+	})
+	t.Run("state-at", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "zgo_audit"`).Returns(auditColumns, record(2, AuditUpdate, updated, "{}", updatedState)).Times(1)
+		fake.On(`FROM "zgo_audit"`).Returns(auditColumns, record(3, AuditDelete, deleted, "{}", "null")).Times(1)
+		gen := func() interface{} { return &testItem{} }
+		at := updated.Add(time.Minute)
+		state, err := db.StateAt(ctx, &testItem{Item: Item{ID: "a"}}, at, gen)
+		assert.NoError(t, err)
+		if assert.IsType(t, &testItem{}, state) {
+			assert.Equal(t, "second", state.(*testItem).Name)
+			assert.Equal(t, ID("a"), state.(*testItem).ID)
+		}
+		query := fake.Find(`FROM "zgo_audit"`)[0]
+		assert.Equal(t, `SELECT * FROM "zgo_audit" WHERE "entity_id" = $1 AND "entity_table" = $2 AND at <= $3 ORDER BY id DESC LIMIT 1`, query.SQL)
+		assert.Equal(t, at, query.Args[2])
+
+		// deleted rows and rows not created yet are not found
+		_, err = db.StateAt(ctx, &testItem{Item: Item{ID: "a"}}, deleted, gen)
+		assert.True(t, errors.Is(err, ErrNotFound))
+		_, err = db.StateAt(ctx, &testItem{Item: Item{ID: "a"}}, created.Add(-time.Hour), gen)
+		assert.True(t, errors.Is(err, ErrNotFound))
+	})
+}
+
+func TestDiff(t *testing.T) {
+	changes, err := diff([]byte(`{"a":1,"b":"x","c":true}`), []byte(`{"a":1,"b":"y","d":null}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]FieldChange{
+		"b": {Before: json.RawMessage(`"x"`), After: json.RawMessage(`"y"`)},
+		"c": {Before: json.RawMessage(`true`)},
+		"d": {After: json.RawMessage(`null`)},
+	}, changes)
+	changes, err = diff(nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+	_, err = diff([]byte("{"), nil)
+	assert.Error(t, err)
+}
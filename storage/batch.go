@@ -0,0 +1,144 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultBatchSize is the number of rows written per statement by bulk writes
+const DefaultBatchSize = 1000
+
+var (
+	errNotSlice = errors.New("bulk writes require a slice of models")
+)
+
+// CreateBatch inserts items, a slice of models, batchSize rows per statement.
+// Each batch runs in its own transaction, so when a batch fails the previous
+// ones remain committed. It returns the rows inserted by every committed batch.
+// Bulk writes are not audited.
+func (s *ORMDatabase) CreateBatch(ctx context.Context, items interface{}, batchSize int) ([]int64, error) {
+	return s.batches(ctx, items, batchSize, func(tx *gorm.DB) *gorm.DB {
+		return tx
+	})
+}
+
+// Upsert inserts items, a slice of models, updating the rows that conflict
+// on conflictColumns with the updateColumns of the item. Rows conflict on the
+// primary key when updateColumns are given without conflictColumns. If
+// updateColumns is empty, conflicting rows are left untouched. Columns can be
+// referenced by their struct field name or by their column name. The version
+// of versioned items is incremented on update. Batches are written as with
+// CreateBatch.
+func (s *ORMDatabase) Upsert(ctx context.Context, items interface{}, conflictColumns []string, updateColumns []string) ([]int64, error) {
+	rv := reflect.Indirect(reflect.ValueOf(items))
+	if rv.Kind() != reflect.Slice {
+		return nil, errNotSlice
+	}
+	sch, err := s.schemaOf(items)
+	if err != nil {
+		return nil, err
+	}
+	onConflict := clause.OnConflict{}
+	for _, name := range conflictColumns {
+		f, err := lookup(sch, name)
+		if err != nil {
+			return nil, err
+		}
+		onConflict.Columns = append(onConflict.Columns, clause.Column{Name: f.DBName})
+	}
+	version := sch.LookUpField("Version")
+	if _, ok := reflect.New(sch.ModelType).Interface().(VersionedItem); !ok {
+		version = nil
+	}
+	var updates []string
+	for _, name := range updateColumns {
+		f, err := lookup(sch, name)
+		if err != nil {
+			return nil, err
+		}
+		if f != version {
+			updates = append(updates, f.DBName)
+		}
+	}
+	if len(updates) == 0 {
+		onConflict.DoNothing = true
+	} else {
+		if len(onConflict.Columns) == 0 {
+			// ON CONFLICT DO UPDATE requires a conflict target
+			for _, f := range sch.PrimaryFields {
+				onConflict.Columns = append(onConflict.Columns, clause.Column{Name: f.DBName})
+			}
+		}
+		set := clause.AssignmentColumns(updates)
+		if version != nil {
+			set = append(set, clause.Assignment{
+				Column: clause.Column{Name: version.DBName},
+				Value: clause.Expr{
+					SQL:  "? + 1",
+					Vars: []interface{}{clause.Column{Table: sch.Table, Name: version.DBName}},
+				},
+			})
+		}
+		onConflict.DoUpdates = set
+	}
+	return s.batches(ctx, items, DefaultBatchSize, func(tx *gorm.DB) *gorm.DB {
+		return tx.Clauses(onConflict)
+	})
+}
+
+// batches inserts the items in batches, each one in its own transaction
+func (s *ORMDatabase) batches(ctx context.Context, items interface{}, batchSize int, prepare func(tx *gorm.DB) *gorm.DB) ([]int64, error) {
+	rv := reflect.Indirect(reflect.ValueOf(items))
+	if rv.Kind() != reflect.Slice {
+		return nil, errNotSlice
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	for i := 0; i < rv.Len(); i++ {
+		elem := rv.Index(i)
+		if elem.Kind() != reflect.Ptr && elem.CanAddr() {
+			elem = elem.Addr()
+		}
+		if obj, ok := elem.Interface().(DbItem); ok {
+			// make sure the new objects to be created have a valid id
+			_ = obj.Id()
+			initVersion(obj)
+		}
+	}
+	var affected []int64
+	for start := 0; start < rv.Len(); start += batchSize {
+		end := start + batchSize
+		if end > rv.Len() {
+			end = rv.Len()
+		}
+		batch := rv.Slice(start, end).Interface()
+		var rows int64
+		err := s.AsTransactionWithOptions(ctx, TxOptions{}, func(tx *gorm.DB) error {
+			result := prepare(tx).Create(batch)
+			rows = result.RowsAffected
+			return CheckResult(result, false)
+		})
+		if err != nil {
+			return affected, err
+		}
+		affected = append(affected, rows)
+	}
+	return affected, nil
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zerjioang/zgo/storage/storagetest"
+)
+
+func TestCreateBatch(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("batches", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`INSERT INTO "test_items"`).Affects(2)
+		items := []testItem{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}, {Name: "e"}}
+		affected, err := db.CreateBatch(ctx, items, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{2, 2, 2}, affected)
+		for _, item := range items {
+			assert.NotEmpty(t, item.ID)
+		}
+		// each batch is written in its own transaction
+		assert.Equal(t, []string{
+			"BEGIN", `INSERT INTO "test_items"`, "COMMIT",
+			"BEGIN", `INSERT INTO "test_items"`, "COMMIT",
+			"BEGIN", `INSERT INTO "test_items"`, "COMMIT",
+		}, queries(fake))
+		inserts := fake.Find(`INSERT INTO "test_items"`)
+		assert.Equal(t, 1, strings.Count(inserts[0].SQL, "),("))
+		assert.Equal(t, 0, strings.Count(inserts[2].SQL, "),("))
+	})
+	t.Run("default-size", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		items := []*testItem{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+		_, err := db.CreateBatch(ctx, &items, 0)
+		assert.NoError(t, err)
+		assert.Len(t, fake.Find(`INSERT INTO "test_items"`), 1)
+		assert.NotEmpty(t, items[0].ID)
+	})
+	t.Run("failed-batch", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`INSERT INTO "test_items"`).Times(1)
+		fake.On(`INSERT INTO "test_items"`).Fails(errors.New("connection reset"))
+		items := []testItem{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+		affected, err := db.CreateBatch(ctx, items, 2)
+		assert.Error(t, err)
+		// the first batch remains committed
+		assert.Equal(t, []int64{storagetest.DefaultAffected}, affected)
+		assert.Equal(t, "ROLLBACK", queries(fake)[len(queries(fake))-1])
+	})
+	t.Run("not-slice", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		_, err := db.CreateBatch(ctx, &testItem{}, 2)
+		assert.Equal(t, errNotSlice, err)
+		assert.Empty(t, fake.Statements())
+	})
+}
+
+func TestUpsert(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name     string
+		items    interface{}
+		conflict []string
+		update   []string
+		clause   string
+	}{
+		{
+			name:     "update",
+			items:    []testItem{{Name: "a", Score: 1}},
+			conflict: []string{"Name"},
+			update:   []string{"Score"},
+			clause:   `ON CONFLICT ("name") DO UPDATE SET "score"="excluded"."score","version"="test_items"."version" + 1`,
+		},
+		{
+			name:     "column-names",
+			items:    []testItem{{Name: "a", Score: 1}},
+			conflict: []string{"name"},
+			update:   []string{"score", "updated_at"},
+			clause:   `ON CONFLICT ("name") DO UPDATE SET "score"="excluded"."score","updated_at"="excluded"."updated_at","version"="test_items"."version" + 1`,
+		},
+		{
+			name:   "primary-key",
+			items:  []testItem{{Name: "a", Score: 1}},
+			update: []string{"Name", "Score"},
+			clause: `ON CONFLICT ("id") DO UPDATE SET "name"="excluded"."name","score"="excluded"."score","version"="test_items"."version" + 1`,
+		},
+		{
+			name:     "do-nothing",
+			items:    []testItem{{Name: "a"}},
+			conflict: []string{"Name"},
+			clause:   `ON CONFLICT ("name") DO NOTHING`,
+		},
+		{
+			name:   "do-nothing-any",
+			items:  []testItem{{Name: "a"}},
+			clause: `ON CONFLICT DO NOTHING`,
+		},
+		{
+			name:     "versioned",
+			items:    []versionedItem{{Name: "a"}},
+			conflict: []string{"Name"},
+			update:   []string{"Name", "Version"},
+			clause:   `ON CONFLICT ("name") DO UPDATE SET "name"="excluded"."name","version"="versioned_items"."version" + 1`,
+		},
+		{
+			name:   "versioned-only",
+			items:  []versionedItem{{Name: "a"}},
+			update: []string{"Version"},
+			clause: `ON CONFLICT DO NOTHING`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, fake := newTestDB(t)
+			_, err := db.Upsert(ctx, c.items, c.conflict, c.update)
+			assert.NoError(t, err)
+			found := fake.Find("INSERT INTO")
+			if assert.Len(t, found, 1) {
+				assert.True(t, strings.HasSuffix(found[0].SQL, c.clause), found[0].SQL)
+			}
+		})
+	}
+	invalid := []struct {
+		name     string
+		items    interface{}
+		conflict []string
+		update   []string
+		err      error
+	}{
+		{"unknown-conflict-column", []testItem{{}}, []string{"Missing"}, nil, ErrInvalidQuery},
+		{"unknown-update-column", []testItem{{}}, []string{"Name"}, []string{"Missing"}, ErrInvalidQuery},
+		{"not-slice", &testItem{}, nil, nil, errNotSlice},
+	}
+	for _, c := range invalid {
+		t.Run(c.name, func(t *testing.T) {
+			db, fake := newTestDB(t)
+			_, err := db.Upsert(ctx, c.items, c.conflict, c.update)
+			assert.True(t, errors.Is(err, c.err))
+			assert.Empty(t, fake.Statements())
+		})
+	}
+}
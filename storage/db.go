@@ -16,12 +16,11 @@ import (
 	"context"
 	"errors"
 	"log"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/zerjioang/zgo/cache"
 
-	"github.com/jackc/pgconn"
 	"gorm.io/gorm"
 )
 
@@ -35,6 +34,14 @@ type ORMDatabase struct {
 	Metadata map[string]DbItem
 	// Cache
 	Cache *cache.Cache
+
+	// cached keys of every table, used to invalidate the cache on writes
+	keysOnce      sync.Once
+	keys          *cacheKeys
+	callbacksOnce sync.Once
+	// tables whose writes are audited
+	auditMu     sync.RWMutex
+	auditTables map[string]bool
 }
 
 // compilation time interface implementation check
@@ -47,24 +54,34 @@ var (
 func (s *ORMDatabase) Create(ctx context.Context, obj DbItem) error {
 	// make sure the new object to be created has a valid id
 	_ = obj.Id()
-	tx := s.Db.WithContext(ctx).Create(obj)
-	return CheckResult(tx, false)
+	initVersion(obj)
+	return s.audited(ctx, obj, AuditCreate, func(db *gorm.DB) error {
+		return CheckResult(db.Create(obj), false)
+	})
 }
 
 func (s *ORMDatabase) CreateNoWarnDuplicate(ctx context.Context, obj DbItem) error {
 	// make sure the new object to be created has a valid id
 	_ = obj.Id()
-	tx := s.Db.WithContext(ctx).Create(obj)
-	return CheckResult(tx, true)
+	initVersion(obj)
+	err := s.audited(ctx, obj, AuditCreate, func(db *gorm.DB) error {
+		return CheckResult(db.Create(obj), false)
+	})
+	if errors.Is(err, ErrDuplicate) {
+		// duplicate key error detected. Audited writes are rolled back
+		// before, as the failed insert aborts their transaction
+		return nil
+	}
+	return err
 }
 
 // CreateIfNot attempts to register the given object in the database if not exists
 func (s *ORMDatabase) CreateIfNot(ctx context.Context, obj DbItem) error {
 	// make sure the new object to be created has a valid id
-	tx := s.Db.WithContext(ctx).Where(obj).First(&obj)
+	tx := s.session().WithContext(ctx).Where(obj).First(&obj)
 	if err := CheckResult(tx, false); err != nil {
 		// handler error
-		if err.Error() == "record not found" {
+		if errors.Is(err, ErrNotFound) {
 			// write the item to the database and return any error occured
 			return s.Create(ctx, obj)
 		}
@@ -74,49 +91,60 @@ func (s *ORMDatabase) CreateIfNot(ctx context.Context, obj DbItem) error {
 	return nil
 }
 
+// ReadByKey reads the item with given primary key. If cacheKey is empty,
+// the item is cached under a key derived from its table and primary key.
 func (s *ORMDatabase) ReadByKey(cacheKey string, ctx context.Context, gen Generator, out interface{}) (interface{}, error) {
-	return s.withCache(cacheKey, gen, 10*time.Minute, func(dst interface{}) error {
-		tx := s.Db.WithContext(ctx).First(dst, "id", out)
+	item := false
+	if cacheKey == "" {
+		if table, err := s.tableOf(gen()); err == nil {
+			cacheKey = itemKey(table, out)
+			item = true
+		}
+	}
+	return s.withCache(cacheKey, item, gen, 10*time.Minute, func(dst interface{}) error {
+		tx := s.session().WithContext(ctx).First(dst, "id", out)
 		return CheckResult(tx, false)
 	})
 }
 
 // ReadOne returns object row in database as unique item
 func (s *ORMDatabase) ReadOne(cacheKey string, ctx context.Context, gen Generator) (interface{}, error) {
-	return s.withCache(cacheKey, gen, 10*time.Minute, func(dst interface{}) error {
-		tx := s.Db.WithContext(ctx).Where(dst).First(&dst)
+	return s.withCache(cacheKey, false, gen, 10*time.Minute, func(dst interface{}) error {
+		tx := s.session().WithContext(ctx).Where(dst).First(&dst)
 		return CheckResult(tx, false)
 	})
 }
 
 // ReadAll makes a SELECT * style operation with given model and reads all fields
 func (s *ORMDatabase) ReadAll(cacheKey string, ctx context.Context, tx *gorm.DB, gen Generator) (interface{}, error) {
-	return s.withCache(cacheKey, gen, 10*time.Minute, func(dst interface{}) error {
+	return s.withCache(cacheKey, false, gen, 10*time.Minute, func(dst interface{}) error {
 		if tx != nil {
 			// reuse passed tx Db context
 			tx = tx.Find(dst) // find product with integer primary key
 			return CheckResult(tx, false)
 		}
-		tx = s.Db.WithContext(ctx).Find(dst) // find product with integer primary key
+		tx = s.session().WithContext(ctx).Find(dst) // find product with integer primary key
 		return CheckResult(tx, false)
 	})
 }
 
 // ReadAllWithFields makes a SELECT query and ONLY retrieves selected column names
 func (s *ORMDatabase) ReadAllWithFields(key string, ctx context.Context, tx *gorm.DB, genObj func() interface{}, columns ...string) (interface{}, error) {
-	return s.withCache(key, genObj, 10*time.Minute, func(dst interface{}) error {
+	return s.withCache(key, false, genObj, 10*time.Minute, func(dst interface{}) error {
 		if tx != nil {
 			// reuse passed tx Db context
 			tx = tx.Select(columns).Find(dst)
 		} else {
-			tx = s.Db.WithContext(ctx).Select(columns).Find(dst)
+			tx = s.session().WithContext(ctx).Select(columns).Find(dst)
 		}
 		return CheckResult(tx, false)
 	})
 }
 
-// ReadAllWithFields makes a SELECT query and ONLY retrieves selected column names
-func (s *ORMDatabase) withCache(key string, gen Generator, d time.Duration, f func(dst interface{}) error) (interface{}, error) {
+// withCache returns the value cached under given key, or reads and caches it.
+// The key is tracked as an item or query key of the table read, so that
+// writes to the table invalidate it. An empty key disables the cache.
+func (s *ORMDatabase) withCache(key string, item bool, gen Generator, d time.Duration, f func(dst interface{}) error) (interface{}, error) {
 	// 1 first check if requested data is in the cache
 	// note that, key value must be unique and must always be paired with method parameters
 	if key != "" {
@@ -130,17 +158,33 @@ func (s *ORMDatabase) withCache(key string, gen Generator, d time.Duration, f fu
 	// cache MISS
 	// we need to generate destination obj to unmarshal data by GORM
 	obj := gen()
+	// the invalidations of the table during the query are detected by
+	// its generation, so that stale reads are not cached
+	table, tableErr := s.tableOf(obj)
+	var generation uint64
+	if key != "" && tableErr == nil {
+		generation = s.generation(table)
+	}
 	if err := f(obj); err != nil {
 		return nil, err
 	}
 	// if no error in database query, add result to cache
-	s.Cache.Set(key, obj, d)
+	if key != "" {
+		if tableErr == nil {
+			s.store(table, generation, key, item, obj, d)
+		} else {
+			s.Cache.Set(key, obj, d)
+		}
+	}
 	return obj, nil
 }
 
+// GetItems reads up to limit rows, every row if zero, in given order into dst.
+//
+// Deprecated: filter is ignored and results cannot be paginated. Use GetPage.
 func (s *ORMDatabase) GetItems(cacheKey string, ctx context.Context, order string, filter DbItem, limit uint, dst Generator) (interface{}, error) {
-	return s.withCache(cacheKey, dst, 10*time.Minute, func(dst interface{}) error {
-		tx := s.Db.WithContext(ctx)
+	return s.withCache(cacheKey, false, dst, 10*time.Minute, func(dst interface{}) error {
+		tx := s.session().WithContext(ctx)
 		if order != "" {
 			tx = tx.Order(order)
 		}
@@ -153,45 +197,53 @@ func (s *ORMDatabase) GetItems(cacheKey string, ctx context.Context, order strin
 }
 
 func (s *ORMDatabase) FindOne(cacheKey string, ctx context.Context, gen Generator, query string, params ...string) (interface{}, error) {
-	return s.withCache(cacheKey, gen, 10*time.Minute, func(dst interface{}) error {
-		tx := s.Db.WithContext(ctx).First(dst, query, params)
+	return s.withCache(cacheKey, false, gen, 10*time.Minute, func(dst interface{}) error {
+		tx := s.session().WithContext(ctx).First(dst, query, params)
 		return CheckResult(tx, false)
 	})
 }
 
 func (s *ORMDatabase) FindByKeyWithFields(ctx context.Context, obj DbItem, columns ...string) error {
-	tx := s.Db.WithContext(ctx).Select(columns).First(obj)
+	tx := s.session().WithContext(ctx).Select(columns).First(obj)
 	return CheckResult(tx, false)
 }
 
+// Update writes the non zero fields of the item. Items with a version fail
+// with ErrConflict if they were modified since they were read.
 func (s *ORMDatabase) Update(ctx context.Context, obj DbItem) error {
-	tx := s.Db.WithContext(ctx).Model(obj).Updates(obj)
-	return CheckResult(tx, false)
+	return s.audited(ctx, obj, AuditUpdate, func(db *gorm.DB) error {
+		return s.updates(db, obj)
+	})
 }
 
 func (s *ORMDatabase) SoftDelete(ctx context.Context, obj DbItem) error {
 	_ = obj.SetDeleted()
-	tx := s.Db.WithContext(ctx).Model(obj).Updates(obj)
-	return CheckResult(tx, false)
+	return s.audited(ctx, obj, AuditSoftDelete, func(db *gorm.DB) error {
+		return s.updates(db, obj)
+	})
 }
 
 func (s *ORMDatabase) Delete(ctx context.Context, obj DbItem) error {
-	tx := s.Db.WithContext(ctx).Delete(obj)
-	return CheckResult(tx, false)
+	return s.audited(ctx, obj, AuditDelete, func(db *gorm.DB) error {
+		return CheckResult(db.Delete(obj), false)
+	})
 }
 
 // Exists returns if the item exists in the database or not
 func (s *ORMDatabase) Exists(ctx context.Context, obj DbItem) (bool, error) {
-	tx := s.Db.WithContext(ctx).Where(obj).First(&obj)
-	if tx.Error != nil {
-		return tx.Error.Error() == "record not found", tx.Error
+	tx := s.session().WithContext(ctx).Where(obj).First(&obj)
+	if err := TranslateError(tx.Error); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
 	}
 	return true, nil
 }
 
 // FindMatches returns a list of matching elements
 func (s *ORMDatabase) FindMatches(ctx context.Context, obj DbItem, dst interface{}) error {
-	tx := s.Db.WithContext(ctx).Find(dst, obj)
+	tx := s.session().WithContext(ctx).Find(dst, obj)
 	return CheckResult(tx, false)
 }
 
@@ -212,8 +264,12 @@ func (s *ORMDatabase) DeleteTable(obj DbItem) error {
 	}
 	// execute the query
 	// we assume GORM provides the right table name an no injections are possible
-	tx := s.Db.Raw("DELETE FROM " + stmt.Schema.Table)
-	return CheckResult(tx, false)
+	tx := s.Db.Exec("DELETE FROM " + stmt.Schema.Table)
+	if err := CheckResult(tx, false); err != nil {
+		return err
+	}
+	s.invalidate(stmt.Schema.Table, nil, true)
+	return nil
 }
 
 // Close closes database connection
@@ -229,6 +285,8 @@ func (s *ORMDatabase) Close() error {
 	return nil
 }
 
+// CheckResult returns the error of given query, classified as one of the
+// typed errors when possible. If noWarnDuplicate is set, duplicate errors are ignored.
 func CheckResult(tx *gorm.DB, noWarnDuplicate bool) error {
 	if tx == nil {
 		return errors.New("could not get a valid response from database")
@@ -241,21 +299,12 @@ func CheckResult(tx *gorm.DB, noWarnDuplicate bool) error {
 	}
 	if tx.Error != nil {
 		log.Println(tx.Error)
-		switch tx.Error.(type) {
-		case *pgconn.PgError:
-			err := tx.Error.(*pgconn.PgError)
-			if strings.Index(err.Message, "duplicate key value violates") != -1 {
-				// duplicate key error detected
-				if noWarnDuplicate {
-					return nil
-				}
-				// return duplicate error
-				return errors.New(err.Severity + ": requested operation is not allowed to be executed.")
-			}
-			return tx.Error
-		default:
-			return tx.Error
+		err := TranslateError(tx.Error)
+		if noWarnDuplicate && errors.Is(err, ErrDuplicate) {
+			// duplicate key error detected
+			return nil
 		}
+		return err
 	}
 	return nil
 }
@@ -263,11 +312,18 @@ func CheckResult(tx *gorm.DB, noWarnDuplicate bool) error {
 // AsTransaction executes given SQL code as unique transaction that is committed.
 // if no errors are found
 // In case of error, all operations are ROLLBACK
+// The cached reads affected by the writes of the transaction are invalidated after commit.
+// Use AsTransactionWithOptions to set the isolation level or retry serialization failures.
 func (s *ORMDatabase) AsTransaction(f func(tx *gorm.DB) error) error {
-	return s.Db.Transaction(func(tx *gorm.DB) error {
+	inv := s.deferred()
+	err := s.withInvalidator(inv).Transaction(func(tx *gorm.DB) error {
 		// do some database operations in the transaction (use 'tx' from this point, not 'db')
 		txErr := f(tx)
 		// return nil will commit the whole transaction
 		return txErr
 	})
+	if err == nil {
+		inv.flush()
+	}
+	return err
 }
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zerjioang/zgo/cache"
+	"github.com/zerjioang/zgo/storage/storagetest"
+	"gorm.io/gorm"
+)
+
+// testItem is the model of the storage tests, stored in the test_items table
+type testItem struct {
+	Item
+	Name  string
+	Score int64
+}
+
+// testColumns are the columns of the test_items table
+var testColumns = []string{"id", "updated_at", "created_at", "deleted_at", "name", "score"}
+
+// testRow returns a row of the test_items table
+func testRow(id string, name string, score int64) []interface{} {
+	return []interface{}{id, int64(0), int64(0), nil, name, score}
+}
+
+// newTestDB returns a database backed by a scripted database
+func newTestDB(t *testing.T) (*ORMDatabase, *storagetest.Database) {
+	t.Helper()
+	fake := storagetest.New()
+	db, err := fake.Open(&gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ORMDatabase{
+		Db:       db,
+		Metadata: map[string]DbItem{},
+		Cache:    cache.New(time.Minute, 0),
+	}, fake
+}
+
+func TestDeleteTable(t *testing.T) {
+	db, fake := newTestDB(t)
+	db.Cache.Set("all", nil, 0)
+	assert.NoError(t, db.RegisterQueryKey(&testItem{}, "all"))
+	assert.NoError(t, db.DeleteTable(&testItem{}))
+	found := fake.Find(`DELETE FROM test_items`)
+	assert.Len(t, found, 1)
+	_, cached := db.Cache.Get("all")
+	assert.False(t, cached)
+}
+
+func TestCreate(t *testing.T) {
+	db, fake := newTestDB(t)
+	item := &testItem{Name: "created"}
+	assert.NoError(t, db.Create(context.Background(), item))
+	assert.NotEmpty(t, item.ID)
+	assert.NotZero(t, item.CreatedAt)
+	found := fake.Find(`INSERT INTO "test_items"`)
+	if assert.Len(t, found, 1) {
+		assert.Contains(t, found[0].Args, string(item.ID))
+	}
+}
@@ -0,0 +1,123 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+)
+
+// Typed database errors. Errors returned by CheckResult can be compared
+// with them using errors.Is, and converted to *DBError with errors.As
+// to read the details reported by the database.
+var (
+	ErrNotFound       = errors.New(RecordNotFound)
+	ErrDuplicate      = errors.New("duplicate record")
+	ErrForeignKey     = errors.New("foreign key violation")
+	ErrCheckViolation = errors.New("check constraint violation")
+	ErrSerialization  = errors.New("serialization failure")
+	ErrDeadlock       = errors.New("deadlock detected")
+	ErrTimeout        = errors.New("database operation timed out")
+)
+
+// PostgreSQL SQLSTATE codes mapped to typed errors
+const (
+	codeUniqueViolation      = "23505"
+	codeForeignKeyViolation  = "23503"
+	codeCheckViolation       = "23514"
+	codeSerializationFailure = "40001"
+	codeDeadlockDetected     = "40P01"
+	codeQueryCanceled        = "57014"
+	codeLockNotAvailable     = "55P03"
+)
+
+var sqlStateErrors = map[string]error{
+	codeUniqueViolation:      ErrDuplicate,
+	codeForeignKeyViolation:  ErrForeignKey,
+	codeCheckViolation:       ErrCheckViolation,
+	codeSerializationFailure: ErrSerialization,
+	codeDeadlockDetected:     ErrDeadlock,
+	codeQueryCanceled:        ErrTimeout,
+	codeLockNotAvailable:     ErrTimeout,
+}
+
+// DBError is a database error classified as one of the typed errors
+type DBError struct {
+	// Kind is the typed error, such as ErrDuplicate
+	Kind error
+	// Code is the SQLSTATE code reported by the database, if any
+	Code string
+	// Constraint is the name of the violated constraint, if any
+	Constraint string
+	// Table is the name of the table involved, if any
+	Table string
+	// Column is the name of the column involved, if any
+	Column string
+	// Err is the original error
+	Err error
+}
+
+func (e *DBError) Error() string {
+	if e.Err == nil || e.Err.Error() == e.Kind.Error() {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the original error, so that driver errors such as
+// *pgconn.PgError can still be inspected with errors.As
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of the given typed error
+func (e *DBError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// TranslateError classifies a database error as one of the typed errors.
+// Errors that cannot be classified are returned as they are.
+func TranslateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var dbErr *DBError
+	if errors.As(err, &dbErr) {
+		return err
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &DBError{Kind: ErrNotFound, Err: err}
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		kind, found := sqlStateErrors[pgErr.Code]
+		if !found {
+			return err
+		}
+		return &DBError{
+			Kind:       kind,
+			Code:       pgErr.Code,
+			Constraint: pgErr.ConstraintName,
+			Table:      pgErr.TableName,
+			Column:     pgErr.ColumnName,
+			Err:        err,
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) {
+		return &DBError{Kind: ErrTimeout, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestTranslateError(t *testing.T) {
+	t.Run("sqlstate", func(t *testing.T) {
+		cases := []struct {
+			code string
+			kind error
+		}{
+			{"23505", ErrDuplicate},
+			{"23503", ErrForeignKey},
+			{"23514", ErrCheckViolation},
+			{"40001", ErrSerialization},
+			{"40P01", ErrDeadlock},
+			{"57014", ErrTimeout},
+			{"55P03", ErrTimeout},
+		}
+		for _, c := range cases {
+			t.Run(c.code, func(t *testing.T) {
+				pgErr := &pgconn.PgError{
+					Code:           c.code,
+					ConstraintName: "users_email_key",
+					TableName:      "users",
+					ColumnName:     "email",
+				}
+				err := TranslateError(fmt.Errorf("exec: %w", pgErr))
+				assert.True(t, errors.Is(err, c.kind))
+				var dbErr *DBError
+				if assert.True(t, errors.As(err, &dbErr)) {
+					assert.Equal(t, c.kind, dbErr.Kind)
+					assert.Equal(t, c.code, dbErr.Code)
+					assert.Equal(t, "users_email_key", dbErr.Constraint)
+					assert.Equal(t, "users", dbErr.Table)
+					assert.Equal(t, "email", dbErr.Column)
+				}
+				// the driver error is still reachable
+				var unwrapped *pgconn.PgError
+				assert.True(t, errors.As(err, &unwrapped))
+				assert.Equal(t, pgErr, unwrapped)
+			})
+		}
+	})
+	t.Run("unknown-sqlstate", func(t *testing.T) {
+		pgErr := &pgconn.PgError{Code: "42P01"}
+		err := TranslateError(pgErr)
+		assert.Equal(t, pgErr, err)
+		var dbErr *DBError
+		assert.False(t, errors.As(err, &dbErr))
+	})
+	t.Run("not-found", func(t *testing.T) {
+		err := TranslateError(gorm.ErrRecordNotFound)
+		assert.True(t, errors.Is(err, ErrNotFound))
+		assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+		assert.Equal(t, RecordNotFound, err.Error())
+	})
+	t.Run("timeout", func(t *testing.T) {
+		err := TranslateError(fmt.Errorf("query: %w", context.DeadlineExceeded))
+		assert.True(t, errors.Is(err, ErrTimeout))
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+	t.Run("passthrough", func(t *testing.T) {
+		assert.Nil(t, TranslateError(nil))
+		other := errors.New("connection refused")
+		assert.Equal(t, other, TranslateError(other))
+		// already translated errors are returned as they are
+		translated := TranslateError(&pgconn.PgError{Code: "23505"})
+		assert.Equal(t, translated, TranslateError(translated))
+	})
+	t.Run("is", func(t *testing.T) {
+		err := &DBError{Kind: ErrDuplicate}
+		assert.True(t, errors.Is(err, ErrDuplicate))
+		assert.False(t, errors.Is(err, ErrForeignKey))
+		assert.Equal(t, "duplicate record", err.Error())
+		err.Err = errors.New("boom")
+		assert.Equal(t, "duplicate record: boom", err.Error())
+	})
+}
+
+func TestCheckResult(t *testing.T) {
+	assert.Error(t, CheckResult(nil, false))
+	assert.NoError(t, CheckResult(&gorm.DB{}, false))
+	assert.NoError(t, CheckResult(&gorm.DB{Error: QueryCachedErr}, false))
+	dup := &gorm.DB{Error: &pgconn.PgError{Code: "23505"}}
+	assert.True(t, errors.Is(CheckResult(dup, false), ErrDuplicate))
+	assert.NoError(t, CheckResult(dup, true))
+	fk := &gorm.DB{Error: &pgconn.PgError{Code: "23503"}}
+	assert.True(t, errors.Is(CheckResult(fk, true), ErrForeignKey))
+}
@@ -0,0 +1,351 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/zerjioang/zgo/cache"
+	"gorm.io/gorm"
+)
+
+// Cached reads are tracked by the table they read from. Item reads are
+// cached under a key derived from the table and the primary key, and the
+// rest of the reads under the key chosen by the caller, which is registered
+// as a query key of the table. Every create, update or delete of a table,
+// including those executed directly with gorm inside AsTransaction, removes
+// the affected item keys and every query key of the table from the cache.
+// Inside a transaction, invalidation is deferred until commit. Reads that
+// overlap an invalidation of their table are not cached, as they may have
+// read the rows before the invalidating write. Keys that
+// expire or are evicted are forgotten on the next sweep of the tracked keys.
+
+const (
+	// invalidationSetting is the gorm setting that holds the invalidator of a statement
+	invalidationSetting = "zgo:invalidation"
+	// invalidationCallback is the name of the gorm callbacks that collect invalidations
+	invalidationCallback = "zgo:cache_invalidation"
+)
+
+// minKeySweep is the number of tracked keys that triggers the first sweep
+const minKeySweep = 1024
+
+// cacheKeys tracks the cached keys of every table
+type cacheKeys struct {
+	mu      sync.Mutex
+	items   map[string]map[string]struct{}
+	queries map[string]map[string]struct{}
+	// registered holds the query keys registered with RegisterQueryKey,
+	// which are kept after being invalidated
+	registered map[string]map[string]struct{}
+	// tracked is the number of item and query keys, which are swept
+	// when it reaches sweepAt
+	tracked int
+	sweepAt int
+	// generations counts the invalidations of every table
+	generations map[string]uint64
+}
+
+// add adds a key of given table to the set, and reports if it was not there
+func (k *cacheKeys) add(set map[string]map[string]struct{}, table, key string) bool {
+	keys, found := set[table]
+	if !found {
+		keys = map[string]struct{}{}
+		set[table] = keys
+	}
+	if _, found := keys[key]; found {
+		return false
+	}
+	keys[key] = struct{}{}
+	return true
+}
+
+// sweep forgets the item and query keys that are no longer cached, because
+// they expired or were deleted, so that the tracked keys do not grow with
+// every key ever cached. The next sweep happens when the remaining keys double.
+func (k *cacheKeys) sweep(c *cache.Cache) {
+	k.tracked = 0
+	for _, set := range []map[string]map[string]struct{}{k.items, k.queries} {
+		for table, keys := range set {
+			for key := range keys {
+				if _, found := c.Get(key); !found {
+					delete(keys, key)
+				}
+			}
+			if len(keys) == 0 {
+				delete(set, table)
+			}
+			k.tracked += len(keys)
+		}
+	}
+	k.sweepAt = 2 * k.tracked
+	if k.sweepAt < minKeySweep {
+		k.sweepAt = minKeySweep
+	}
+}
+
+// invalidator removes the cached reads affected by the writes of a statement.
+// Inside a transaction, keys are collected in pending until commit.
+type invalidator struct {
+	db      *ORMDatabase
+	mu      sync.Mutex
+	pending map[string][]string
+	all     map[string]bool
+}
+
+// ItemKey returns the cache key of given item, derived from its table and primary key
+func (s *ORMDatabase) ItemKey(obj DbItem) (string, error) {
+	table, err := s.tableOf(obj)
+	if err != nil {
+		return "", err
+	}
+	return itemKey(table, obj.Id()), nil
+}
+
+func itemKey(table string, id interface{}) string {
+	return table + ":" + fmt.Sprint(id)
+}
+
+// RegisterQueryKey registers cache keys that depend on the table of given model,
+// so that they are invalidated on every write of the table. Keys used with the
+// read methods of ORMDatabase are registered automatically when the destination
+// is a model or a slice of models.
+func (s *ORMDatabase) RegisterQueryKey(model interface{}, keys ...string) error {
+	table, err := s.tableOf(model)
+	if err != nil {
+		return err
+	}
+	k := s.cacheKeys()
+	k.mu.Lock()
+	for _, key := range keys {
+		k.add(k.registered, table, key)
+	}
+	k.mu.Unlock()
+	return nil
+}
+
+// InvalidateTable removes every cached read of the table of given model.
+// It is only needed after writing the table with raw SQL.
+func (s *ORMDatabase) InvalidateTable(model interface{}) error {
+	table, err := s.tableOf(model)
+	if err != nil {
+		return err
+	}
+	s.invalidate(table, nil, true)
+	return nil
+}
+
+// tableOf returns the table name of given model, or slice of models
+func (s *ORMDatabase) tableOf(model interface{}) (string, error) {
+	sch, err := s.schemaOf(model)
+	if err != nil {
+		return "", err
+	}
+	return sch.Table, nil
+}
+
+func (s *ORMDatabase) cacheKeys() *cacheKeys {
+	s.keysOnce.Do(func() {
+		s.keys = &cacheKeys{
+			items:       map[string]map[string]struct{}{},
+			queries:     map[string]map[string]struct{}{},
+			registered:  map[string]map[string]struct{}{},
+			sweepAt:     minKeySweep,
+			generations: map[string]uint64{},
+		}
+	})
+	return s.keys
+}
+
+// track registers a cached key of given table. It must be called with the lock of k held.
+func (s *ORMDatabase) track(k *cacheKeys, table, key string, item bool) {
+	set := k.queries
+	if item {
+		set = k.items
+	}
+	if k.add(set, table, key) {
+		k.tracked++
+	}
+	if k.tracked >= k.sweepAt && s.Cache != nil {
+		k.sweep(s.Cache)
+	}
+}
+
+// generation returns the number of invalidations of given table
+func (s *ORMDatabase) generation(table string) uint64 {
+	k := s.cacheKeys()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.generations[table]
+}
+
+// store caches a value read from given table and tracks its key, unless the
+// table was invalidated after generation was taken, before the read
+func (s *ORMDatabase) store(table string, generation uint64, key string, item bool, value interface{}, d time.Duration) {
+	k := s.cacheKeys()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.generations[table] != generation {
+		return
+	}
+	s.track(k, table, key, item)
+	// set under the lock, so that a later invalidation finds the key tracked
+	s.Cache.Set(key, value, d)
+}
+
+// invalidate removes the cached item keys of given table, and every query
+// key of the table. If all is set, every item key of the table is removed.
+func (s *ORMDatabase) invalidate(table string, keys []string, all bool) {
+	if s.Cache == nil || table == "" {
+		return
+	}
+	k := s.cacheKeys()
+	k.mu.Lock()
+	k.generations[table]++
+	var removed []string
+	for key := range k.queries[table] {
+		removed = append(removed, key)
+	}
+	k.tracked -= len(k.queries[table])
+	delete(k.queries, table)
+	for key := range k.registered[table] {
+		removed = append(removed, key)
+	}
+	if all {
+		for key := range k.items[table] {
+			removed = append(removed, key)
+		}
+		k.tracked -= len(k.items[table])
+		delete(k.items, table)
+	} else {
+		items := k.items[table]
+		for _, key := range keys {
+			if _, found := items[key]; found {
+				delete(items, key)
+				k.tracked--
+			}
+		}
+		removed = append(removed, keys...)
+	}
+	k.mu.Unlock()
+	for _, key := range removed {
+		s.Cache.Delete(key)
+	}
+}
+
+// session returns a gorm session whose writes invalidate the cache immediately
+func (s *ORMDatabase) session() *gorm.DB {
+	return s.withInvalidator(&invalidator{db: s})
+}
+
+// withInvalidator returns a gorm session whose writes are reported to inv
+func (s *ORMDatabase) withInvalidator(inv *invalidator) *gorm.DB {
+	s.callbacksOnce.Do(func() {
+		registerInvalidationCallbacks(s.Db)
+	})
+	return s.Db.Set(invalidationSetting, inv)
+}
+
+// registerInvalidationCallbacks registers the callbacks that report the writes
+// of every statement. Callbacks belong to the gorm config, which may be shared
+// by several databases, so they are only registered once.
+func registerInvalidationCallbacks(db *gorm.DB) {
+	c := db.Callback()
+	if c.Create().Get(invalidationCallback) == nil {
+		_ = c.Create().After("gorm:create").Register(invalidationCallback, collectInvalidation)
+	}
+	if c.Update().Get(invalidationCallback) == nil {
+		_ = c.Update().After("gorm:update").Register(invalidationCallback, collectInvalidation)
+	}
+	if c.Delete().Get(invalidationCallback) == nil {
+		_ = c.Delete().After("gorm:delete").Register(invalidationCallback, collectInvalidation)
+	}
+}
+
+// collectInvalidation reports the table and primary keys written by a statement
+func collectInvalidation(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	v, found := db.Get(invalidationSetting)
+	if !found {
+		return
+	}
+	inv := v.(*invalidator)
+	stmt := db.Statement
+	table := stmt.Table
+	if table == "" && stmt.Schema != nil {
+		table = stmt.Schema.Table
+	}
+	var keys []string
+	all := true
+	if stmt.Schema != nil && stmt.Schema.PrioritizedPrimaryField != nil && stmt.ReflectValue.IsValid() {
+		field := stmt.Schema.PrioritizedPrimaryField
+		rv := reflect.Indirect(stmt.ReflectValue)
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array:
+			all = false
+			for i := 0; i < rv.Len(); i++ {
+				if id, zero := field.ValueOf(reflect.Indirect(rv.Index(i))); !zero {
+					keys = append(keys, itemKey(table, id))
+				} else {
+					all = true
+				}
+			}
+		case reflect.Struct:
+			if id, zero := field.ValueOf(rv); !zero {
+				keys = append(keys, itemKey(table, id))
+				all = false
+			}
+		}
+	}
+	inv.add(table, keys, all)
+}
+
+// add invalidates the keys, or collects them when inside a transaction
+func (inv *invalidator) add(table string, keys []string, all bool) {
+	inv.mu.Lock()
+	if inv.pending == nil {
+		inv.mu.Unlock()
+		inv.db.invalidate(table, keys, all)
+		return
+	}
+	inv.pending[table] = append(inv.pending[table], keys...)
+	if all {
+		inv.all[table] = true
+	}
+	inv.mu.Unlock()
+}
+
+// deferred returns an invalidator that collects keys until flushed
+func (s *ORMDatabase) deferred() *invalidator {
+	return &invalidator{
+		db:      s,
+		pending: map[string][]string{},
+		all:     map[string]bool{},
+	}
+}
+
+// flush invalidates the keys collected by a committed transaction
+func (inv *invalidator) flush() {
+	inv.mu.Lock()
+	pending, all := inv.pending, inv.all
+	inv.pending, inv.all = nil, nil
+	inv.mu.Unlock()
+	for table, keys := range pending {
+		inv.db.invalidate(table, keys, all[table])
+	}
+}
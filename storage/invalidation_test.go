@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestInvalidation(t *testing.T) {
+	ctx := context.Background()
+	gen := func() interface{} { return &testItem{} }
+	genAll := func() interface{} { return &[]testItem{} }
+	// warm caches item a under its item key and every item under a query key
+	warm := func(t *testing.T, db *ORMDatabase) string {
+		key := itemKey("test_items", "a")
+		_, err := db.ReadByKey("", ctx, gen, "a")
+		assert.NoError(t, err)
+		_, err = db.ReadAll("all", ctx, nil, genAll)
+		assert.NoError(t, err)
+		assert.True(t, cached(db, key))
+		assert.True(t, cached(db, "all"))
+		return key
+	}
+	newDB := func(t *testing.T) *ORMDatabase {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2))
+		return db
+	}
+
+	t.Run("create", func(t *testing.T) {
+		db := newDB(t)
+		key := warm(t, db)
+		assert.NoError(t, db.Create(ctx, &testItem{Item: Item{ID: "c"}}))
+		assert.True(t, cached(db, key))
+		assert.False(t, cached(db, "all"))
+	})
+	t.Run("update", func(t *testing.T) {
+		db := newDB(t)
+		key := warm(t, db)
+		assert.NoError(t, db.Update(ctx, &testItem{Item: Item{ID: "a"}, Name: "updated"}))
+		assert.False(t, cached(db, key))
+		assert.False(t, cached(db, "all"))
+	})
+	t.Run("update-other", func(t *testing.T) {
+		db := newDB(t)
+		key := warm(t, db)
+		assert.NoError(t, db.Update(ctx, &testItem{Item: Item{ID: "b"}, Name: "updated"}))
+		assert.True(t, cached(db, key))
+		assert.False(t, cached(db, "all"))
+	})
+	t.Run("delete", func(t *testing.T) {
+		db := newDB(t)
+		key := warm(t, db)
+		assert.NoError(t, db.Delete(ctx, &testItem{Item: Item{ID: "a"}}))
+		assert.False(t, cached(db, key))
+		assert.False(t, cached(db, "all"))
+	})
+	t.Run("registered", func(t *testing.T) {
+		db := newDB(t)
+		warm(t, db)
+		assert.NoError(t, db.RegisterQueryKey(&testItem{}, "custom"))
+		db.Cache.Set("custom", 1, 0)
+		assert.NoError(t, db.Create(ctx, &testItem{}))
+		assert.False(t, cached(db, "custom"))
+		// registered keys are kept after being invalidated
+		db.Cache.Set("custom", 1, 0)
+		assert.NoError(t, db.Create(ctx, &testItem{}))
+		assert.False(t, cached(db, "custom"))
+	})
+	t.Run("transaction", func(t *testing.T) {
+		db := newDB(t)
+		key := warm(t, db)
+		err := db.AsTransaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&testItem{Item: Item{ID: "a"}}).Update("name", "updated").Error; err != nil {
+				return err
+			}
+			// invalidation is deferred until commit
+			assert.True(t, cached(db, key))
+			assert.True(t, cached(db, "all"))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.False(t, cached(db, key))
+		assert.False(t, cached(db, "all"))
+	})
+	t.Run("transaction-without-keys", func(t *testing.T) {
+		db := newDB(t)
+		key := warm(t, db)
+		// without a primary key, every item of the table is invalidated
+		err := db.AsTransaction(func(tx *gorm.DB) error {
+			return tx.Where("score > ?", 0).Delete(&testItem{}).Error
+		})
+		assert.NoError(t, err)
+		assert.False(t, cached(db, key))
+		assert.False(t, cached(db, "all"))
+	})
+	t.Run("rollback", func(t *testing.T) {
+		db := newDB(t)
+		key := warm(t, db)
+		failure := errors.New("rolled back")
+		err := db.AsTransaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(&testItem{Item: Item{ID: "a"}}).Error; err != nil {
+				return err
+			}
+			return failure
+		})
+		assert.Equal(t, failure, err)
+		assert.True(t, cached(db, key))
+		assert.True(t, cached(db, "all"))
+	})
+	t.Run("failed-commit", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1))
+		fake.On("COMMIT").Fails(errors.New("could not serialize access"))
+		key := warm(t, db)
+		err := db.AsTransaction(func(tx *gorm.DB) error {
+			return tx.Delete(&testItem{Item: Item{ID: "a"}}).Error
+		})
+		assert.Error(t, err)
+		assert.True(t, cached(db, key))
+		assert.True(t, cached(db, "all"))
+	})
+	t.Run("failed-write", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1))
+		fake.On(`UPDATE "test_items"`).Fails(errors.New("connection reset"))
+		key := warm(t, db)
+		assert.Error(t, db.Update(ctx, &testItem{Item: Item{ID: "a"}, Name: "updated"}))
+		assert.True(t, cached(db, key))
+		assert.True(t, cached(db, "all"))
+	})
+	t.Run("invalidate-table", func(t *testing.T) {
+		db := newDB(t)
+		key := warm(t, db)
+		assert.NoError(t, db.InvalidateTable(&testItem{}))
+		assert.False(t, cached(db, key))
+		assert.False(t, cached(db, "all"))
+	})
+}
+
+func TestConcurrentInvalidation(t *testing.T) {
+	ctx := context.Background()
+	db, fake := newTestDB(t)
+	fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1))
+	gen := func() interface{} { return &[]testItem{} }
+	// a write of the table is committed while the read is running
+	_, err := db.withCache("all", false, gen, time.Minute, func(dst interface{}) error {
+		if err := db.Db.WithContext(ctx).Find(dst).Error; err != nil {
+			return err
+		}
+		return db.InvalidateTable(&testItem{})
+	})
+	assert.NoError(t, err)
+	assert.False(t, cached(db, "all"))
+	// reads not overlapping an invalidation are cached
+	_, err = db.ReadAll("all", ctx, nil, gen)
+	assert.NoError(t, err)
+	assert.True(t, cached(db, "all"))
+}
+
+func TestTrackedKeysSweep(t *testing.T) {
+	db, _ := newTestDB(t)
+	// a few keys remain cached, the rest expired or were evicted
+	k := db.cacheKeys()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i := 0; i < 10; i++ {
+		db.Cache.Set(fmt.Sprint("live-", i), i, 0)
+		db.track(k, "test_items", fmt.Sprint("live-", i), i%2 == 0)
+	}
+	for i := 0; i < 3*minKeySweep; i++ {
+		db.track(k, "test_items", fmt.Sprint("gone-", i), i%2 == 0)
+	}
+	assert.Less(t, k.tracked, minKeySweep)
+	assert.Equal(t, len(k.items["test_items"])+len(k.queries["test_items"]), k.tracked)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprint("live-", i)
+		if i%2 == 0 {
+			assert.Contains(t, k.items["test_items"], key)
+		} else {
+			assert.Contains(t, k.queries["test_items"], key)
+		}
+	}
+}
+
+// cached reports if given key is in the cache of db
+func cached(db *ORMDatabase, key string) bool {
+	_, found := db.Cache.Get(key)
+	return found
+}
@@ -37,14 +37,21 @@ type ItemMetadata struct {
 	// UNIX Epoch timestamp millis
 	CreatedAt int64           `gorm:"autoCreateTime" json:"created_at,omitempty"` // Use unix seconds as creating time
 	DeletedAt *gorm.DeletedAt `gorm:"index" json:"deleted_at,omitempty"`
+	// Version enables optimistic locking. It starts at 1 on create, and every
+	// update through ORMDatabase increments it, only succeeding if the row is
+	// still at the version the item was read with. Zero skips the check.
+	Version int64 `gorm:"not null;default:1" json:"version,omitempty"`
 }
 
 var _ callbacks.BeforeCreateInterface = (*ItemMetadata)(nil)
 var _ callbacks.BeforeUpdateInterface = (*ItemMetadata)(nil)
 var _ callbacks.BeforeDeleteInterface = (*ItemMetadata)(nil)
+var _ VersionedItem = (*ItemMetadata)(nil)
 
+// LoadStruct can be implemented by the models read with QueryRaw, usually
+// with ScanRow. Otherwise, QueryRaw scans them by column name.
 func (mt *ItemMetadata) LoadStruct(rows *sql.Rows) (interface{}, error) {
-	panic("LoadStruct method needs to be implemented")
+	return nil, ErrNoLoadStruct
 }
 
 func (mt *ItemMetadata) BeforeCreate(*gorm.DB) (err error) {
@@ -58,11 +65,23 @@ func (mt *ItemMetadata) BeforeUpdate(*gorm.DB) (err error) {
 }
 
 func (mt *ItemMetadata) BeforeDelete(*gorm.DB) (err error) {
-	return mt.DeletedAt.Scan(timer.Now())
+	return mt.SetDeleted()
 }
 
+// SetDeleted marks the item as deleted at current time
 func (mt *ItemMetadata) SetDeleted() error {
-	return mt.DeletedAt.Scan(timer.Now())
+	mt.DeletedAt = &gorm.DeletedAt{Time: timer.Time(), Valid: true}
+	return nil
+}
+
+// GetVersion returns the version the item was read with
+func (mt *ItemMetadata) GetVersion() int64 {
+	return mt.Version
+}
+
+// SetVersion sets the version of the item
+func (mt *ItemMetadata) SetVersion(version int64) {
+	mt.Version = version
 }
 
 // DbItem interface implementation methids
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestItemMetadata(t *testing.T) {
+	t.Run("set-deleted", func(t *testing.T) {
+		var item Item
+		assert.Nil(t, item.DeletedAt)
+		assert.NoError(t, item.SetDeleted())
+		if assert.NotNil(t, item.DeletedAt) {
+			assert.True(t, item.DeletedAt.Valid)
+			assert.False(t, item.DeletedAt.Time.IsZero())
+		}
+	})
+	t.Run("before-delete", func(t *testing.T) {
+		var item Item
+		assert.NoError(t, item.BeforeDelete(nil))
+		if assert.NotNil(t, item.DeletedAt) {
+			assert.True(t, item.DeletedAt.Valid)
+		}
+	})
+	t.Run("id", func(t *testing.T) {
+		var item Item
+		id := item.Id()
+		assert.NotEmpty(t, id)
+		assert.Equal(t, id, item.Id())
+		assert.NoError(t, item.SetId("42"))
+		assert.Equal(t, ID("42"), item.Id())
+	})
+}
@@ -0,0 +1,106 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+// DefaultIterateChunk is the number of rows read per query by Iterate
+const DefaultIterateChunk = 500
+
+var (
+	errNotModel = errors.New("generator must return a pointer to a model")
+)
+
+// Iterate calls fn with every row of the model created by gen matching the
+// spec, in spec order. Rows are read in chunks of spec.Limit rows, or
+// DefaultIterateChunk if zero, with keyset pagination, so only one chunk is
+// held in memory and rows written during the iteration are never skipped
+// nor repeated because of offsets. Iteration starts after spec.Cursor if set.
+// Reads bypass the cache, and iteration stops when the context is done or
+// fn returns an error.
+func (s *ORMDatabase) Iterate(ctx context.Context, spec QuerySpec, gen Generator, fn func(item DbItem) error) error {
+	model := gen()
+	typ := reflect.TypeOf(model)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return errNotModel
+	}
+	if _, ok := model.(DbItem); !ok {
+		return errNotModel
+	}
+	sch, err := s.schemaOf(model)
+	if err != nil {
+		return err
+	}
+	sorts, err := spec.sortFields(sch)
+	if err != nil {
+		return err
+	}
+	if spec.Limit == 0 {
+		spec.Limit = DefaultIterateChunk
+	}
+	sliceType := reflect.SliceOf(typ.Elem())
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tx, err := spec.apply(s.Db.WithContext(ctx), sch, sorts)
+		if err != nil {
+			return err
+		}
+		chunk := reflect.New(sliceType)
+		if err := CheckResult(tx.Find(chunk.Interface()), false); err != nil {
+			return err
+		}
+		rows := chunk.Elem()
+		for i := 0; i < rows.Len(); i++ {
+			if err := fn(rows.Index(i).Addr().Interface().(DbItem)); err != nil {
+				return err
+			}
+		}
+		if spec.Cursor, err = spec.next(chunk.Interface(), sorts); err != nil {
+			return err
+		}
+		if spec.Cursor == "" {
+			return nil
+		}
+	}
+}
+
+// IterateChan streams the rows read by Iterate through a channel. Both
+// channels are closed when the iteration ends, after sending its error,
+// if any, to the error channel. Callers that stop reading before the end
+// must cancel the context to release the iteration.
+func (s *ORMDatabase) IterateChan(ctx context.Context, spec QuerySpec, gen Generator) (<-chan DbItem, <-chan error) {
+	items := make(chan DbItem)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(items)
+		err := s.Iterate(ctx, spec, gen, func(item DbItem) error {
+			select {
+			case items <- item:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			errc <- err
+		}
+	}()
+	return items, errc
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func genTestItem() interface{} {
+	return &testItem{}
+}
+
+func TestIterate(t *testing.T) {
+	ctx := context.Background()
+	collect := func(ids *[]ID) func(item DbItem) error {
+		return func(item DbItem) error {
+			*ids = append(*ids, item.Id())
+			return nil
+		}
+	}
+
+	t.Run("chunks", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2)).Times(1)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("c", "third", 3), testRow("d", "fourth", 4)).Times(1)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("e", "fifth", 5)).Times(1)
+		var ids []ID
+		assert.NoError(t, db.Iterate(ctx, QuerySpec{Limit: 2}, genTestItem, collect(&ids)))
+		assert.Equal(t, []ID{"a", "b", "c", "d", "e"}, ids)
+		queries := fake.Find(`FROM "test_items"`)
+		if assert.Len(t, queries, 3) {
+			assert.NotContains(t, queries[0].SQL, `"test_items"."id" >`)
+			assert.Contains(t, queries[2].SQL, `WHERE "test_items"."id" > $1 AND "test_items"."deleted_at" IS NULL ORDER BY "test_items"."id" LIMIT 2`)
+			assert.Equal(t, []driver.Value{"d"}, queries[2].Args)
+		}
+		// reads bypass the cache
+		assert.Zero(t, db.Cache.ItemCount())
+	})
+	t.Run("default-chunk", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		assert.NoError(t, db.Iterate(ctx, QuerySpec{}, genTestItem, collect(new([]ID))))
+		assert.Contains(t, lastQuery(t, fake, "test_items").SQL, "LIMIT 500")
+	})
+	t.Run("nullable-sort", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "ranked_items"`).Returns(rankedColumns, []interface{}{"a", int64(1)}, []interface{}{"b", nil}).Times(1)
+		fake.On(`FROM "ranked_items"`).Returns(rankedColumns, []interface{}{"c", nil}).Times(1)
+		var ids []ID
+		spec := QuerySpec{Sort: []Sort{{Field: "Rank"}}, Limit: 2}
+		assert.NoError(t, db.Iterate(ctx, spec, func() interface{} { return &rankedItem{} }, collect(&ids)))
+		assert.Equal(t, []ID{"a", "b", "c"}, ids)
+		// the rows after a NULL rank are the NULL ones with a greater id
+		stmt := lastQuery(t, fake, "ranked_items")
+		assert.Contains(t, stmt.SQL, `WHERE ("ranked_items"."rank" IS NULL AND "ranked_items"."id" > $1) AND "ranked_items"."deleted_at" IS NULL ORDER BY "ranked_items"."rank" NULLS LAST,"ranked_items"."id" LIMIT 2`)
+		assert.Equal(t, []driver.Value{"b"}, stmt.Args)
+	})
+	t.Run("stopped", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2))
+		stop := errors.New("stop")
+		var ids []ID
+		err := db.Iterate(ctx, QuerySpec{Limit: 2}, genTestItem, func(item DbItem) error {
+			ids = append(ids, item.Id())
+			return stop
+		})
+		assert.Equal(t, stop, err)
+		assert.Equal(t, []ID{"a"}, ids)
+		assert.Len(t, fake.Find(`FROM "test_items"`), 1)
+	})
+	t.Run("canceled", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		err := db.Iterate(ctx, QuerySpec{}, genTestItem, collect(new([]ID)))
+		assert.Equal(t, context.Canceled, err)
+		assert.Empty(t, fake.Statements())
+	})
+	t.Run("invalid", func(t *testing.T) {
+		db, _ := newTestDB(t)
+		gens := map[string]Generator{
+			"nil":       func() interface{} { return nil },
+			"value":     func() interface{} { return testItem{} },
+			"slice":     genTestItems,
+			"not-model": func() interface{} { return &struct{ Name string }{} },
+		}
+		for name, gen := range gens {
+			err := db.Iterate(ctx, QuerySpec{}, gen, collect(new([]ID)))
+			assert.Equal(t, errNotModel, err, name)
+		}
+		err := db.Iterate(ctx, QuerySpec{Sort: []Sort{{Field: "Missing"}}}, genTestItem, collect(new([]ID)))
+		assert.True(t, errors.Is(err, ErrInvalidQuery))
+	})
+}
+
+func TestIterateChan(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("items", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2))
+		items, errc := db.IterateChan(ctx, QuerySpec{Limit: 5}, genTestItem)
+		var ids []ID
+		for item := range items {
+			ids = append(ids, item.Id())
+		}
+		assert.NoError(t, <-errc)
+		assert.Equal(t, []ID{"a", "b"}, ids)
+	})
+	t.Run("error", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		failure := errors.New("connection reset")
+		fake.On(`FROM "test_items"`).Fails(failure)
+		items, errc := db.IterateChan(ctx, QuerySpec{}, genTestItem)
+		_, open := <-items
+		assert.False(t, open)
+		assert.True(t, errors.Is(<-errc, failure))
+	})
+	t.Run("canceled", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2))
+		ctx, cancel := context.WithCancel(ctx)
+		items, errc := db.IterateChan(ctx, QuerySpec{Limit: 5}, genTestItem)
+		<-items
+		// the iteration is released without reading the rest of the items
+		cancel()
+		assert.Equal(t, context.Canceled, <-errc)
+		for range items {
+		}
+	})
+}
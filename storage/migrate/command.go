@@ -0,0 +1,120 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package migrate
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: migrate [-dry-run] <command> [arg]
+
+commands:
+  up [version]   apply the pending migrations, up to version if given
+  down [steps]   revert the last applied migrations, 1 by default
+  status         list the migrations and whether they are applied
+`
+
+var (
+	errUsage = errors.New("migrate: invalid command")
+)
+
+// Command runs the migrate command line, so that services can expose it
+// as a subcommand, for instance with:
+//
+//	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+//		cli.ExitWithError(migrate.Command(ctx, m, os.Args[2:], os.Stdout))
+//	}
+func Command(ctx context.Context, m *Migrator, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() { _, _ = io.WriteString(out, usage) }
+	dryRun := flags.Bool("dry-run", false, "report the migrations without running them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	run := *m
+	run.config.DryRun = run.config.DryRun || *dryRun
+	args = flags.Args()
+	if len(args) == 0 || len(args) > 2 {
+		flags.Usage()
+		return errUsage
+	}
+	var arg int64
+	if len(args) == 2 {
+		var err error
+		if arg, err = strconv.ParseInt(args[1], 10, 64); err != nil || arg < 0 {
+			flags.Usage()
+			return errUsage
+		}
+	}
+	switch args[0] {
+	case "up":
+		done, err := run.UpTo(ctx, arg)
+		report(out, "applied", done, run.config.DryRun)
+		return err
+	case "down":
+		if arg == 0 {
+			arg = 1
+		}
+		done, err := run.Down(ctx, int(arg))
+		report(out, "reverted", done, run.config.DryRun)
+		return err
+	case "status":
+		status, err := run.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return printStatus(out, status)
+	default:
+		flags.Usage()
+		return errUsage
+	}
+}
+
+func report(out io.Writer, action string, done []Migration, dryRun bool) {
+	if dryRun {
+		action = "would be " + action
+	}
+	if len(done) == 0 {
+		_, _ = fmt.Fprintf(out, "no migrations %s\n", action)
+	}
+	for _, mg := range done {
+		_, _ = fmt.Fprintf(out, "%s %s\n", action, mg)
+	}
+}
+
+func printStatus(out io.Writer, status []Status) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, s := range status {
+		state, at := "pending", ""
+		if s.Applied {
+			state, at = "applied", s.AppliedAt.Format(time.RFC3339)
+		}
+		switch {
+		case s.Unknown:
+			state += " (unknown)"
+		case s.Modified:
+			state += " (modified)"
+		}
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, at)
+	}
+	return w.Flush()
+}
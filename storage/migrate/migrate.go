@@ -0,0 +1,374 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package migrate applies versioned schema migrations, written as SQL files
+// or Go functions, and records them in a migrations table.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/zerjioang/zgo/storage"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultTable is the name of the migrations table
+	DefaultTable = "schema_migrations"
+	// DefaultLockID is the key of the advisory lock held while migrating
+	DefaultLockID int64 = 7262331813940371
+)
+
+var (
+	// ErrChecksumMismatch is returned when an applied migration was modified
+	ErrChecksumMismatch = errors.New("migrate: applied migration was modified")
+	// ErrNoDown is returned when reverting a migration without down step
+	ErrNoDown = errors.New("migrate: migration cannot be reverted")
+	// ErrUnknownMigration is returned when reverting a migration applied
+	// by the database but not known by the migrator
+	ErrUnknownMigration = errors.New("migrate: applied migration is unknown")
+	errDuplicateVersion = errors.New("migrate: duplicate migration version")
+	errInvalidVersion   = errors.New("migrate: migration versions must be positive")
+	errNoUp             = errors.New("migrate: migration has no up step")
+	errInvalidSteps     = errors.New("migrate: steps must not be negative")
+)
+
+// Func is a migration step written in Go
+type Func func(ctx context.Context, tx *gorm.DB) error
+
+// Migration is a versioned schema change. Each step is either SQL or a Go function.
+type Migration struct {
+	// Version orders the migrations, and must be unique and positive
+	Version int64
+	Name    string
+	UpSQL   string
+	DownSQL string
+	Up      Func
+	Down    Func
+	// NoTransaction runs the migration outside of a transaction, as required
+	// by statements such as CREATE INDEX CONCURRENTLY
+	NoTransaction bool
+}
+
+// Checksum identifies the content of the migration. Go functions cannot be
+// hashed, so they only contribute their presence.
+func (m Migration) Checksum() string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%d\x00%s\x00%s\x00%t\x00%t", m.Version, m.UpSQL, m.DownSQL, m.Up != nil, m.Down != nil)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (m Migration) reversible() bool {
+	return m.Down != nil || m.DownSQL != ""
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%d_%s", m.Version, m.Name)
+}
+
+// record is a row of the migrations table
+type record struct {
+	Version   int64  `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"not null"`
+	Checksum  string `gorm:"not null"`
+	AppliedAt time.Time
+}
+
+// Config configures a migrator. Zero values are replaced by the defaults.
+type Config struct {
+	// Table is the name of the migrations table
+	Table string
+	// LockID is the key of the PostgreSQL advisory lock that prevents
+	// concurrent runs. Other databases are not locked.
+	LockID int64
+	// DryRun reports the migrations that would run without running them
+	DryRun bool
+}
+
+func (c Config) withDefaults() Config {
+	if c.Table == "" {
+		c.Table = DefaultTable
+	}
+	if c.LockID == 0 {
+		c.LockID = DefaultLockID
+	}
+	return c
+}
+
+// Status is the state of a migration
+type Status struct {
+	Version int64
+	Name    string
+	// Applied is set when the migration is recorded in the migrations table
+	Applied   bool
+	AppliedAt time.Time
+	// Modified is set when the applied migration differs from the known one
+	Modified bool
+	// Unknown is set when the applied migration is not known by the migrator
+	Unknown bool
+}
+
+// Migrator applies and reverts migrations
+type Migrator struct {
+	db         *gorm.DB
+	config     Config
+	migrations []Migration
+}
+
+// New returns a migrator of given migrations, sorted by version
+func New(db *gorm.DB, config Config, migrations ...Migration) (*Migrator, error) {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	for i, m := range sorted {
+		if m.Version <= 0 {
+			return nil, errInvalidVersion
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("%w: %d", errDuplicateVersion, m.Version)
+		}
+		if m.Up == nil && m.UpSQL == "" {
+			return nil, fmt.Errorf("%w: %s", errNoUp, m)
+		}
+	}
+	return &Migrator{db: db, config: config.withDefaults(), migrations: sorted}, nil
+}
+
+// Migrations returns the known migrations, sorted by version
+func (m *Migrator) Migrations() []Migration {
+	return append([]Migration(nil), m.migrations...)
+}
+
+// Up applies every pending migration. It returns the migrations applied,
+// or the ones that would be applied in dry-run mode.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.UpTo(ctx, 0)
+}
+
+// UpTo applies the pending migrations up to given version included.
+// A zero version applies every pending migration.
+func (m *Migrator) UpTo(ctx context.Context, version int64) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(db *gorm.DB) error {
+		applied, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(applied); err != nil {
+			return err
+		}
+		for _, mg := range m.migrations {
+			if version > 0 && mg.Version > version {
+				break
+			}
+			if _, found := applied[mg.Version]; found {
+				continue
+			}
+			if !m.config.DryRun {
+				if err := m.run(ctx, db, mg, true); err != nil {
+					return err
+				}
+			}
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last steps applied migrations. It returns the migrations
+// reverted, or the ones that would be reverted in dry-run mode.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if steps < 0 {
+		return nil, fmt.Errorf("%w: %d", errInvalidSteps, steps)
+	}
+	var done []Migration
+	err := m.locked(ctx, func(db *gorm.DB) error {
+		applied, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(applied); err != nil {
+			return err
+		}
+		versions := make([]int64, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+		if steps < len(versions) {
+			versions = versions[:steps]
+		}
+		for _, v := range versions {
+			mg, found := m.find(v)
+			if !found {
+				return fmt.Errorf("%w: %d_%s", ErrUnknownMigration, v, applied[v].Name)
+			}
+			if !mg.reversible() {
+				return fmt.Errorf("%w: %s", ErrNoDown, mg)
+			}
+			if !m.config.DryRun {
+				if err := m.run(ctx, db, mg, false); err != nil {
+					return err
+				}
+			}
+			done = append(done, mg)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status returns the state of the known and applied migrations, sorted by version
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(m.db.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	var status []Status
+	for _, mg := range m.migrations {
+		s := Status{Version: mg.Version, Name: mg.Name}
+		if r, found := applied[mg.Version]; found {
+			s.Applied = true
+			s.AppliedAt = r.AppliedAt
+			s.Modified = r.Checksum != mg.Checksum()
+			delete(applied, mg.Version)
+		}
+		status = append(status, s)
+	}
+	for _, r := range applied {
+		status = append(status, Status{
+			Version:   r.Version,
+			Name:      r.Name,
+			Applied:   true,
+			AppliedAt: r.AppliedAt,
+			Unknown:   true,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+	return status, nil
+}
+
+func (m *Migrator) find(version int64) (Migration, bool) {
+	for _, mg := range m.migrations {
+		if mg.Version == version {
+			return mg, true
+		}
+	}
+	return Migration{}, false
+}
+
+// verify checks that the applied migrations were not modified
+func (m *Migrator) verify(applied map[int64]record) error {
+	for _, mg := range m.migrations {
+		if r, found := applied[mg.Version]; found && r.Checksum != mg.Checksum() {
+			return fmt.Errorf("%w: %s", ErrChecksumMismatch, mg)
+		}
+	}
+	return nil
+}
+
+// locked runs f holding the advisory lock, on a dedicated connection, so
+// that the lock is released by the same session that acquired it
+func (m *Migrator) locked(ctx context.Context, f func(db *gorm.DB) error) error {
+	db := m.db.WithContext(ctx)
+	if db.Dialector.Name() != "postgres" {
+		if err := m.ensureTable(db); err != nil {
+			return err
+		}
+		return f(db)
+	}
+	sqlDB, err := m.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return storage.TranslateError(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", m.config.LockID); err != nil {
+		return storage.TranslateError(err)
+	}
+	defer func() {
+		// the context may be done by now, and the lock must be released anyway
+		_, _ = conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", m.config.LockID)
+	}()
+	db = db.Session(&gorm.Session{NewDB: true})
+	db.Statement.ConnPool = conn
+	if err := m.ensureTable(db); err != nil {
+		return err
+	}
+	return f(db)
+}
+
+// ensureTable creates the migrations table, unless in dry-run mode
+func (m *Migrator) ensureTable(db *gorm.DB) error {
+	if m.config.DryRun {
+		return nil
+	}
+	return storage.TranslateError(db.Table(m.config.Table).AutoMigrate(&record{}))
+}
+
+// applied returns the rows of the migrations table by version
+func (m *Migrator) applied(db *gorm.DB) (map[int64]record, error) {
+	if !db.Migrator().HasTable(m.config.Table) {
+		return map[int64]record{}, nil
+	}
+	var rows []record
+	if err := db.Table(m.config.Table).Find(&rows).Error; err != nil {
+		return nil, storage.TranslateError(err)
+	}
+	applied := make(map[int64]record, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// run applies or reverts a migration, together with its migrations table row
+func (m *Migrator) run(ctx context.Context, db *gorm.DB, mg Migration, up bool) error {
+	apply := func(tx *gorm.DB) error {
+		if err := step(ctx, tx, mg, up); err != nil {
+			return fmt.Errorf("migrate: %s: %w", mg, storage.TranslateError(err))
+		}
+		table := tx.Table(m.config.Table)
+		if up {
+			r := record{Version: mg.Version, Name: mg.Name, Checksum: mg.Checksum(), AppliedAt: time.Now()}
+			return storage.TranslateError(table.Create(&r).Error)
+		}
+		return storage.TranslateError(table.Where("version = ?", mg.Version).Delete(&record{}).Error)
+	}
+	if mg.NoTransaction {
+		return apply(db)
+	}
+	return db.Transaction(apply)
+}
+
+// step runs the up or down step of a migration
+func step(ctx context.Context, tx *gorm.DB, mg Migration, up bool) error {
+	f, query := mg.Up, mg.UpSQL
+	if !up {
+		f, query = mg.Down, mg.DownSQL
+	}
+	if f != nil {
+		return f(ctx, tx)
+	}
+	return tx.Exec(query).Error
+}
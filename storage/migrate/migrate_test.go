@@ -0,0 +1,382 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zerjioang/zgo/storage/storagetest"
+	"gorm.io/gorm"
+)
+
+var recordColumns = []string{"version", "name", "checksum", "applied_at"}
+
+// testMigrations returns a SQL migration, a Go one and one run outside of a
+// transaction. Go steps are recorded in calls.
+func testMigrations(calls *[]string) []Migration {
+	return []Migration{
+		{Version: 3, Name: "index_users", UpSQL: "CREATE INDEX CONCURRENTLY users_name ON users (name)", NoTransaction: true},
+		{Version: 1, Name: "create_users", UpSQL: "CREATE TABLE users (id text)", DownSQL: "DROP TABLE users"},
+		{
+			Version: 2,
+			Name:    "seed_users",
+			Up: func(ctx context.Context, tx *gorm.DB) error {
+				*calls = append(*calls, "up")
+				return tx.Exec("INSERT INTO users VALUES ('admin')").Error
+			},
+			Down: func(ctx context.Context, tx *gorm.DB) error {
+				*calls = append(*calls, "down")
+				return tx.Exec("DELETE FROM users").Error
+			},
+		},
+	}
+}
+
+// appliedRow returns a row of the migrations table of given migration
+func appliedRow(mg Migration) []interface{} {
+	return []interface{}{mg.Version, mg.Name, mg.Checksum(), time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// newTestMigrator returns a migrator of a scripted database, in which the
+// migrations table holds given applied migrations
+func newTestMigrator(t *testing.T, migrations []Migration, applied ...Migration) (*Migrator, *storagetest.Database) {
+	t.Helper()
+	fake := storagetest.New()
+	if len(applied) > 0 {
+		fake.On("information_schema.tables").Returns([]string{"count"}, []interface{}{int64(1)})
+		rows := make([][]interface{}, 0, len(applied))
+		for _, mg := range applied {
+			rows = append(rows, appliedRow(mg))
+		}
+		fake.On(`FROM "schema_migrations"`).Returns(recordColumns, rows...)
+	}
+	db, err := fake.Open(&gorm.Config{SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(db, Config{}, migrations...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, fake
+}
+
+// migrationStatements returns the statements of fake that are not about
+// the migrations table, the lock or the database catalog
+func migrationStatements(fake *storagetest.Database) []string {
+	var found []string
+	for _, s := range fake.Statements() {
+		switch {
+		case strings.Contains(s.SQL, "information_schema"),
+			strings.Contains(s.SQL, "DATABASE()"),
+			strings.Contains(s.SQL, "pg_advisory"),
+			strings.HasPrefix(s.SQL, "CREATE TABLE "+`"schema_migrations"`),
+			strings.HasPrefix(s.SQL, `SELECT * FROM "schema_migrations"`):
+			continue
+		}
+		found = append(found, strings.SplitN(s.SQL, " (", 2)[0])
+	}
+	return found
+}
+
+func versions(migrations []Migration) []int64 {
+	var found []int64
+	for _, mg := range migrations {
+		found = append(found, mg.Version)
+	}
+	return found
+}
+
+func TestNew(t *testing.T) {
+	var calls []string
+	m, err := New(nil, Config{}, testMigrations(&calls)...)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 3}, versions(m.Migrations()))
+	assert.Equal(t, Config{Table: DefaultTable, LockID: DefaultLockID}, m.config)
+
+	invalid := []struct {
+		name       string
+		migrations []Migration
+		err        error
+	}{
+		{"invalid-version", []Migration{{Version: 0, UpSQL: "SELECT 1"}}, errInvalidVersion},
+		{"duplicate-version", []Migration{{Version: 1, UpSQL: "SELECT 1"}, {Version: 1, UpSQL: "SELECT 2"}}, errDuplicateVersion},
+		{"no-up", []Migration{{Version: 1, DownSQL: "SELECT 1"}}, errNoUp},
+	}
+	for _, c := range invalid {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := New(nil, Config{}, c.migrations...)
+			assert.True(t, errors.Is(err, c.err))
+		})
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	mg := Migration{Version: 1, Name: "create_users", UpSQL: "CREATE TABLE users (id text)"}
+	checksum := mg.Checksum()
+	assert.Len(t, checksum, 64)
+	renamed := mg
+	renamed.Name = "users"
+	assert.Equal(t, checksum, renamed.Checksum())
+	modified := mg
+	modified.UpSQL = "CREATE TABLE users (id uuid)"
+	assert.NotEqual(t, checksum, modified.Checksum())
+	withDown := mg
+	withDown.Down = func(context.Context, *gorm.DB) error { return nil }
+	assert.NotEqual(t, checksum, withDown.Checksum())
+}
+
+func TestUp(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("all", func(t *testing.T) {
+		var calls []string
+		m, fake := newTestMigrator(t, testMigrations(&calls))
+		done, err := m.Up(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3}, versions(done))
+		assert.Equal(t, []string{"up"}, calls)
+		assert.Equal(t, []string{
+			"BEGIN", "CREATE TABLE users", `INSERT INTO "schema_migrations"`, "COMMIT",
+			"BEGIN", "INSERT INTO users VALUES", `INSERT INTO "schema_migrations"`, "COMMIT",
+			// the migration run outside of a transaction
+			"CREATE INDEX CONCURRENTLY users_name ON users", `INSERT INTO "schema_migrations"`,
+		}, migrationStatements(fake))
+		statements := fake.Statements()
+		// migrations run holding the advisory lock
+		assert.Equal(t, "SELECT pg_advisory_lock($1)", statements[0].SQL)
+		assert.Equal(t, DefaultLockID, statements[0].Args[0])
+		assert.Equal(t, "SELECT pg_advisory_unlock($1)", statements[len(statements)-1].SQL)
+		assert.NotEmpty(t, fake.Find(`CREATE TABLE "schema_migrations"`))
+		insert := fake.Find(`INSERT INTO "schema_migrations"`)[0]
+		assert.Equal(t, []interface{}{int64(1), "create_users", m.migrations[0].Checksum()}, []interface{}{insert.Args[0], insert.Args[1], insert.Args[2]})
+	})
+	t.Run("pending", func(t *testing.T) {
+		var calls []string
+		migrations := testMigrations(&calls)
+		m, fake := newTestMigrator(t, migrations, migrations[1])
+		done, err := m.UpTo(ctx, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{2}, versions(done))
+		assert.Equal(t, []string{"BEGIN", "INSERT INTO users VALUES", `INSERT INTO "schema_migrations"`, "COMMIT"}, migrationStatements(fake))
+	})
+	t.Run("dry-run", func(t *testing.T) {
+		var calls []string
+		m, fake := newTestMigrator(t, testMigrations(&calls))
+		m.config.DryRun = true
+		done, err := m.Up(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3}, versions(done))
+		assert.Empty(t, calls)
+		assert.Empty(t, migrationStatements(fake))
+		// the migrations table is not created either
+		assert.Empty(t, fake.Find(`CREATE TABLE "schema_migrations"`))
+	})
+	t.Run("failed", func(t *testing.T) {
+		var calls []string
+		m, fake := newTestMigrator(t, testMigrations(&calls))
+		fake.On("INSERT INTO users").Fails(errors.New("relation users does not exist"))
+		done, err := m.Up(ctx)
+		assert.EqualError(t, err, "migrate: 2_seed_users: relation users does not exist")
+		assert.Equal(t, []int64{1}, versions(done))
+		assert.Equal(t, []string{
+			"BEGIN", "CREATE TABLE users", `INSERT INTO "schema_migrations"`, "COMMIT",
+			"BEGIN", "INSERT INTO users VALUES", "ROLLBACK",
+		}, migrationStatements(fake))
+		statements := fake.Statements()
+		assert.Equal(t, "SELECT pg_advisory_unlock($1)", statements[len(statements)-1].SQL)
+	})
+	t.Run("checksum-mismatch", func(t *testing.T) {
+		var calls []string
+		migrations := testMigrations(&calls)
+		modified := migrations[1]
+		modified.UpSQL = "CREATE TABLE users (id uuid)"
+		m, fake := newTestMigrator(t, migrations, modified)
+		_, err := m.Up(ctx)
+		assert.True(t, errors.Is(err, ErrChecksumMismatch))
+		assert.Empty(t, migrationStatements(fake))
+	})
+}
+
+func TestDown(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("last", func(t *testing.T) {
+		var calls []string
+		migrations := testMigrations(&calls)
+		m, fake := newTestMigrator(t, migrations, migrations[1], migrations[2])
+		done, err := m.Down(ctx, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{2}, versions(done))
+		assert.Equal(t, []string{"down"}, calls)
+		assert.Equal(t, []string{"BEGIN", "DELETE FROM users", `DELETE FROM "schema_migrations" WHERE version = $1`, "COMMIT"}, migrationStatements(fake))
+		assert.Equal(t, int64(2), fake.Find(`DELETE FROM "schema_migrations"`)[0].Args[0])
+	})
+	t.Run("more-than-applied", func(t *testing.T) {
+		var calls []string
+		migrations := testMigrations(&calls)
+		m, _ := newTestMigrator(t, migrations, migrations[1], migrations[2])
+		done, err := m.Down(ctx, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{2, 1}, versions(done))
+	})
+	t.Run("none", func(t *testing.T) {
+		var calls []string
+		migrations := testMigrations(&calls)
+		m, fake := newTestMigrator(t, migrations, migrations[1])
+		done, err := m.Down(ctx, 0)
+		assert.NoError(t, err)
+		assert.Empty(t, done)
+		assert.Empty(t, migrationStatements(fake))
+	})
+	t.Run("negative-steps", func(t *testing.T) {
+		var calls []string
+		migrations := testMigrations(&calls)
+		m, fake := newTestMigrator(t, migrations, migrations[1])
+		done, err := m.Down(ctx, -1)
+		assert.True(t, errors.Is(err, errInvalidSteps))
+		assert.Empty(t, done)
+		// the lock is not even acquired
+		assert.Empty(t, fake.Statements())
+	})
+	t.Run("dry-run", func(t *testing.T) {
+		var calls []string
+		migrations := testMigrations(&calls)
+		m, fake := newTestMigrator(t, migrations, migrations[1], migrations[2])
+		m.config.DryRun = true
+		done, err := m.Down(ctx, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{2, 1}, versions(done))
+		assert.Empty(t, calls)
+		assert.Empty(t, migrationStatements(fake))
+	})
+	t.Run("irreversible", func(t *testing.T) {
+		var calls []string
+		migrations := testMigrations(&calls)
+		m, fake := newTestMigrator(t, migrations, migrations...)
+		_, err := m.Down(ctx, 1)
+		assert.True(t, errors.Is(err, ErrNoDown))
+		assert.Empty(t, migrationStatements(fake))
+	})
+	t.Run("unknown", func(t *testing.T) {
+		var calls []string
+		migrations := testMigrations(&calls)
+		m, fake := newTestMigrator(t, migrations, Migration{Version: 4, Name: "removed"})
+		_, err := m.Down(ctx, 1)
+		assert.True(t, errors.Is(err, ErrUnknownMigration))
+		assert.EqualError(t, err, "migrate: applied migration is unknown: 4_removed")
+		assert.Empty(t, migrationStatements(fake))
+	})
+}
+
+func TestStatus(t *testing.T) {
+	var calls []string
+	migrations := testMigrations(&calls)
+	modified := migrations[2]
+	modified.Up = nil
+	modified.UpSQL = "INSERT INTO users VALUES ('admin')"
+	m, _ := newTestMigrator(t, migrations, migrations[1], modified, Migration{Version: 4, Name: "removed"})
+	status, err := m.Status(context.Background())
+	assert.NoError(t, err)
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, []Status{
+		{Version: 1, Name: "create_users", Applied: true, AppliedAt: at},
+		{Version: 2, Name: "seed_users", Applied: true, AppliedAt: at, Modified: true},
+		{Version: 3, Name: "index_users"},
+		{Version: 4, Name: "removed", Applied: true, AppliedAt: at, Unknown: true},
+	}, status)
+}
+
+func TestFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0002_index_users.up.sql":    {Data: []byte(NoTransactionDirective + "\nCREATE INDEX CONCURRENTLY users_name ON users (name)")},
+		"migrations/0001_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id text)")},
+		"migrations/0001_create_users.down.sql": {Data: []byte("DROP TABLE users")},
+		"migrations/README.md":                  {Data: []byte("ignored")},
+		"migrations/old/0003_ignored.up.sql":    {Data: []byte("ignored")},
+	}
+	migrations, err := FromFS(fsys, "migrations")
+	assert.NoError(t, err)
+	assert.Equal(t, []Migration{
+		{Version: 1, Name: "create_users", UpSQL: "CREATE TABLE users (id text)", DownSQL: "DROP TABLE users"},
+		{Version: 2, Name: "index_users", UpSQL: NoTransactionDirective + "\nCREATE INDEX CONCURRENTLY users_name ON users (name)", NoTransaction: true},
+	}, migrations)
+
+	invalid := []struct {
+		name  string
+		files fstest.MapFS
+		err   error
+	}{
+		{"no-direction", fstest.MapFS{"m/0001_users.sql": {}}, errInvalidFileName},
+		{"no-version", fstest.MapFS{"m/users.up.sql": {}}, errInvalidFileName},
+		{"zero-version", fstest.MapFS{"m/0_users.up.sql": {}}, errInvalidFileName},
+		{"duplicate-version", fstest.MapFS{"m/1_users.up.sql": {Data: []byte("SELECT 1")}, "m/1_groups.down.sql": {}}, errDuplicateVersion},
+		{"no-up", fstest.MapFS{"m/1_users.down.sql": {Data: []byte("SELECT 1")}}, errNoUp},
+	}
+	for _, c := range invalid {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := FromFS(c.files, "m")
+			assert.True(t, errors.Is(err, c.err), "%v", err)
+		})
+	}
+	_, err = FromFS(fsys, "missing")
+	assert.Error(t, err)
+}
+
+func TestCommand(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name   string
+		args   []string
+		output string
+		err    error
+	}{
+		{
+			name:   "up",
+			args:   []string{"up", "2"},
+			output: "applied 2_seed_users\n",
+		},
+		{
+			name:   "up-dry-run",
+			args:   []string{"-dry-run", "up"},
+			output: "would be applied 2_seed_users\nwould be applied 3_index_users\n",
+		},
+		{
+			name:   "down",
+			args:   []string{"down"},
+			output: "reverted 1_create_users\n",
+		},
+		{
+			name:   "status",
+			args:   []string{"status"},
+			output: "VERSION  NAME          STATUS   APPLIED AT\n1        create_users  applied  2021-01-01T00:00:00Z\n2        seed_users    pending  \n3        index_users   pending  \n",
+		},
+		{name: "no-command", err: errUsage},
+		{name: "unknown-command", args: []string{"redo"}, err: errUsage},
+		{name: "negative-steps", args: []string{"down", "-1"}, err: errUsage},
+		{name: "invalid-version", args: []string{"up", "latest"}, err: errUsage},
+		{name: "too-many-arguments", args: []string{"up", "1", "2"}, err: errUsage},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var calls []string
+			migrations := testMigrations(&calls)
+			m, _ := newTestMigrator(t, migrations, migrations[1])
+			var out bytes.Buffer
+			err := Command(ctx, m, c.args, &out)
+			assert.Equal(t, c.err, err)
+			if c.err != nil {
+				assert.True(t, strings.HasPrefix(out.String(), "usage: migrate"))
+				return
+			}
+			assert.Equal(t, c.output, out.String())
+			// the dry-run flag does not change the migrator
+			assert.False(t, m.config.DryRun)
+		})
+	}
+}
@@ -0,0 +1,109 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NoTransactionDirective marks the SQL files that must run outside of a
+// transaction when it is their first line
+const NoTransactionDirective = "-- migrate:no-transaction"
+
+var (
+	errInvalidFileName = errors.New("migrate: invalid migration file name")
+)
+
+// FromFS loads the migrations of the SQL files of a directory, such as an
+// embed.FS. Files are named <version>_<name>.up.sql and <version>_<name>.down.sql,
+// for instance 0001_create_users.up.sql. Down files are optional.
+func FromFS(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		version, title, up, err := parseFileName(name)
+		if err != nil {
+			return nil, err
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		mg, found := byVersion[version]
+		if !found {
+			mg = &Migration{Version: version, Name: title}
+			byVersion[version] = mg
+		} else if mg.Name != title {
+			return nil, fmt.Errorf("%w: %d", errDuplicateVersion, version)
+		}
+		query := string(content)
+		if up {
+			if mg.UpSQL != "" {
+				return nil, fmt.Errorf("%w: %d", errDuplicateVersion, version)
+			}
+			mg.UpSQL = query
+			mg.NoTransaction = strings.HasPrefix(strings.TrimSpace(query), NoTransactionDirective)
+		} else {
+			if mg.DownSQL != "" {
+				return nil, fmt.Errorf("%w: %d", errDuplicateVersion, version)
+			}
+			mg.DownSQL = query
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mg := range byVersion {
+		if mg.UpSQL == "" {
+			return nil, fmt.Errorf("%w: %s", errNoUp, mg)
+		}
+		migrations = append(migrations, *mg)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// parseFileName splits <version>_<name>.<up|down>.sql
+func parseFileName(file string) (version int64, name string, up bool, err error) {
+	base := strings.TrimSuffix(file, ".sql")
+	switch {
+	case strings.HasSuffix(base, ".up"):
+		base, up = strings.TrimSuffix(base, ".up"), true
+	case strings.HasSuffix(base, ".down"):
+		base = strings.TrimSuffix(base, ".down")
+	default:
+		return 0, "", false, fmt.Errorf("%w: %s", errInvalidFileName, file)
+	}
+	parts := strings.SplitN(base, "_", 2)
+	version, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, "", false, fmt.Errorf("%w: %s", errInvalidFileName, file)
+	}
+	if len(parts) == 2 {
+		name = parts[1]
+	}
+	return version, name, up, nil
+}
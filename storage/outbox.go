@@ -0,0 +1,314 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/zerjioang/zgo/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Events written with Enqueue inside AsTransaction are committed, or rolled
+// back, together with the rest of the writes of the transaction. A Relay
+// polls the outbox table and hands pending events to a Publisher. Delivery
+// is at least once: an event may be published again if the relay stops, or
+// fails to mark it delivered, after publishing it. Events are marked one at
+// a time, so this only affects the event being published, never the events
+// already published by the same poll.
+
+// Outbox event status
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	// OutboxDead is the status of the events that failed MaxAttempts times
+	OutboxDead = "dead"
+)
+
+// Relay defaults
+const (
+	DefaultOutboxPollInterval = time.Second
+	DefaultOutboxBatchSize    = 100
+	DefaultOutboxMaxAttempts  = 10
+	DefaultOutboxMinBackoff   = time.Second
+	DefaultOutboxMaxBackoff   = 5 * time.Minute
+)
+
+var (
+	errNoPublisher = errors.New("outbox relay requires a publisher")
+)
+
+// Event is a message to publish once the transaction that enqueues it commits
+type Event struct {
+	// Topic is the destination of the event
+	Topic string
+	// Key identifies the entity the event is about, and can be used by
+	// publishers to keep the events of an entity ordered
+	Key     string
+	Payload []byte
+}
+
+// OutboxEvent is an event stored in the outbox table
+type OutboxEvent struct {
+	ID      string `gorm:"primaryKey" json:"id"`
+	Topic   string `gorm:"not null" json:"topic"`
+	Key     string `json:"key,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+	// Status is one of OutboxPending, OutboxDelivered or OutboxDead
+	Status   string `gorm:"not null;index:idx_zgo_outbox_status,priority:1" json:"status"`
+	Attempts int    `gorm:"not null" json:"attempts"`
+	// NextAttemptAt is the time after which a pending event can be published
+	NextAttemptAt time.Time  `gorm:"not null;index:idx_zgo_outbox_status,priority:2" json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `gorm:"not null" json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// TableName returns the name of the outbox table
+func (OutboxEvent) TableName() string {
+	return "zgo_outbox"
+}
+
+// MigrateOutbox creates or updates the outbox table
+func MigrateOutbox(db *gorm.DB) error {
+	return db.AutoMigrate(&OutboxEvent{})
+}
+
+// Enqueue writes the events to the outbox table using given transaction,
+// usually the one received by the function passed to AsTransaction
+func Enqueue(tx *gorm.DB, events ...Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	now := time.Now()
+	rows := make([]OutboxEvent, len(events))
+	for i, event := range events {
+		rows[i] = OutboxEvent{
+			ID:            uuid.New(),
+			Topic:         event.Topic,
+			Key:           event.Key,
+			Payload:       event.Payload,
+			Status:        OutboxPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+	}
+	return CheckResult(tx.Create(&rows), false)
+}
+
+// Publisher delivers outbox events to a message broker
+type Publisher interface {
+	Publish(ctx context.Context, event OutboxEvent) error
+}
+
+// PublisherFunc adapts a function to the Publisher interface
+type PublisherFunc func(ctx context.Context, event OutboxEvent) error
+
+// Publish calls f(ctx, event)
+func (f PublisherFunc) Publish(ctx context.Context, event OutboxEvent) error {
+	return f(ctx, event)
+}
+
+// RelayConfig configures an outbox relay. Zero values are replaced by the defaults.
+type RelayConfig struct {
+	Publisher Publisher
+	// PollInterval is the wait between polls when the outbox has no pending events
+	PollInterval time.Duration
+	// BatchSize is the maximum number of events published per poll
+	BatchSize int
+	// MaxAttempts is the number of failed publications after which an event is dead
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the exponential wait between attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (c RelayConfig) withDefaults() RelayConfig {
+	if c.PollInterval <= 0 {
+		c.PollInterval = DefaultOutboxPollInterval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultOutboxBatchSize
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultOutboxMaxAttempts
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = DefaultOutboxMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = DefaultOutboxMaxBackoff
+		if c.MaxBackoff < c.MinBackoff {
+			c.MaxBackoff = c.MinBackoff
+		}
+	}
+	return c
+}
+
+// Relay publishes the pending events of the outbox table. Several relays
+// can poll the same table: events being published are locked and skipped
+// by the rest of the relays.
+type Relay struct {
+	db     *ORMDatabase
+	config RelayConfig
+}
+
+// NewRelay returns a relay of the outbox table of given database
+func NewRelay(db *ORMDatabase, config RelayConfig) (*Relay, error) {
+	if config.Publisher == nil {
+		return nil, errNoPublisher
+	}
+	return &Relay{db: db, config: config.withDefaults()}, nil
+}
+
+// Run polls the outbox until the context is done
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.Poll(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Println("outbox relay:", err)
+		}
+		if n == r.config.BatchSize && err == nil {
+			// there may be more pending events
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.config.PollInterval):
+		}
+	}
+}
+
+// Poll publishes up to BatchSize of the pending events due for publication,
+// and returns the number of events processed, whether they succeeded or not.
+// Every event is published and marked in its own transaction, so an error
+// only rolls back the mark of the event being published, which is published
+// again on a later poll.
+func (r *Relay) Poll(ctx context.Context) (int, error) {
+	processed := 0
+	for processed < r.config.BatchSize {
+		found, err := r.publishNext(ctx)
+		if err != nil {
+			return processed, err
+		}
+		if !found {
+			break
+		}
+		processed++
+	}
+	return processed, nil
+}
+
+// publishNext publishes the next pending event due for publication. The
+// event stays locked, and skipped by the rest of the relays, until its
+// status is committed. It returns false if there are no events due.
+func (r *Relay) publishNext(ctx context.Context) (bool, error) {
+	found := false
+	err := r.db.Db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var events []OutboxEvent
+		find := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", OutboxPending, time.Now()).
+			Order("next_attempt_at").Order("created_at").
+			Limit(1).
+			Find(&events)
+		if err := CheckResult(find, false); err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		event := events[0]
+		if err := r.config.Publisher.Publish(ctx, event); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := r.failed(tx, event, err); err != nil {
+				return err
+			}
+		} else if err := r.delivered(tx, event); err != nil {
+			return err
+		}
+		found = true
+		return nil
+	})
+	return found, err
+}
+
+// delivered marks the event as delivered
+func (r *Relay) delivered(tx *gorm.DB, event OutboxEvent) error {
+	now := time.Now()
+	return r.update(tx, event, map[string]interface{}{
+		"status":       OutboxDelivered,
+		"attempts":     event.Attempts + 1,
+		"delivered_at": now,
+		"last_error":   "",
+	})
+}
+
+// failed schedules the next attempt of the event, or marks it as dead
+func (r *Relay) failed(tx *gorm.DB, event OutboxEvent, cause error) error {
+	attempts := event.Attempts + 1
+	values := map[string]interface{}{
+		"attempts":   attempts,
+		"last_error": cause.Error(),
+	}
+	if attempts >= r.config.MaxAttempts {
+		values["status"] = OutboxDead
+	} else {
+		values["next_attempt_at"] = time.Now().Add(r.backoff(attempts))
+	}
+	return r.update(tx, event, values)
+}
+
+func (r *Relay) update(tx *gorm.DB, event OutboxEvent, values map[string]interface{}) error {
+	return CheckResult(tx.Model(&OutboxEvent{}).Where("id = ?", event.ID).Updates(values), false)
+}
+
+// backoff returns the wait before the next attempt after given failed attempts
+func (r *Relay) backoff(attempts int) time.Duration {
+	d := r.config.MinBackoff
+	for i := 1; i < attempts && d < r.config.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.config.MaxBackoff {
+		d = r.config.MaxBackoff
+	}
+	return d
+}
+
+// Dead returns up to limit dead events, oldest first
+func (r *Relay) Dead(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	var events []OutboxEvent
+	tx := r.db.Db.WithContext(ctx).Where("status = ?", OutboxDead).Order("created_at").Limit(limit).Find(&events)
+	return events, CheckResult(tx, false)
+}
+
+// Requeue moves dead events back to pending, resetting their attempts
+func (r *Relay) Requeue(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx := r.db.Db.WithContext(ctx).Model(&OutboxEvent{}).
+		Where("status = ? AND id IN ?", OutboxDead, ids).
+		Updates(map[string]interface{}{
+			"status":          OutboxPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		})
+	return CheckResult(tx, false)
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zerjioang/zgo/storage/storagetest"
+	"gorm.io/gorm"
+)
+
+var outboxColumns = []string{"id", "topic", "key", "payload", "status", "attempts", "next_attempt_at", "created_at"}
+
+func outboxRow(id string, attempts int) []interface{} {
+	now := time.Now()
+	return []interface{}{id, "users", "a", []byte("{}"), OutboxPending, int64(attempts), now, now}
+}
+
+// commands returns the first word of the statements received by fake
+func commands(fake *storagetest.Database) []string {
+	var found []string
+	for _, s := range fake.Statements() {
+		found = append(found, strings.Fields(s.SQL)[0])
+	}
+	return found
+}
+
+func TestEnqueue(t *testing.T) {
+	db, fake := newTestDB(t)
+	err := db.AsTransaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&testItem{}).Error; err != nil {
+			return err
+		}
+		return Enqueue(tx,
+			Event{Topic: "users", Key: "a", Payload: []byte(`{"name":"a"}`)},
+			Event{Topic: "users", Key: "b"},
+		)
+	})
+	assert.NoError(t, err)
+	var queries []string
+	for _, s := range fake.Statements() {
+		queries = append(queries, strings.SplitN(s.SQL, " (", 2)[0])
+	}
+	// the events are written in the transaction of the rest of the writes
+	assert.Equal(t, []string{"BEGIN", `INSERT INTO "test_items"`, `INSERT INTO "zgo_outbox"`, "COMMIT"}, queries)
+	insert := fake.Find(`INSERT INTO "zgo_outbox"`)[0]
+	assert.Contains(t, insert.SQL, "),(")
+	assert.Contains(t, insert.Args, "users")
+	assert.Contains(t, insert.Args, OutboxPending)
+	assert.Contains(t, insert.Args, []byte(`{"name":"a"}`))
+
+	fake.Reset()
+	assert.NoError(t, Enqueue(db.Db))
+	assert.Empty(t, fake.Statements())
+}
+
+func TestRelay(t *testing.T) {
+	ctx := context.Background()
+	failure := errors.New("broker is down")
+	publisher := func(published *[]string) Publisher {
+		return PublisherFunc(func(ctx context.Context, event OutboxEvent) error {
+			*published = append(*published, event.ID)
+			if event.ID != "delivered" {
+				return failure
+			}
+			return nil
+		})
+	}
+
+	t.Run("config", func(t *testing.T) {
+		db, _ := newTestDB(t)
+		_, err := NewRelay(db, RelayConfig{})
+		assert.Equal(t, errNoPublisher, err)
+		relay, err := NewRelay(db, RelayConfig{Publisher: PublisherFunc(nil), MinBackoff: time.Hour})
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultOutboxPollInterval, relay.config.PollInterval)
+		assert.Equal(t, DefaultOutboxBatchSize, relay.config.BatchSize)
+		assert.Equal(t, DefaultOutboxMaxAttempts, relay.config.MaxAttempts)
+		// the maximum backoff is never below the minimum
+		assert.Equal(t, time.Hour, relay.config.MaxBackoff)
+	})
+	t.Run("backoff", func(t *testing.T) {
+		relay := &Relay{config: RelayConfig{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+		expected := map[int]time.Duration{
+			1:  time.Second,
+			2:  2 * time.Second,
+			3:  4 * time.Second,
+			4:  8 * time.Second,
+			5:  10 * time.Second,
+			64: 10 * time.Second,
+		}
+		for attempts, d := range expected {
+			assert.Equal(t, d, relay.backoff(attempts), "attempts %d", attempts)
+		}
+	})
+	t.Run("poll", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "zgo_outbox"`).Returns(outboxColumns, outboxRow("delivered", 0)).Times(1)
+		fake.On(`FROM "zgo_outbox"`).Returns(outboxColumns, outboxRow("retried", 1)).Times(1)
+		fake.On(`FROM "zgo_outbox"`).Returns(outboxColumns, outboxRow("dead", 2)).Times(1)
+		var published []string
+		relay, err := NewRelay(db, RelayConfig{Publisher: publisher(&published), BatchSize: 3, MaxAttempts: 3, MinBackoff: time.Minute})
+		assert.NoError(t, err)
+		start := time.Now()
+		n, err := relay.Poll(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+		assert.Equal(t, []string{"delivered", "retried", "dead"}, published)
+
+		poll := fake.Find(`FROM "zgo_outbox"`)[0]
+		assert.Equal(t, `SELECT * FROM "zgo_outbox" WHERE status = $1 AND next_attempt_at <= $2 ORDER BY next_attempt_at,created_at LIMIT 1 FOR UPDATE SKIP LOCKED`, poll.SQL)
+		assert.Equal(t, OutboxPending, poll.Args[0])
+
+		updates := fake.Find(`UPDATE "zgo_outbox"`)
+		if assert.Len(t, updates, 3) {
+			// columns are set in alphabetical order, followed by the id
+			assert.Equal(t, `UPDATE "zgo_outbox" SET "attempts"=$1,"delivered_at"=$2,"last_error"=$3,"status"=$4 WHERE id = $5`, updates[0].SQL)
+			assert.Equal(t, []interface{}{int64(1), "", OutboxDelivered, "delivered"}, []interface{}{updates[0].Args[0], updates[0].Args[2], updates[0].Args[3], updates[0].Args[4]})
+
+			assert.Equal(t, `UPDATE "zgo_outbox" SET "attempts"=$1,"last_error"=$2,"next_attempt_at"=$3 WHERE id = $4`, updates[1].SQL)
+			assert.Equal(t, int64(2), updates[1].Args[0])
+			assert.Equal(t, failure.Error(), updates[1].Args[1])
+			// the second failure waits twice the minimum backoff
+			next := updates[1].Args[2].(time.Time)
+			assert.False(t, next.Before(start.Add(2*time.Minute)))
+			assert.WithinDuration(t, start.Add(2*time.Minute), next, time.Minute)
+
+			assert.Equal(t, `UPDATE "zgo_outbox" SET "attempts"=$1,"last_error"=$2,"status"=$3 WHERE id = $4`, updates[2].SQL)
+			assert.Equal(t, []interface{}{int64(3), failure.Error(), OutboxDead, "dead"}, []interface{}{updates[2].Args[0], updates[2].Args[1], updates[2].Args[2], updates[2].Args[3]})
+		}
+		// every event is marked in its own transaction
+		transaction := []string{"BEGIN", "SELECT", "UPDATE", "COMMIT"}
+		var expected []string
+		for i := 0; i < 3; i++ {
+			expected = append(expected, transaction...)
+		}
+		assert.Equal(t, expected, commands(fake))
+	})
+	t.Run("poll-empty", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "zgo_outbox"`).Returns(outboxColumns, outboxRow("delivered", 0)).Times(1)
+		var published []string
+		relay, err := NewRelay(db, RelayConfig{Publisher: publisher(&published)})
+		assert.NoError(t, err)
+		n, err := relay.Poll(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Len(t, fake.Find(`FROM "zgo_outbox"`), 2)
+	})
+	t.Run("poll-rollback", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "zgo_outbox"`).Returns(outboxColumns, outboxRow("delivered", 0))
+		fake.On(`UPDATE "zgo_outbox"`).Affects(1).Times(1)
+		fake.On(`UPDATE "zgo_outbox"`).Fails(errors.New("connection reset"))
+		var published []string
+		relay, err := NewRelay(db, RelayConfig{Publisher: publisher(&published)})
+		assert.NoError(t, err)
+		n, err := relay.Poll(ctx)
+		assert.Error(t, err)
+		// the event published before the failure stays delivered
+		assert.Equal(t, 1, n)
+		assert.Equal(t, []string{"delivered", "delivered"}, published)
+		assert.Equal(t, []string{
+			"BEGIN", "SELECT", "UPDATE", "COMMIT",
+			"BEGIN", "SELECT", "UPDATE", "ROLLBACK",
+		}, commands(fake))
+	})
+	t.Run("poll-canceled", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "zgo_outbox"`).Returns(outboxColumns, outboxRow("first", 0), outboxRow("second", 0))
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var published []string
+		relay, err := NewRelay(db, RelayConfig{Publisher: PublisherFunc(func(ctx context.Context, event OutboxEvent) error {
+			published = append(published, event.ID)
+			cancel()
+			return ctx.Err()
+		})})
+		assert.NoError(t, err)
+		n, err := relay.Poll(ctx)
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 0, n)
+		// the event interrupted by the cancellation is not counted as an attempt
+		assert.Equal(t, []string{"first"}, published)
+		assert.Empty(t, fake.Find(`UPDATE "zgo_outbox"`))
+	})
+	t.Run("dead", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "zgo_outbox"`).Returns(outboxColumns, outboxRow("dead", 3))
+		relay, err := NewRelay(db, RelayConfig{Publisher: PublisherFunc(nil)})
+		assert.NoError(t, err)
+		events, err := relay.Dead(ctx, 10)
+		assert.NoError(t, err)
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, "dead", events[0].ID)
+			assert.Equal(t, 3, events[0].Attempts)
+		}
+		query := fake.Find(`FROM "zgo_outbox"`)[0]
+		assert.Equal(t, `SELECT * FROM "zgo_outbox" WHERE status = $1 ORDER BY created_at LIMIT 10`, query.SQL)
+		assert.Equal(t, OutboxDead, query.Args[0])
+	})
+	t.Run("requeue", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		relay, err := NewRelay(db, RelayConfig{Publisher: PublisherFunc(nil)})
+		assert.NoError(t, err)
+		assert.NoError(t, relay.Requeue(ctx))
+		assert.Empty(t, fake.Statements())
+		assert.NoError(t, relay.Requeue(ctx, "a", "b"))
+		updates := fake.Find(`UPDATE "zgo_outbox"`)
+		if assert.Len(t, updates, 1) {
+			assert.Equal(t, `UPDATE "zgo_outbox" SET "attempts"=$1,"next_attempt_at"=$2,"status"=$3 WHERE status = $4 AND id IN ($5,$6)`, updates[0].SQL)
+			args := updates[0].Args
+			assert.Equal(t, []interface{}{int64(0), OutboxPending, OutboxDead, "a", "b"}, []interface{}{args[0], args[2], args[3], args[4], args[5]})
+		}
+	})
+	t.Run("run", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "zgo_outbox"`).Returns(outboxColumns, outboxRow("delivered", 0)).Times(1)
+		var published []string
+		relay, err := NewRelay(db, RelayConfig{Publisher: publisher(&published), PollInterval: time.Millisecond})
+		assert.NoError(t, err)
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, relay.Run(ctx))
+		assert.Equal(t, []string{"delivered"}, published)
+		// polling goes on after the outbox is empty
+		assert.Greater(t, len(fake.Find(`FROM "zgo_outbox"`)), 1)
+	})
+}
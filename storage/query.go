@@ -0,0 +1,472 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+var (
+	// ErrInvalidQuery is returned when a query spec references unknown
+	// fields, uses an unsupported operator or carries a bad cursor
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
+func init() {
+	// cursor values are normalized to driver.Value types, and time.Time
+	// is the only one of them not known by gob
+	gob.Register(time.Time{})
+}
+
+// Op is a filter operator
+type Op string
+
+const (
+	OpEq    Op = "eq"
+	OpNe    Op = "ne"
+	OpIn    Op = "in"
+	OpRange Op = "range"
+	OpLike  Op = "like"
+)
+
+// Filter is a condition on a model field. Fields can be referenced
+// by their struct field name or by their column name.
+type Filter struct {
+	Field string      `json:"field"`
+	Op    Op          `json:"op"`
+	Value interface{} `json:"value,omitempty"`
+	// Values of the in operator
+	Values []interface{} `json:"values,omitempty"`
+	// From and To are the inclusive bounds of the range operator.
+	// A nil bound leaves the range open.
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// Eq returns a filter matching the rows where field equals value
+func Eq(field string, value interface{}) Filter {
+	return Filter{Field: field, Op: OpEq, Value: value}
+}
+
+// Ne returns a filter matching the rows where field is not equal to value
+func Ne(field string, value interface{}) Filter {
+	return Filter{Field: field, Op: OpNe, Value: value}
+}
+
+// In returns a filter matching the rows where field is one of the values
+func In(field string, values ...interface{}) Filter {
+	return Filter{Field: field, Op: OpIn, Values: values}
+}
+
+// Range returns a filter matching the rows where field is between from and to, both included
+func Range(field string, from, to interface{}) Filter {
+	return Filter{Field: field, Op: OpRange, From: from, To: to}
+}
+
+// Like returns a filter matching the rows where field matches the SQL LIKE pattern
+func Like(field string, pattern string) Filter {
+	return Filter{Field: field, Op: OpLike, Value: pattern}
+}
+
+// Sort orders the results by a model field
+type Sort struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
+}
+
+// QuerySpec describes a query over the rows of a model
+type QuerySpec struct {
+	Filters []Filter `json:"filters,omitempty"`
+	// Sort is applied in order. The primary key is always appended
+	// as the last sort field, so that pagination is deterministic.
+	Sort []Sort `json:"sort,omitempty"`
+	// Sortable whitelists the fields that can be sorted by.
+	// If empty, every field of the model is allowed.
+	Sortable []string `json:"-"`
+	// Limit is the size of a page. Zero reads every matching row.
+	Limit uint `json:"limit,omitempty"`
+	// Cursor is the Next token of the previous page
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Page is a page of results of a query
+type Page struct {
+	// Items is the destination created by the generator, filled with the results.
+	// Cached pages are copied, together with the structs pointed by the items,
+	// so items can be modified without modifying the cache. Maps, slices and
+	// pointers held by the items are still shared.
+	Items interface{}
+	// Next is the opaque token to read the next page, or empty on the last page
+	Next string
+}
+
+// cursor is the content of a page token: the sort values of the last
+// row of the page, and a hash of the query it belongs to
+type cursor struct {
+	Query  string
+	Values []interface{}
+}
+
+// GetPage returns a page of the rows of the model created by dst matching
+// the spec. Results are cached under a key derived from the spec and the
+// type of the destination.
+func (s *ORMDatabase) GetPage(ctx context.Context, spec QuerySpec, dst Generator) (Page, error) {
+	model := dst()
+	sch, err := s.schemaOf(model)
+	if err != nil {
+		return Page{}, err
+	}
+	sorts, err := spec.sortFields(sch)
+	if err != nil {
+		return Page{}, err
+	}
+	key, err := spec.cacheKey(sch.Table, reflect.TypeOf(model))
+	if err != nil {
+		return Page{}, err
+	}
+	if data, found := s.Cache.Get(key); found {
+		// cache HIT
+		page := data.(Page)
+		page.Items = copyItems(page.Items)
+		return page, nil
+	}
+	generation := s.generation(sch.Table)
+	tx, err := spec.apply(s.session().WithContext(ctx), sch, sorts)
+	if err != nil {
+		return Page{}, err
+	}
+	items := dst()
+	if err := CheckResult(tx.Find(items), false); err != nil {
+		return Page{}, err
+	}
+	page := Page{Items: items}
+	if page.Next, err = spec.next(items, sorts); err != nil {
+		return Page{}, err
+	}
+	s.store(sch.Table, generation, key, false, Page{Items: copyItems(items), Next: page.Next}, 10*time.Minute)
+	return page, nil
+}
+
+// copyItems returns a copy of the items read into a destination, copying
+// the slices and the structs they point to
+func copyItems(items interface{}) interface{} {
+	if items == nil {
+		return nil
+	}
+	return copyValue(reflect.ValueOf(items)).Interface()
+}
+
+func copyValue(rv reflect.Value) reflect.Value {
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return rv
+		}
+		cp := reflect.New(rv.Type().Elem())
+		cp.Elem().Set(copyValue(rv.Elem()))
+		return cp
+	case reflect.Slice:
+		if rv.IsNil() {
+			return rv
+		}
+		cp := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			cp.Index(i).Set(copyValue(rv.Index(i)))
+		}
+		return cp
+	}
+	return rv
+}
+
+// schemaOf returns the parsed schema of given model, or slice of models
+func (s *ORMDatabase) schemaOf(model interface{}) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: s.Db}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+// lookup returns the database field of the model referenced by name
+func lookup(sch *schema.Schema, name string) (*schema.Field, error) {
+	f := sch.LookUpField(name)
+	if f == nil || f.DBName == "" {
+		return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidQuery, name)
+	}
+	return f, nil
+}
+
+func column(f *schema.Field) clause.Column {
+	return clause.Column{Table: clause.CurrentTable, Name: f.DBName}
+}
+
+// valuerType is the type of the driver.Valuer interface
+var valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+
+// sortField is a validated sort
+type sortField struct {
+	field    *schema.Field
+	desc     bool
+	nullable bool
+}
+
+// nullable reports if the field can hold NULL: it is neither a primary key
+// nor declared not null, and its type can represent NULL, as pointers and
+// driver.Valuer types do. Fields of other types are assumed to never be NULL.
+func nullable(f *schema.Field) bool {
+	if f.PrimaryKey || f.NotNull {
+		return false
+	}
+	return f.FieldType.Kind() == reflect.Ptr || reflect.PtrTo(f.FieldType).Implements(valuerType)
+}
+
+// sortFields validates the sort against the whitelist and appends the primary key
+func (spec QuerySpec) sortFields(sch *schema.Schema) ([]sortField, error) {
+	allowed := map[string]bool{}
+	for _, name := range spec.Sortable {
+		f, err := lookup(sch, name)
+		if err != nil {
+			return nil, err
+		}
+		allowed[f.DBName] = true
+	}
+	pk := sch.PrioritizedPrimaryField
+	var sorts []sortField
+	hasPK := false
+	for _, srt := range spec.Sort {
+		f, err := lookup(sch, srt.Field)
+		if err != nil {
+			return nil, err
+		}
+		if len(allowed) > 0 && !allowed[f.DBName] && f != pk {
+			return nil, fmt.Errorf("%w: field %q is not sortable", ErrInvalidQuery, srt.Field)
+		}
+		hasPK = hasPK || f == pk
+		sorts = append(sorts, sortField{field: f, desc: srt.Desc, nullable: nullable(f)})
+	}
+	if pk != nil && !hasPK {
+		sorts = append(sorts, sortField{field: pk})
+	}
+	return sorts, nil
+}
+
+// apply adds the filters, sort, cursor and limit of the spec to the query
+func (spec QuerySpec) apply(tx *gorm.DB, sch *schema.Schema, sorts []sortField) (*gorm.DB, error) {
+	for _, filter := range spec.Filters {
+		expr, err := filter.expression(sch)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where(expr)
+	}
+	if spec.Cursor != "" {
+		expr, err := spec.after(sorts)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where(expr)
+	}
+	for _, srt := range sorts {
+		if !srt.nullable {
+			tx = tx.Order(clause.OrderByColumn{Column: column(srt.field), Desc: srt.desc})
+			continue
+		}
+		// NULL sorts after every value, as in PostgreSQL, whatever the database
+		order := tx.Statement.Quote(clause.Column{Table: sch.Table, Name: srt.field.DBName}) + " NULLS LAST"
+		if srt.desc {
+			order = tx.Statement.Quote(clause.Column{Table: sch.Table, Name: srt.field.DBName}) + " DESC NULLS FIRST"
+		}
+		tx = tx.Order(clause.OrderByColumn{Column: clause.Column{Name: order, Raw: true}})
+	}
+	if spec.Limit > 0 {
+		tx = tx.Limit(int(spec.Limit))
+	}
+	return tx, nil
+}
+
+// expression returns the SQL condition of the filter
+func (filter Filter) expression(sch *schema.Schema) (clause.Expression, error) {
+	f, err := lookup(sch, filter.Field)
+	if err != nil {
+		return nil, err
+	}
+	col := column(f)
+	switch filter.Op {
+	case OpEq:
+		return clause.Eq{Column: col, Value: filter.Value}, nil
+	case OpNe:
+		return clause.Neq{Column: col, Value: filter.Value}, nil
+	case OpIn:
+		return clause.IN{Column: col, Values: filter.Values}, nil
+	case OpLike:
+		return clause.Like{Column: col, Value: filter.Value}, nil
+	case OpRange:
+		var exprs []clause.Expression
+		if filter.From != nil {
+			exprs = append(exprs, clause.Gte{Column: col, Value: filter.From})
+		}
+		if filter.To != nil {
+			exprs = append(exprs, clause.Lte{Column: col, Value: filter.To})
+		}
+		if len(exprs) == 0 {
+			return nil, fmt.Errorf("%w: range on %q has no bounds", ErrInvalidQuery, filter.Field)
+		}
+		return clause.And(exprs...), nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported operator %q", ErrInvalidQuery, filter.Op)
+	}
+}
+
+// after returns the keyset condition that selects the rows after the cursor:
+// (a > va) OR (a = va AND b > vb) OR ..., using < for descending fields.
+// NULL sorts after every value, so it is compared with IS NULL.
+func (spec QuerySpec) after(sorts []sortField) (clause.Expression, error) {
+	c, err := spec.decodeCursor()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Values) != len(sorts) {
+		return nil, fmt.Errorf("%w: cursor does not match the sort", ErrInvalidQuery)
+	}
+	var or []clause.Expression
+	for i, srt := range sorts {
+		next := srt.after(c.Values[i])
+		if next == nil {
+			// no row comes after NULL in ascending order
+			continue
+		}
+		and := make([]clause.Expression, 0, i+1)
+		for j := 0; j < i; j++ {
+			// a nil value is compared with IS NULL
+			and = append(and, clause.Eq{Column: column(sorts[j].field), Value: c.Values[j]})
+		}
+		and = append(and, next)
+		or = append(or, clause.And(and...))
+	}
+	if len(or) == 1 {
+		// gorm joins a single OR condition to the filters with OR
+		return or[0], nil
+	}
+	return clause.Or(or...), nil
+}
+
+// after returns the condition that selects the values of the field after
+// given one, or nil if there are none
+func (srt sortField) after(v interface{}) clause.Expression {
+	col := column(srt.field)
+	switch {
+	case !srt.nullable && srt.desc:
+		return clause.Lt{Column: col, Value: v}
+	case !srt.nullable:
+		return clause.Gt{Column: col, Value: v}
+	case srt.desc && v == nil:
+		return clause.Neq{Column: col, Value: nil}
+	case srt.desc:
+		return clause.Lt{Column: col, Value: v}
+	case v == nil:
+		return nil
+	default:
+		return clause.Or(clause.Gt{Column: col, Value: v}, clause.Eq{Column: col, Value: nil})
+	}
+}
+
+// next returns the token of the page after the one read into items
+func (spec QuerySpec) next(items interface{}, sorts []sortField) (string, error) {
+	rv := reflect.Indirect(reflect.ValueOf(items))
+	if spec.Limit == 0 || rv.Kind() != reflect.Slice || rv.Len() < int(spec.Limit) {
+		return "", nil
+	}
+	last := reflect.Indirect(rv.Index(rv.Len() - 1))
+	c := cursor{Query: spec.hash()}
+	for _, srt := range sorts {
+		v, _ := srt.field.ValueOf(last)
+		// valuers and nil pointers are converted too
+		v, err := driver.DefaultParameterConverter.ConvertValue(v)
+		if err != nil {
+			return "", err
+		}
+		c.Values = append(c.Values, v)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (spec QuerySpec) decodeCursor() (cursor, error) {
+	var c cursor
+	raw, err := base64.RawURLEncoding.DecodeString(spec.Cursor)
+	if err != nil {
+		return c, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&c); err != nil {
+		return c, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	if c.Query != spec.hash() {
+		return c, fmt.Errorf("%w: cursor belongs to another query", ErrInvalidQuery)
+	}
+	return c, nil
+}
+
+// hash identifies the filters and sort of the spec, so that
+// cursors cannot be used with a different query
+func (spec QuerySpec) hash() string {
+	raw, _ := json.Marshal(QuerySpec{Filters: spec.Filters, Sort: spec.Sort})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:8])
+}
+
+// cacheKey derives the cache key of the spec, read into a destination of
+// given type, as pages of different destination types cannot be shared
+func (spec QuerySpec) cacheKey(table string, typ reflect.Type) (string, error) {
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	h := sha256.New()
+	h.Write(raw)
+	_, _ = fmt.Fprintf(h, "\x00%s\x00%s", pkgPath(typ), typ)
+	return table + ":query:" + hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// pkgPath returns the package of the named type of the items of typ
+func pkgPath(typ reflect.Type) string {
+	for typ != nil && typ.Name() == "" {
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array:
+			typ = typ.Elem()
+		default:
+			return ""
+		}
+	}
+	if typ == nil {
+		return ""
+	}
+	return typ.PkgPath()
+}
@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zerjioang/zgo/storage/storagetest"
+)
+
+// rankedItem is a model with a nullable column, stored in the ranked_items table
+type rankedItem struct {
+	Item
+	Rank *int64
+}
+
+var rankedColumns = []string{"id", "rank"}
+
+func genTestItems() interface{} {
+	return &[]testItem{}
+}
+
+func genRankedItems() interface{} {
+	return &[]rankedItem{}
+}
+
+// lastQuery returns the last statement that read given table
+func lastQuery(t *testing.T, fake *storagetest.Database, table string) storagetest.Statement {
+	t.Helper()
+	found := fake.Find(`FROM "` + table + `"`)
+	if len(found) == 0 {
+		t.Fatalf("%s was not read", table)
+	}
+	return found[len(found)-1]
+}
+
+func TestGetPageFilters(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name   string
+		filter Filter
+		where  string
+		args   []driver.Value
+	}{
+		{"eq", Eq("Name", "a"), `"test_items"."name" = $1`, []driver.Value{"a"}},
+		{"eq-column", Eq("name", "a"), `"test_items"."name" = $1`, []driver.Value{"a"}},
+		{"eq-null", Eq("DeletedAt", nil), `"test_items"."deleted_at" IS NULL`, nil},
+		{"ne", Ne("Score", 1), `"test_items"."score" <> $1`, []driver.Value{int64(1)}},
+		{"in", In("Score", 1, 2), `"test_items"."score" IN ($1,$2)`, []driver.Value{int64(1), int64(2)}},
+		{"range", Range("Score", 1, 5), `("test_items"."score" >= $1 AND "test_items"."score" <= $2)`, []driver.Value{int64(1), int64(5)}},
+		{"range-from", Range("Score", 1, nil), `"test_items"."score" >= $1`, []driver.Value{int64(1)}},
+		{"range-to", Range("Score", nil, 5), `"test_items"."score" <= $1`, []driver.Value{int64(5)}},
+		{"like", Like("Name", "a%"), `"test_items"."name" LIKE $1`, []driver.Value{"a%"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, fake := newTestDB(t)
+			_, err := db.GetPage(ctx, QuerySpec{Filters: []Filter{c.filter}}, genTestItems)
+			assert.NoError(t, err)
+			stmt := lastQuery(t, fake, "test_items")
+			assert.Contains(t, stmt.SQL, "WHERE "+c.where+` AND "test_items"."deleted_at" IS NULL`)
+			assert.Equal(t, c.args, stmt.Args)
+		})
+	}
+	invalid := []struct {
+		name   string
+		filter Filter
+	}{
+		{"unknown-field", Eq("Missing", 1)},
+		{"unknown-op", Filter{Field: "Name", Op: "gt", Value: 1}},
+		{"unbounded-range", Range("Score", nil, nil)},
+	}
+	for _, c := range invalid {
+		t.Run(c.name, func(t *testing.T) {
+			db, fake := newTestDB(t)
+			_, err := db.GetPage(ctx, QuerySpec{Filters: []Filter{c.filter}}, genTestItems)
+			assert.True(t, errors.Is(err, ErrInvalidQuery))
+			assert.Empty(t, fake.Statements())
+		})
+	}
+}
+
+func TestGetPageSort(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name  string
+		spec  QuerySpec
+		order string
+		err   error
+	}{
+		{
+			name:  "primary-key",
+			spec:  QuerySpec{},
+			order: `ORDER BY "test_items"."id"`,
+		},
+		{
+			name:  "fields",
+			spec:  QuerySpec{Sort: []Sort{{Field: "Score", Desc: true}, {Field: "name"}}},
+			order: `ORDER BY "test_items"."score" DESC,"test_items"."name","test_items"."id"`,
+		},
+		{
+			name:  "descending-primary-key",
+			spec:  QuerySpec{Sort: []Sort{{Field: "ID", Desc: true}}},
+			order: `ORDER BY "test_items"."id" DESC`,
+		},
+		{
+			name:  "whitelisted",
+			spec:  QuerySpec{Sort: []Sort{{Field: "score"}}, Sortable: []string{"Score"}},
+			order: `ORDER BY "test_items"."score","test_items"."id"`,
+		},
+		{
+			name:  "primary-key-always-sortable",
+			spec:  QuerySpec{Sort: []Sort{{Field: "ID"}}, Sortable: []string{"Score"}},
+			order: `ORDER BY "test_items"."id"`,
+		},
+		{
+			name:  "nullable",
+			spec:  QuerySpec{Sort: []Sort{{Field: "DeletedAt"}}},
+			order: `ORDER BY "test_items"."deleted_at" NULLS LAST,"test_items"."id"`,
+		},
+		{
+			name:  "nullable-descending",
+			spec:  QuerySpec{Sort: []Sort{{Field: "DeletedAt", Desc: true}}},
+			order: `ORDER BY "test_items"."deleted_at" DESC NULLS FIRST,"test_items"."id"`,
+		},
+		{
+			name: "not-whitelisted",
+			spec: QuerySpec{Sort: []Sort{{Field: "Name"}}, Sortable: []string{"Score"}},
+			err:  ErrInvalidQuery,
+		},
+		{
+			name: "unknown-field",
+			spec: QuerySpec{Sort: []Sort{{Field: "Missing"}}},
+			err:  ErrInvalidQuery,
+		},
+		{
+			name: "unknown-whitelisted-field",
+			spec: QuerySpec{Sortable: []string{"Missing"}},
+			err:  ErrInvalidQuery,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, fake := newTestDB(t)
+			_, err := db.GetPage(ctx, c.spec, genTestItems)
+			if c.err != nil {
+				assert.True(t, errors.Is(err, c.err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, strings.HasSuffix(lastQuery(t, fake, "test_items").SQL, c.order))
+		})
+	}
+}
+
+func TestGetPageCursor(t *testing.T) {
+	ctx := context.Background()
+	db, fake := newTestDB(t)
+	fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 5), testRow("b", "second", 3)).Times(1)
+	fake.On(`FROM "test_items"`).Returns(testColumns, testRow("c", "third", 3))
+	spec := QuerySpec{
+		Filters: []Filter{Like("Name", "%")},
+		Sort:    []Sort{{Field: "Score", Desc: true}},
+		Limit:   2,
+	}
+	page, err := db.GetPage(ctx, spec, genTestItems)
+	assert.NoError(t, err)
+	assert.Len(t, *page.Items.(*[]testItem), 2)
+	assert.NotEmpty(t, page.Next)
+
+	spec.Cursor = page.Next
+	page, err = db.GetPage(ctx, spec, genTestItems)
+	assert.NoError(t, err)
+	assert.Len(t, *page.Items.(*[]testItem), 1)
+	// a short page is the last one
+	assert.Empty(t, page.Next)
+	stmt := lastQuery(t, fake, "test_items")
+	assert.Contains(t, stmt.SQL, `WHERE "test_items"."name" LIKE $1 AND ("test_items"."score" < $2 OR ("test_items"."score" = $3 AND "test_items"."id" > $4))`)
+	assert.Equal(t, []driver.Value{"%", int64(3), int64(3), "b"}, stmt.Args)
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, token := range []string{"not a cursor", base64.RawURLEncoding.EncodeToString([]byte("garbage"))} {
+			spec := spec
+			spec.Cursor = token
+			_, err := db.GetPage(ctx, spec, genTestItems)
+			assert.True(t, errors.Is(err, ErrInvalidQuery))
+		}
+	})
+	t.Run("other-query", func(t *testing.T) {
+		other := spec
+		other.Filters = []Filter{Like("Name", "s%")}
+		_, err := db.GetPage(ctx, other, genTestItems)
+		assert.True(t, errors.Is(err, ErrInvalidQuery))
+		other = spec
+		other.Sort = []Sort{{Field: "Score"}}
+		_, err = db.GetPage(ctx, other, genTestItems)
+		assert.True(t, errors.Is(err, ErrInvalidQuery))
+	})
+}
+
+func TestGetPageNullableCursor(t *testing.T) {
+	ctx := context.Background()
+	one := int64(1)
+	cases := []struct {
+		name  string
+		desc  bool
+		last  interface{}
+		where string
+		args  []driver.Value
+	}{
+		{
+			name:  "ascending",
+			last:  one,
+			where: `(("ranked_items"."rank" > $1 OR "ranked_items"."rank" IS NULL) OR ("ranked_items"."rank" = $2 AND "ranked_items"."id" > $3))`,
+			args:  []driver.Value{int64(1), int64(1), "b"},
+		},
+		{
+			// only the rows with NULL rank and a greater id remain
+			name:  "ascending-null",
+			last:  nil,
+			where: `("ranked_items"."rank" IS NULL AND "ranked_items"."id" > $1)`,
+			args:  []driver.Value{"b"},
+		},
+		{
+			name:  "descending",
+			desc:  true,
+			last:  one,
+			where: `("ranked_items"."rank" < $1 OR ("ranked_items"."rank" = $2 AND "ranked_items"."id" > $3))`,
+			args:  []driver.Value{int64(1), int64(1), "b"},
+		},
+		{
+			name:  "descending-null",
+			desc:  true,
+			last:  nil,
+			where: `("ranked_items"."rank" IS NOT NULL OR ("ranked_items"."rank" IS NULL AND "ranked_items"."id" > $1))`,
+			args:  []driver.Value{"b"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, fake := newTestDB(t)
+			fake.On(`FROM "ranked_items"`).Returns(rankedColumns, []interface{}{"a", nil}, []interface{}{"b", c.last}).Times(1)
+			spec := QuerySpec{Sort: []Sort{{Field: "Rank", Desc: c.desc}}, Limit: 2}
+			page, err := db.GetPage(ctx, spec, genRankedItems)
+			assert.NoError(t, err)
+			spec.Cursor = page.Next
+			_, err = db.GetPage(ctx, spec, genRankedItems)
+			assert.NoError(t, err)
+			stmt := lastQuery(t, fake, "ranked_items")
+			assert.Contains(t, stmt.SQL, "WHERE "+c.where+` AND "ranked_items"."deleted_at" IS NULL`)
+			assert.Equal(t, c.args, stmt.Args)
+		})
+	}
+}
+
+func TestGetPageCache(t *testing.T) {
+	ctx := context.Background()
+	db, fake := newTestDB(t)
+	fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1))
+	spec := QuerySpec{Limit: 10}
+
+	page, err := db.GetPage(ctx, spec, genTestItems)
+	assert.NoError(t, err)
+	(*page.Items.(*[]testItem))[0].Name = "modified"
+	page, err = db.GetPage(ctx, spec, genTestItems)
+	assert.NoError(t, err)
+	assert.Len(t, fake.Find(`FROM "test_items"`), 1)
+	items := *page.Items.(*[]testItem)
+	assert.Equal(t, "first", items[0].Name)
+	items[0].Name = "modified"
+	page, err = db.GetPage(ctx, spec, genTestItems)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", (*page.Items.(*[]testItem))[0].Name)
+
+	t.Run("destination-type", func(t *testing.T) {
+		page, err := db.GetPage(ctx, spec, func() interface{} { return &[]*testItem{} })
+		assert.NoError(t, err)
+		pointers := *page.Items.(*[]*testItem)
+		assert.Equal(t, "first", pointers[0].Name)
+		assert.Len(t, fake.Find(`FROM "test_items"`), 2)
+		pointers[0].Name = "modified"
+		page, err = db.GetPage(ctx, spec, func() interface{} { return &[]*testItem{} })
+		assert.NoError(t, err)
+		assert.Equal(t, "first", (*page.Items.(*[]*testItem))[0].Name)
+	})
+	t.Run("invalidated", func(t *testing.T) {
+		assert.NoError(t, db.Create(ctx, &testItem{}))
+		_, err := db.GetPage(ctx, spec, genTestItems)
+		assert.NoError(t, err)
+		assert.Len(t, fake.Find(`FROM "test_items"`), 3)
+	})
+}
+
+func TestGetItems(t *testing.T) {
+	ctx := context.Background()
+	db, fake := newTestDB(t)
+	fake.On(`FROM "test_items"`).Returns(testColumns, testRow("b", "second", 2), testRow("a", "first", 1))
+	items, err := db.GetItems("items", ctx, "score desc", nil, 2, genTestItems)
+	assert.NoError(t, err)
+	assert.Len(t, *items.(*[]testItem), 2)
+	assert.Equal(t, `SELECT * FROM "test_items" WHERE "test_items"."deleted_at" IS NULL ORDER BY score desc LIMIT 2`, lastQuery(t, fake, "test_items").SQL)
+	_, err = db.GetItems("items", ctx, "score desc", nil, 2, genTestItems)
+	assert.NoError(t, err)
+	assert.Len(t, fake.Find(`FROM "test_items"`), 1)
+}
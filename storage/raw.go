@@ -0,0 +1,169 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm/schema"
+)
+
+var (
+	// ErrNoLoadStruct is returned by the models that do not implement LoadStruct
+	ErrNoLoadStruct = errors.New("LoadStruct method needs to be implemented")
+	errNotStructPtr = errors.New("scan destination must be a pointer to a struct")
+)
+
+// QueryRaw runs a raw SQL query and loads every row with parser.LoadStruct,
+// bypassing GORM reflection. Models without their own LoadStruct, such as the
+// ones relying on the one of ItemMetadata, are loaded with ScanRow into new
+// instances of the type of parser. Results are not cached.
+func (s *ORMDatabase) QueryRaw(ctx context.Context, query string, args []interface{}, parser SQLItemParser) ([]interface{}, error) {
+	var items []interface{}
+	err := s.QueryRawEach(ctx, query, args, parser, func(item interface{}) error {
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+// QueryRawEach runs a raw SQL query and streams every row loaded as with
+// QueryRaw to fn, without holding the results in memory.
+// Iteration stops at the first error returned by fn.
+func (s *ORMDatabase) QueryRawEach(ctx context.Context, query string, args []interface{}, parser SQLItemParser, fn func(item interface{}) error) error {
+	rows, err := s.Db.WithContext(ctx).Raw(query, args...).Rows()
+	if err != nil {
+		return TranslateError(err)
+	}
+	defer rows.Close()
+	load := parser.LoadStruct
+	for rows.Next() {
+		item, err := load(rows)
+		if errors.Is(err, ErrNoLoadStruct) {
+			load = scanner(parser)
+			item, err = load(rows)
+		}
+		if err != nil {
+			return TranslateError(err)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return TranslateError(rows.Err())
+}
+
+// scanner returns a function that loads the rows with ScanRow into new
+// instances of the type of parser, if it is a pointer to a struct
+func scanner(parser SQLItemParser) func(rows *sql.Rows) (interface{}, error) {
+	typ := reflect.TypeOf(parser)
+	return func(rows *sql.Rows) (interface{}, error) {
+		if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+			return nil, ErrNoLoadStruct
+		}
+		item := reflect.New(typ.Elem()).Interface()
+		return item, ScanRow(rows, item)
+	}
+}
+
+// scanPlans caches the field of every column of the scanned types
+var scanPlans sync.Map
+
+type scanPlanKey struct {
+	typ     reflect.Type
+	columns string
+}
+
+// ScanRow scans the current row into dst, a pointer to a model, matching the
+// columns with the fields by their column name, as derived by GORM from
+// the struct tags. Unknown columns are discarded. The field mapping is
+// computed once per model and set of columns, so ScanRow can implement
+// LoadStruct without reflecting on every row:
+//
+//	func (u *User) LoadStruct(rows *sql.Rows) (interface{}, error) {
+//		item := &User{}
+//		return item, storage.ScanRow(rows, item)
+//	}
+func ScanRow(rows *sql.Rows, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errNotStructPtr
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	plan, err := scanPlanOf(rv.Elem().Type(), columns)
+	if err != nil {
+		return err
+	}
+	elem := rv.Elem()
+	targets := make([]interface{}, len(plan))
+	for i, index := range plan {
+		if index == nil {
+			targets[i] = new(interface{})
+			continue
+		}
+		targets[i] = elem.FieldByIndex(index).Addr().Interface()
+	}
+	return rows.Scan(targets...)
+}
+
+// scanPlanOf returns the field index of every column, or nil for unknown columns
+func scanPlanOf(typ reflect.Type, columns []string) ([][]int, error) {
+	key := scanPlanKey{typ: typ, columns: strings.Join(columns, ",")}
+	if plan, found := scanPlans.Load(key); found {
+		return plan.([][]int), nil
+	}
+	sch, err := schema.Parse(reflect.New(typ).Interface(), &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", typ, err)
+	}
+	plan := make([][]int, len(columns))
+	for i, column := range columns {
+		if f := sch.LookUpField(column); f != nil && f.DBName != "" {
+			plan[i] = f.StructField.Index
+			// embedded structs are reported with the index of the embedded field
+			if len(f.BindNames) > 1 {
+				plan[i] = indexOf(typ, f.BindNames)
+			}
+		}
+	}
+	scanPlans.Store(key, plan)
+	return plan, nil
+}
+
+// indexOf returns the index path of the field reached through given field
+// names, or nil if the path goes through a pointer
+func indexOf(typ reflect.Type, names []string) []int {
+	var index []int
+	for i, name := range names {
+		f, found := typ.FieldByName(name)
+		if !found {
+			return nil
+		}
+		index = append(index, f.Index...)
+		typ = f.Type
+		if typ.Kind() == reflect.Ptr && i < len(names)-1 {
+			// fields of embedded pointers may not be allocated
+			return nil
+		}
+	}
+	return index
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testParser loads the rows of the test_items table with ScanRow
+type testParser struct{}
+
+func (testParser) LoadStruct(rows *sql.Rows) (interface{}, error) {
+	item := &testItem{}
+	return item, ScanRow(rows, item)
+}
+
+func TestQueryRaw(t *testing.T) {
+	ctx := context.Background()
+	query := "SELECT * FROM test_items WHERE score > ?"
+
+	t.Run("all", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("FROM test_items").Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2))
+		items, err := db.QueryRaw(ctx, query, []interface{}{0}, testParser{})
+		assert.NoError(t, err)
+		if assert.Len(t, items, 2) {
+			assert.Equal(t, &testItem{Item: Item{ID: "a"}, Name: "first", Score: 1}, items[0])
+			assert.Equal(t, &testItem{Item: Item{ID: "b"}, Name: "second", Score: 2}, items[1])
+		}
+		stmt := fake.Find("FROM test_items")[0]
+		assert.Equal(t, "SELECT * FROM test_items WHERE score > $1", stmt.SQL)
+		assert.Equal(t, int64(0), stmt.Args[0])
+	})
+	t.Run("each-stopped", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("FROM test_items").Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2))
+		stop := errors.New("stop")
+		var seen []string
+		err := db.QueryRawEach(ctx, query, []interface{}{0}, testParser{}, func(item interface{}) error {
+			seen = append(seen, item.(*testItem).Name)
+			return stop
+		})
+		assert.Equal(t, stop, err)
+		assert.Equal(t, []string{"first"}, seen)
+	})
+	t.Run("without-load-struct", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("FROM test_items").Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2))
+		// models relying on the LoadStruct of ItemMetadata are scanned
+		items, err := db.QueryRaw(ctx, query, []interface{}{0}, &testItem{})
+		assert.NoError(t, err)
+		if assert.Len(t, items, 2) {
+			assert.Equal(t, &testItem{Item: Item{ID: "a"}, Name: "first", Score: 1}, items[0])
+			assert.Equal(t, &testItem{Item: Item{ID: "b"}, Name: "second", Score: 2}, items[1])
+		}
+	})
+	t.Run("not-implemented", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("FROM test_items").Returns(testColumns, testRow("a", "first", 1))
+		_, err := db.QueryRaw(ctx, query, []interface{}{0}, valueItem{})
+		assert.Equal(t, ErrNoLoadStruct, err)
+	})
+	t.Run("failed", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("FROM test_items").Fails(context.DeadlineExceeded)
+		_, err := db.QueryRaw(ctx, query, []interface{}{0}, testParser{})
+		assert.True(t, errors.Is(err, ErrTimeout))
+	})
+}
+
+func TestScanRow(t *testing.T) {
+	ctx := context.Background()
+	scan := func(db *ORMDatabase, dst interface{}) error {
+		rows, err := db.Db.WithContext(ctx).Raw("SELECT * FROM test_items").Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		assert.True(t, rows.Next())
+		return ScanRow(rows, dst)
+	}
+
+	t.Run("columns", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		// unknown columns are discarded, and missing ones left untouched
+		fake.On("FROM test_items").Returns([]string{"score", "unknown", "id", "deleted_at"}, []interface{}{int64(3), "x", "a", nil})
+		item := &testItem{Name: "kept"}
+		assert.NoError(t, scan(db, item))
+		assert.Equal(t, &testItem{Item: Item{ID: "a"}, Name: "kept", Score: 3}, item)
+	})
+	t.Run("plan-cache", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("FROM test_items").Returns([]string{"id", "name"}, []interface{}{"a", "first"})
+		assert.NoError(t, scan(db, &testItem{}))
+		assert.NoError(t, scan(db, &testItem{}))
+		var plans int
+		scanPlans.Range(func(key, value interface{}) bool {
+			if k := key.(scanPlanKey); k.typ == reflect.TypeOf(testItem{}) && k.columns == "id,name" {
+				plans++
+			}
+			return true
+		})
+		assert.Equal(t, 1, plans)
+	})
+	t.Run("not-struct-pointer", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("FROM test_items").Returns([]string{"id"}, []interface{}{"a"})
+		assert.Equal(t, errNotStructPtr, scan(db, testItem{}))
+		name := ""
+		assert.Equal(t, errNotStructPtr, scan(db, &name))
+	})
+}
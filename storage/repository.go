@@ -0,0 +1,114 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"context"
+	"reflect"
+)
+
+// TypedRepository is a type safe access layer to the rows of model T,
+// built on ORMDatabase and its cache. T must be a pointer to a struct,
+// such as *User, so that new items can be allocated.
+type TypedRepository[T DbItem] struct {
+	db       *ORMDatabase
+	itemType reflect.Type
+}
+
+// NewTypedRepository returns the repository of model T. It panics if T
+// is not a pointer to a struct.
+func NewTypedRepository[T DbItem](db *ORMDatabase) *TypedRepository[T] {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		panic("storage: TypedRepository model must be a pointer to a struct, got " + typ.String())
+	}
+	return &TypedRepository[T]{
+		db:       db,
+		itemType: typ.Elem(),
+	}
+}
+
+// New allocates an empty item
+func (r *TypedRepository[T]) New() T {
+	return reflect.New(r.itemType).Interface().(T)
+}
+
+func (r *TypedRepository[T]) newItem() interface{} {
+	return r.New()
+}
+
+func (r *TypedRepository[T]) newList() interface{} {
+	return &[]T{}
+}
+
+// Get returns the item with given primary key. Items are cached
+// under a key derived from their table and primary key, and a copy
+// of the cached item is returned.
+func (r *TypedRepository[T]) Get(ctx context.Context, id string) (T, error) {
+	item, err := r.db.ReadByKey("", ctx, r.newItem, id)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return copyItems(item).(T), nil
+}
+
+// List returns the items matching the spec
+func (r *TypedRepository[T]) List(ctx context.Context, spec QuerySpec) ([]T, error) {
+	items, _, err := r.ListPage(ctx, spec)
+	return items, err
+}
+
+// ListPage returns the items matching the spec, and the token of the next page
+func (r *TypedRepository[T]) ListPage(ctx context.Context, spec QuerySpec) ([]T, string, error) {
+	page, err := r.db.GetPage(ctx, spec, r.newList)
+	if err != nil {
+		return nil, "", err
+	}
+	return *page.Items.(*[]T), page.Next, nil
+}
+
+// Create inserts the item, assigning it a new id if it has none
+func (r *TypedRepository[T]) Create(ctx context.Context, item T) error {
+	return r.db.Create(ctx, item)
+}
+
+// Iterate calls fn with every item matching the spec, reading
+// spec.Limit items at a time and bypassing the cache
+func (r *TypedRepository[T]) Iterate(ctx context.Context, spec QuerySpec, fn func(item T) error) error {
+	return r.db.Iterate(ctx, spec, r.newItem, func(item DbItem) error {
+		return fn(item.(T))
+	})
+}
+
+// CreateBatch inserts the items, batchSize rows per transaction,
+// and returns the rows inserted by each batch
+func (r *TypedRepository[T]) CreateBatch(ctx context.Context, items []T, batchSize int) ([]int64, error) {
+	return r.db.CreateBatch(ctx, items, batchSize)
+}
+
+// Upsert inserts the items, updating the updateColumns of the rows
+// that conflict on conflictColumns
+func (r *TypedRepository[T]) Upsert(ctx context.Context, items []T, conflictColumns []string, updateColumns []string) ([]int64, error) {
+	return r.db.Upsert(ctx, items, conflictColumns, updateColumns)
+}
+
+// Update writes the non zero fields of the item
+func (r *TypedRepository[T]) Update(ctx context.Context, item T) error {
+	return r.db.Update(ctx, item)
+}
+
+// Delete deletes the item
+func (r *TypedRepository[T]) Delete(ctx context.Context, item T) error {
+	return r.db.Delete(ctx, item)
+}
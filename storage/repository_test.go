@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// valueItem implements DbItem without being a pointer
+type valueItem struct{}
+
+func (valueItem) LoadStruct(*sql.Rows) (interface{}, error) { return nil, ErrNoLoadStruct }
+func (valueItem) SetId(string) error                        { return nil }
+func (valueItem) Id() ID                                    { return "" }
+func (valueItem) SetDeleted() error                         { return nil }
+
+func TestNewTypedRepository(t *testing.T) {
+	db, _ := newTestDB(t)
+	assert.NotNil(t, NewTypedRepository[*testItem](db))
+	assert.PanicsWithValue(t, "storage: TypedRepository model must be a pointer to a struct, got storage.DbItem", func() {
+		NewTypedRepository[DbItem](db)
+	})
+	assert.PanicsWithValue(t, "storage: TypedRepository model must be a pointer to a struct, got storage.valueItem", func() {
+		NewTypedRepository[valueItem](db)
+	})
+}
+
+func TestTypedRepository(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("get", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1))
+		repo := NewTypedRepository[*testItem](db)
+		item, err := repo.Get(ctx, "a")
+		assert.NoError(t, err)
+		assert.Equal(t, ID("a"), item.ID)
+		assert.Equal(t, "first", item.Name)
+		// the cached item is not modified through the returned one
+		item.Name = "modified"
+		item, err = repo.Get(ctx, "a")
+		assert.NoError(t, err)
+		assert.Equal(t, "first", item.Name)
+		assert.Len(t, fake.Find(`FROM "test_items"`), 1)
+	})
+	t.Run("get-not-found", func(t *testing.T) {
+		db, _ := newTestDB(t)
+		repo := NewTypedRepository[*testItem](db)
+		item, err := repo.Get(ctx, "missing")
+		assert.True(t, errors.Is(err, ErrNotFound))
+		assert.Nil(t, item)
+	})
+	t.Run("list", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2))
+		repo := NewTypedRepository[*testItem](db)
+		items, err := repo.List(ctx, QuerySpec{Filters: []Filter{Range("Score", 1, 2)}})
+		assert.NoError(t, err)
+		if assert.Len(t, items, 2) {
+			assert.Equal(t, "first", items[0].Name)
+			assert.Equal(t, "second", items[1].Name)
+		}
+		_, err = repo.List(ctx, QuerySpec{Filters: []Filter{Eq("Missing", 1)}})
+		assert.True(t, errors.Is(err, ErrInvalidQuery))
+	})
+	t.Run("list-page", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("a", "first", 1), testRow("b", "second", 2)).Times(1)
+		fake.On(`FROM "test_items"`).Returns(testColumns, testRow("c", "third", 3))
+		repo := NewTypedRepository[*testItem](db)
+		spec := QuerySpec{Limit: 2}
+		items, next, err := repo.ListPage(ctx, spec)
+		assert.NoError(t, err)
+		assert.Len(t, items, 2)
+		assert.NotEmpty(t, next)
+		spec.Cursor = next
+		items, next, err = repo.ListPage(ctx, spec)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, ID("c"), items[0].ID)
+		}
+		assert.Empty(t, next)
+		stmt := lastQuery(t, fake, "test_items")
+		assert.Contains(t, stmt.SQL, `"test_items"."id" > $1`)
+	})
+	t.Run("write", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		repo := NewTypedRepository[*testItem](db)
+		item := repo.New()
+		item.Name = "new"
+		assert.NoError(t, repo.Create(ctx, item))
+		assert.NotEmpty(t, item.ID)
+		assert.NoError(t, repo.Update(ctx, item))
+		assert.NoError(t, repo.Delete(ctx, item))
+		assert.Len(t, fake.Find(`INSERT INTO "test_items"`), 1)
+		assert.Len(t, fake.Find(`UPDATE "test_items"`), 2)
+	})
+}
@@ -35,6 +35,7 @@ type DbItem interface {
 
 // SQLItemParser interface implements a custom sql.Rows to custom Struct data loader
 // instead of relying on GORM reflection methods
+// LoadStruct is called once per row, after rows.Next, and returns the loaded item.
 type SQLItemParser interface {
 	LoadStruct(rows *sql.Rows) (interface{}, error)
 }
@@ -0,0 +1,358 @@
+// Package storagetest runs gorm against a scripted in-memory database, so
+// that the storage package can be tested without a database server. Every
+// statement is recorded, and answered by the first rule whose query it
+// contains.
+package storagetest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DefaultAffected is the number of rows affected by the statements without rule
+const DefaultAffected = 1
+
+var (
+	errClosed = errors.New("storagetest: connection is closed")
+	errDone   = errors.New("storagetest: transaction is already done")
+)
+
+// Statement is a statement received by the database. Transactions are
+// recorded as BEGIN, with the isolation level and access mode, COMMIT
+// and ROLLBACK statements.
+type Statement struct {
+	SQL  string
+	Args []driver.Value
+}
+
+// Rule answers the statements containing its query
+type Rule struct {
+	query    string
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+	err      error
+	reply    func(args []driver.Value) ([][]interface{}, error)
+	// times is the number of statements answered before the rule
+	// expires, or zero for no limit
+	times int
+	used  int
+}
+
+// Returns answers the queries with given rows
+func (r *Rule) Returns(columns []string, rows ...[]interface{}) *Rule {
+	r.columns = columns
+	r.rows = values(rows)
+	return r
+}
+
+// Replies answers the queries with the rows returned by f for the
+// arguments of the statement. Rows have the columns given to Returns.
+func (r *Rule) Replies(f func(args []driver.Value) ([][]interface{}, error)) *Rule {
+	r.reply = f
+	return r
+}
+
+// Affects sets the rows affected by the statements
+func (r *Rule) Affects(n int64) *Rule {
+	r.affected = n
+	return r
+}
+
+// Fails answers the statements with given error
+func (r *Rule) Fails(err error) *Rule {
+	r.err = err
+	return r
+}
+
+// Times expires the rule after answering n statements
+func (r *Rule) Times(n int) *Rule {
+	r.times = n
+	return r
+}
+
+// Database is a scripted database. The zero value is not usable, use New.
+type Database struct {
+	mu         sync.Mutex
+	rules      []*Rule
+	statements []Statement
+}
+
+// New returns an empty database
+func New() *Database {
+	return &Database{}
+}
+
+// Open returns a gorm connection to the database. Logging is disabled
+// unless config sets a logger.
+func (d *Database) Open(config *gorm.Config) (*gorm.DB, error) {
+	if config == nil {
+		config = &gorm.Config{}
+	}
+	if config.Logger == nil {
+		config.Logger = logger.Discard
+	}
+	return gorm.Open(d.Dialector(), config)
+}
+
+// Dialector returns a gorm dialector of the database, which generates
+// the same SQL as the PostgreSQL one
+func (d *Database) Dialector() gorm.Dialector {
+	return &dialector{db: d}
+}
+
+// On adds a rule for the statements containing query. Rules are checked
+// in the order they were added. By default, statements affect
+// DefaultAffected rows and queries return no rows.
+func (d *Database) On(query string) *Rule {
+	r := &Rule{query: query, affected: DefaultAffected}
+	d.mu.Lock()
+	d.rules = append(d.rules, r)
+	d.mu.Unlock()
+	return r
+}
+
+// Statements returns the statements received, in order
+func (d *Database) Statements() []Statement {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Statement(nil), d.statements...)
+}
+
+// Find returns the statements received containing query, in order
+func (d *Database) Find(query string) []Statement {
+	var found []Statement
+	for _, s := range d.Statements() {
+		if strings.Contains(s.SQL, query) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// Reset forgets the statements received. Rules are kept.
+func (d *Database) Reset() {
+	d.mu.Lock()
+	d.statements = nil
+	d.mu.Unlock()
+}
+
+// answer records a statement and returns its rows, affected rows and error
+func (d *Database) answer(query string, args []driver.NamedValue) (*rows, int64, error) {
+	stmt := Statement{SQL: query}
+	for _, arg := range args {
+		stmt.Args = append(stmt.Args, arg.Value)
+	}
+	d.mu.Lock()
+	d.statements = append(d.statements, stmt)
+	var rule *Rule
+	for _, r := range d.rules {
+		if (r.times == 0 || r.used < r.times) && strings.Contains(query, r.query) {
+			r.used++
+			rule = r
+			break
+		}
+	}
+	d.mu.Unlock()
+	if rule == nil {
+		return &rows{}, DefaultAffected, nil
+	}
+	if rule.err != nil {
+		return nil, 0, rule.err
+	}
+	data := rule.rows
+	if rule.reply != nil {
+		replied, err := rule.reply(stmt.Args)
+		if err != nil {
+			return nil, 0, err
+		}
+		data = values(replied)
+	}
+	return &rows{columns: rule.columns, data: data}, rule.affected, nil
+}
+
+func values(rows [][]interface{}) [][]driver.Value {
+	data := make([][]driver.Value, len(rows))
+	for i, row := range rows {
+		data[i] = make([]driver.Value, len(row))
+		for j, v := range row {
+			data[i][j] = v
+		}
+	}
+	return data
+}
+
+// connector opens the connections of a database
+type connector struct {
+	db *Database
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{db: c.db}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return c
+}
+
+func (c connector) Open(string) (driver.Conn, error) {
+	return &conn{db: c.db}, nil
+}
+
+// conn is a connection to a database
+type conn struct {
+	db     *Database
+	closed bool
+}
+
+var (
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.ConnPrepareContext = (*conn)(nil)
+)
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	if c.closed {
+		return nil, errClosed
+	}
+	return &stmt{conn: c, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx records the transaction as a PostgreSQL BEGIN statement
+func (c *conn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.closed {
+		return nil, errClosed
+	}
+	query := "BEGIN"
+	if level := sql.IsolationLevel(opts.Isolation); level != sql.LevelDefault {
+		query += " ISOLATION LEVEL " + strings.ToUpper(level.String())
+	}
+	if opts.ReadOnly {
+		query += " READ ONLY"
+	}
+	if _, _, err := c.db.answer(query, nil); err != nil {
+		return nil, err
+	}
+	return &tx{conn: c}, nil
+}
+
+func (c *conn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.closed {
+		return nil, errClosed
+	}
+	_, affected, err := c.db.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func (c *conn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.closed {
+		return nil, errClosed
+	}
+	r, _, err := c.db.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// stmt is a prepared statement, only used by clients that prepare them explicitly
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	nv := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		nv[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return nv
+}
+
+// tx is a transaction of a connection
+type tx struct {
+	conn *conn
+	done bool
+}
+
+func (t *tx) Commit() error {
+	return t.end("COMMIT")
+}
+
+func (t *tx) Rollback() error {
+	return t.end("ROLLBACK")
+}
+
+func (t *tx) end(query string) error {
+	if t.done {
+		return errDone
+	}
+	t.done = true
+	_, _, err := t.conn.db.answer(query, nil)
+	return err
+}
+
+// rows are the rows returned by a query
+type rows struct {
+	columns []string
+	data    [][]driver.Value
+	next    int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.data) {
+		return io.EOF
+	}
+	copy(dest, r.data[r.next])
+	r.next++
+	return nil
+}
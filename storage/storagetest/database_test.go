@@ -0,0 +1,107 @@
+package storagetest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type user struct {
+	ID   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name string
+}
+
+func TestDatabase(t *testing.T) {
+	t.Run("rules", func(t *testing.T) {
+		db := New()
+		gdb, err := db.Open(nil)
+		assert.NoError(t, err)
+		db.On(`FROM "users"`).Returns([]string{"id", "name"}, []interface{}{int64(1), "first"}).Times(1)
+		db.On(`FROM "users"`).Returns([]string{"id", "name"}, []interface{}{int64(2), "second"})
+		var users []user
+		assert.NoError(t, gdb.Find(&users).Error)
+		assert.Equal(t, []user{{ID: 1, Name: "first"}}, users)
+		assert.NoError(t, gdb.Find(&users).Error)
+		assert.Equal(t, []user{{ID: 2, Name: "second"}}, users)
+		found := db.Find(`FROM "users"`)
+		if assert.Len(t, found, 2) {
+			assert.Equal(t, `SELECT * FROM "users"`, found[0].SQL)
+		}
+	})
+	t.Run("replies", func(t *testing.T) {
+		db := New()
+		gdb, err := db.Open(nil)
+		assert.NoError(t, err)
+		db.On(`FROM "users"`).Returns([]string{"id", "name"}).Replies(func(args []driver.Value) ([][]interface{}, error) {
+			return [][]interface{}{{args[0], "replied"}}, nil
+		})
+		var u user
+		assert.NoError(t, gdb.First(&u, "id = ?", 7).Error)
+		assert.Equal(t, user{ID: 7, Name: "replied"}, u)
+		found := db.Find(`FROM "users"`)
+		if assert.Len(t, found, 1) {
+			assert.Equal(t, `SELECT * FROM "users" WHERE id = $1 ORDER BY "users"."id" LIMIT 1`, found[0].SQL)
+			assert.Equal(t, []driver.Value{int64(7)}, found[0].Args)
+		}
+	})
+	t.Run("affected", func(t *testing.T) {
+		db := New()
+		gdb, err := db.Open(&gorm.Config{SkipDefaultTransaction: true})
+		assert.NoError(t, err)
+		tx := gdb.Model(&user{ID: 1}).Update("name", "x")
+		assert.NoError(t, tx.Error)
+		assert.Equal(t, int64(DefaultAffected), tx.RowsAffected)
+		db.On(`UPDATE "users"`).Affects(0)
+		tx = gdb.Model(&user{ID: 1}).Update("name", "x")
+		assert.NoError(t, tx.Error)
+		assert.Equal(t, int64(0), tx.RowsAffected)
+	})
+	t.Run("transactions", func(t *testing.T) {
+		db := New()
+		gdb, err := db.Open(&gorm.Config{SkipDefaultTransaction: true})
+		assert.NoError(t, err)
+		failure := errors.New("commit failed")
+		db.On("COMMIT").Fails(failure).Times(1)
+		err = gdb.Transaction(func(tx *gorm.DB) error {
+			return tx.Create(&user{ID: 1}).Error
+		}, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true})
+		assert.Equal(t, failure, err)
+		err = gdb.Transaction(func(tx *gorm.DB) error {
+			return tx.Transaction(func(tx *gorm.DB) error {
+				return errors.New("rolled back")
+			})
+		})
+		assert.Error(t, err)
+		var queries []string
+		for _, s := range db.Statements() {
+			// savepoint names are generated
+			queries = append(queries, strings.Split(s.SQL, " sp")[0])
+		}
+		assert.Equal(t, []string{
+			"BEGIN ISOLATION LEVEL SERIALIZABLE READ ONLY",
+			`INSERT INTO "users" ("id","name") VALUES ($1,$2)`,
+			"COMMIT",
+			"BEGIN",
+			"SAVEPOINT",
+			"ROLLBACK TO SAVEPOINT",
+			"ROLLBACK",
+		}, queries)
+		db.Reset()
+		assert.Empty(t, db.Statements())
+	})
+	t.Run("errors", func(t *testing.T) {
+		db := New()
+		gdb, err := db.Open(nil)
+		assert.NoError(t, err)
+		failure := errors.New("boom")
+		db.On("SELECT").Fails(failure)
+		var u user
+		assert.Equal(t, failure, gdb.WithContext(context.Background()).First(&u).Error)
+	})
+}
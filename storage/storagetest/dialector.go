@@ -0,0 +1,106 @@
+package storagetest
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/migrator"
+	"gorm.io/gorm/schema"
+)
+
+// numericPlaceholder matches the bind variables of the statements
+var numericPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// dialector generates PostgreSQL statements for a scripted database
+type dialector struct {
+	db *Database
+}
+
+var (
+	_ gorm.Dialector                     = (*dialector)(nil)
+	_ gorm.SavePointerDialectorInterface = (*dialector)(nil)
+)
+
+func (d *dialector) Name() string {
+	return "postgres"
+}
+
+func (d *dialector) Initialize(db *gorm.DB) error {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{
+		CreateClauses: []string{"INSERT", "VALUES", "ON CONFLICT", "RETURNING"},
+		UpdateClauses: []string{"UPDATE", "SET", "WHERE", "RETURNING"},
+		DeleteClauses: []string{"DELETE", "FROM", "WHERE", "RETURNING"},
+	})
+	db.ConnPool = sql.OpenDB(connector{db: d.db})
+	return nil
+}
+
+func (d *dialector) Migrator(db *gorm.DB) gorm.Migrator {
+	return migrator.Migrator{Config: migrator.Config{
+		DB:                          db,
+		Dialector:                   d,
+		CreateIndexAfterCreateTable: true,
+	}}
+}
+
+func (d *dialector) DataTypeOf(field *schema.Field) string {
+	switch field.DataType {
+	case schema.Bool:
+		return "boolean"
+	case schema.Int, schema.Uint:
+		if field.AutoIncrement {
+			return "bigserial"
+		}
+		return "bigint"
+	case schema.Float:
+		return "decimal"
+	case schema.String:
+		if field.Size > 0 {
+			return "varchar(" + strconv.Itoa(field.Size) + ")"
+		}
+		return "text"
+	case schema.Time:
+		return "timestamptz"
+	case schema.Bytes:
+		return "bytea"
+	}
+	return string(field.DataType)
+}
+
+func (d *dialector) DefaultValueOf(*schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+
+func (d *dialector) BindVarTo(writer clause.Writer, stmt *gorm.Statement, _ interface{}) {
+	_ = writer.WriteByte('$')
+	_, _ = writer.WriteString(strconv.Itoa(len(stmt.Vars)))
+}
+
+func (d *dialector) QuoteTo(writer clause.Writer, str string) {
+	for i, part := range strings.Split(str, ".") {
+		if i > 0 {
+			_ = writer.WriteByte('.')
+		}
+		_ = writer.WriteByte('"')
+		_, _ = writer.WriteString(strings.ReplaceAll(part, `"`, `""`))
+		_ = writer.WriteByte('"')
+	}
+}
+
+func (d *dialector) Explain(sql string, vars ...interface{}) string {
+	return logger.ExplainSQL(sql, numericPlaceholder, `'`, vars...)
+}
+
+func (d *dialector) SavePoint(tx *gorm.DB, name string) error {
+	return tx.Exec("SAVEPOINT " + name).Error
+}
+
+func (d *dialector) RollbackTo(tx *gorm.DB, name string) error {
+	return tx.Exec("ROLLBACK TO SAVEPOINT " + name).Error
+}
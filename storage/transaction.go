@@ -0,0 +1,119 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Transaction retry defaults
+const (
+	DefaultTxRetries    = 3
+	DefaultTxMinBackoff = 10 * time.Millisecond
+	DefaultTxMaxBackoff = time.Second
+	// NoRetry disables the retries of a transaction
+	NoRetry = -1
+)
+
+// TxOptions configures a transaction run with AsTransactionWithOptions
+type TxOptions struct {
+	// Isolation is the isolation level. The zero value is the database default.
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// Timeout bounds the whole run, retries included. Zero means no timeout.
+	Timeout time.Duration
+	// Retries is the number of times the transaction is run again after
+	// a serialization failure or a deadlock. Zero means DefaultTxRetries,
+	// use NoRetry to run the transaction only once.
+	Retries int
+	// MinBackoff and MaxBackoff bound the jittered exponential wait between runs
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (o TxOptions) withDefaults() TxOptions {
+	switch {
+	case o.Retries == 0:
+		o.Retries = DefaultTxRetries
+	case o.Retries < 0:
+		o.Retries = NoRetry
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = DefaultTxMinBackoff
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = DefaultTxMaxBackoff
+		if o.MaxBackoff < o.MinBackoff {
+			o.MaxBackoff = o.MinBackoff
+		}
+	}
+	return o
+}
+
+// backoff returns a random wait of up to the exponential backoff of given retry
+func (o TxOptions) backoff(retry int) time.Duration {
+	d := o.MinBackoff
+	for i := 1; i < retry && d < o.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// retryable returns true for the errors that may not happen again when
+// the transaction is run again
+func retryable(err error) bool {
+	return errors.Is(err, ErrSerialization) || errors.Is(err, ErrDeadlock)
+}
+
+// AsTransactionWithOptions runs f in a transaction with given options. The
+// transaction is committed if f returns nil, and rolled back otherwise.
+// Transactions failing with ErrSerialization or ErrDeadlock are run again up
+// to opts.Retries times, DefaultTxRetries unless set, or never with NoRetry,
+// so f must be safe to re-run: it must not have side effects outside of the
+// transaction, nor depend on state left by a previous run.
+// The cached reads affected by the writes of the transaction are invalidated after commit.
+func (s *ORMDatabase) AsTransactionWithOptions(ctx context.Context, opts TxOptions, f func(tx *gorm.DB) error) error {
+	opts = opts.withDefaults()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	txOpts := &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly}
+	for retry := 0; ; retry++ {
+		inv := s.deferred()
+		err := s.withInvalidator(inv).WithContext(ctx).Transaction(f, txOpts)
+		if err == nil {
+			inv.flush()
+			return nil
+		}
+		err = TranslateError(err)
+		if retry >= opts.Retries || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return TranslateError(ctx.Err())
+		case <-time.After(opts.backoff(retry + 1)):
+		}
+	}
+}
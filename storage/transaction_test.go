@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestTxOptions(t *testing.T) {
+	opts := TxOptions{}.withDefaults()
+	assert.Equal(t, TxOptions{Retries: DefaultTxRetries, MinBackoff: DefaultTxMinBackoff, MaxBackoff: DefaultTxMaxBackoff}, opts)
+	opts = TxOptions{Retries: NoRetry, MinBackoff: 2 * time.Second}.withDefaults()
+	// negative retries are kept, and disable them
+	assert.Equal(t, NoRetry, opts.Retries)
+	// the maximum backoff is never below the minimum
+	assert.Equal(t, 2*time.Second, opts.MaxBackoff)
+
+	opts = TxOptions{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+	bounds := map[int]time.Duration{
+		1:  time.Millisecond,
+		2:  2 * time.Millisecond,
+		3:  4 * time.Millisecond,
+		4:  5 * time.Millisecond,
+		64: 5 * time.Millisecond,
+	}
+	for retry, max := range bounds {
+		for i := 0; i < 100; i++ {
+			d := opts.backoff(retry)
+			assert.True(t, d > 0 && d <= max, "retry %d waited %s", retry, d)
+		}
+	}
+}
+
+func TestAsTransactionWithOptions(t *testing.T) {
+	ctx := context.Background()
+	serialization := &pgconn.PgError{Code: "40001"}
+	fast := TxOptions{MinBackoff: time.Microsecond, MaxBackoff: time.Microsecond}
+	create := func(runs *int) func(tx *gorm.DB) error {
+		return func(tx *gorm.DB) error {
+			*runs++
+			return tx.Create(&testItem{}).Error
+		}
+	}
+
+	t.Run("options", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		var runs int
+		opts := TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true}
+		assert.NoError(t, db.AsTransactionWithOptions(ctx, opts, create(&runs)))
+		assert.Equal(t, 1, runs)
+		statements := fake.Statements()
+		assert.Equal(t, "BEGIN ISOLATION LEVEL SERIALIZABLE READ ONLY", statements[0].SQL)
+		assert.Equal(t, "COMMIT", statements[len(statements)-1].SQL)
+	})
+	t.Run("retried", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("COMMIT").Fails(serialization).Times(2)
+		var runs int
+		assert.NoError(t, db.AsTransactionWithOptions(ctx, fast, create(&runs)))
+		assert.Equal(t, 3, runs)
+		assert.Len(t, fake.Find("BEGIN"), 3)
+		assert.Len(t, fake.Find("COMMIT"), 3)
+	})
+	t.Run("deadlock", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`INSERT INTO "test_items"`).Fails(&pgconn.PgError{Code: "40P01"}).Times(1)
+		var runs int
+		assert.NoError(t, db.AsTransactionWithOptions(ctx, fast, create(&runs)))
+		assert.Equal(t, 2, runs)
+		assert.Len(t, fake.Find("ROLLBACK"), 1)
+	})
+	t.Run("exhausted", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("COMMIT").Fails(serialization)
+		var runs int
+		err := db.AsTransactionWithOptions(ctx, fast, create(&runs))
+		assert.True(t, errors.Is(err, ErrSerialization))
+		assert.Equal(t, DefaultTxRetries+1, runs)
+
+		runs = 0
+		opts := fast
+		opts.Retries = 1
+		err = db.AsTransactionWithOptions(ctx, opts, create(&runs))
+		assert.True(t, errors.Is(err, ErrSerialization))
+		assert.Equal(t, 2, runs)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("COMMIT").Fails(serialization)
+		var runs int
+		opts := fast
+		opts.Retries = NoRetry
+		err := db.AsTransactionWithOptions(ctx, opts, create(&runs))
+		assert.True(t, errors.Is(err, ErrSerialization))
+		assert.Equal(t, 1, runs)
+	})
+	t.Run("not-retryable", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		failure := errors.New("invalid item")
+		var runs int
+		err := db.AsTransactionWithOptions(ctx, fast, func(tx *gorm.DB) error {
+			runs++
+			return failure
+		})
+		assert.Equal(t, failure, err)
+		assert.Equal(t, 1, runs)
+		assert.Equal(t, []string{"BEGIN", "ROLLBACK"}, queries(fake))
+
+		fake.Reset()
+		fake.On(`INSERT INTO "test_items"`).Fails(&pgconn.PgError{Code: "23505"})
+		runs = 0
+		err = db.AsTransactionWithOptions(ctx, fast, create(&runs))
+		assert.True(t, errors.Is(err, ErrDuplicate))
+		assert.Equal(t, 1, runs)
+	})
+	t.Run("timeout", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("COMMIT").Fails(serialization)
+		var runs int
+		opts := TxOptions{Timeout: 20 * time.Millisecond, MinBackoff: time.Hour}
+		start := time.Now()
+		err := db.AsTransactionWithOptions(ctx, opts, create(&runs))
+		assert.True(t, errors.Is(err, ErrTimeout))
+		assert.Equal(t, 1, runs)
+		// the backoff is interrupted by the timeout
+		assert.Less(t, time.Since(start), time.Minute)
+	})
+	t.Run("invalidated-after-commit", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On("COMMIT").Fails(serialization).Times(1)
+		key := itemKey("test_items", "a")
+		db.Cache.Set(key, &testItem{}, 0)
+		var cachedDuringRuns []bool
+		err := db.AsTransactionWithOptions(ctx, fast, func(tx *gorm.DB) error {
+			cachedDuringRuns = append(cachedDuringRuns, cached(db, key))
+			return tx.Save(&testItem{Item: Item{ID: "a"}}).Error
+		})
+		assert.NoError(t, err)
+		// the failed run does not invalidate, the committed one does
+		assert.Equal(t, []bool{true, true}, cachedDuringRuns)
+		assert.False(t, cached(db, key))
+	})
+}
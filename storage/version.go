@@ -0,0 +1,111 @@
+//
+// Copyright zerjioang. 2021 All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrConflict is returned when updating an item modified by someone else
+	// since it was read. The returned error is a *ConflictError.
+	ErrConflict = errors.New("version conflict")
+)
+
+// ConflictError is returned by stale writes of versioned items
+type ConflictError struct {
+	Table string
+	ID    ID
+	// Expected is the version the write was based on
+	Expected int64
+	// Current is the version stored in the database
+	Current int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s %s is at version %d, expected %d", ErrConflict, e.Table, e.ID, e.Current, e.Expected)
+}
+
+// Is reports whether target is ErrConflict
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// VersionedItem is implemented by the models with a version column, such as
+// the models embedding Item, whose writes use optimistic locking
+type VersionedItem interface {
+	GetVersion() int64
+	SetVersion(v int64)
+}
+
+// initVersion sets the initial version of new versioned items
+func initVersion(obj DbItem) {
+	if v, ok := obj.(VersionedItem); ok && v.GetVersion() == 0 {
+		v.SetVersion(1)
+	}
+}
+
+// updates writes the non zero fields of obj using given session. Versioned
+// items are only written if the row is at the same version, which is then
+// incremented. Items without version are written unconditionally.
+func (s *ORMDatabase) updates(db *gorm.DB, obj DbItem) error {
+	versioned, ok := obj.(VersionedItem)
+	if !ok || versioned.GetVersion() == 0 {
+		tx := db.Model(obj).Updates(obj)
+		return CheckResult(tx, false)
+	}
+	sch, err := s.schemaOf(obj)
+	if err != nil {
+		return err
+	}
+	field, err := lookup(sch, "Version")
+	if err != nil {
+		return err
+	}
+	expected := versioned.GetVersion()
+	versioned.SetVersion(expected + 1)
+	tx := db.Model(obj).
+		Where(clause.Eq{Column: column(field), Value: expected}).
+		Updates(obj)
+	if err := CheckResult(tx, false); err != nil {
+		versioned.SetVersion(expected)
+		return err
+	}
+	if tx.RowsAffected > 0 {
+		return nil
+	}
+	versioned.SetVersion(expected)
+	// the row was deleted or updated by someone else: read its current version
+	read := db.Session(&gorm.Session{NewDB: true}).
+		Table(sch.Table).Select(field.DBName).
+		Where(map[string]interface{}{sch.PrioritizedPrimaryField.DBName: obj.Id()})
+	if deleted := sch.LookUpField("DeletedAt"); deleted != nil && deleted.DBName != "" {
+		// soft deleted rows are reported as not found
+		read = read.Where(clause.Eq{Column: deleted.DBName, Value: nil})
+	}
+	var current int64
+	tx = read.Scan(&current)
+	if err := CheckResult(tx, false); err != nil {
+		return err
+	}
+	if tx.RowsAffected == 0 {
+		return &DBError{Kind: ErrNotFound, Table: sch.Table}
+	}
+	// drop the stale cached reads of the item
+	s.invalidate(sch.Table, []string{itemKey(sch.Table, obj.Id())}, false)
+	return &ConflictError{Table: sch.Table, ID: obj.Id(), Expected: expected, Current: current}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// versionedItem is a model stored in the versioned_items table
+type versionedItem struct {
+	Item
+	Name string
+}
+
+// atVersion returns the item a, read at given version
+func atVersion(version int64) Item {
+	return Item{ID: "a", ItemMetadata: ItemMetadata{Version: version}}
+}
+
+func TestVersioned(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("create", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		item := &versionedItem{Name: "new"}
+		assert.NoError(t, db.Create(ctx, item))
+		assert.Equal(t, int64(1), item.Version)
+		found := fake.Find(`INSERT INTO "versioned_items"`)
+		if assert.Len(t, found, 1) {
+			assert.Contains(t, found[0].Args, int64(1))
+		}
+	})
+	t.Run("update", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		item := &versionedItem{Item: atVersion(3), Name: "updated"}
+		assert.NoError(t, db.Update(ctx, item))
+		assert.Equal(t, int64(4), item.Version)
+		found := fake.Find(`UPDATE "versioned_items"`)
+		if assert.Len(t, found, 1) {
+			assert.Contains(t, found[0].SQL, `"versioned_items"."version" = $`)
+			args := found[0].Args
+			// the new version is set, conditioned on the one read
+			assert.Contains(t, args, int64(4))
+			assert.Equal(t, []driver.Value{int64(3), "a"}, args[len(args)-2:])
+		}
+	})
+	t.Run("conflict", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`FROM "versioned_items"`).Returns([]string{"id", "version", "name"}, []interface{}{"a", int64(3), "cached"}).Times(1)
+		fake.On(`UPDATE "versioned_items"`).Affects(0)
+		fake.On(`SELECT version FROM "versioned_items"`).Returns([]string{"version"}, []interface{}{int64(5)})
+		_, err := db.ReadByKey("", ctx, func() interface{} { return &versionedItem{} }, "a")
+		assert.NoError(t, err)
+		assert.True(t, cached(db, itemKey("versioned_items", "a")))
+
+		item := &versionedItem{Item: atVersion(3), Name: "stale"}
+		err = db.Update(ctx, item)
+		assert.True(t, errors.Is(err, ErrConflict))
+		var conflict *ConflictError
+		if assert.True(t, errors.As(err, &conflict)) {
+			assert.Equal(t, &ConflictError{Table: "versioned_items", ID: "a", Expected: 3, Current: 5}, conflict)
+		}
+		assert.Equal(t, "version conflict: versioned_items a is at version 5, expected 3", err.Error())
+		// the item keeps the version it was read with
+		assert.Equal(t, int64(3), item.Version)
+		// the stale cached item is dropped
+		assert.False(t, cached(db, itemKey("versioned_items", "a")))
+		found := fake.Find(`SELECT version FROM "versioned_items"`)
+		if assert.Len(t, found, 1) {
+			assert.Contains(t, found[0].SQL, `"deleted_at" IS NULL`)
+		}
+	})
+	t.Run("not-found", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`UPDATE "versioned_items"`).Affects(0)
+		item := &versionedItem{Item: atVersion(3)}
+		err := db.SoftDelete(ctx, item)
+		assert.True(t, errors.Is(err, ErrNotFound))
+		assert.False(t, errors.Is(err, ErrConflict))
+		assert.Equal(t, int64(3), item.Version)
+	})
+	t.Run("failed", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`UPDATE "versioned_items"`).Fails(errors.New("connection reset"))
+		item := &versionedItem{Item: atVersion(3)}
+		assert.Error(t, db.Update(ctx, item))
+		assert.Equal(t, int64(3), item.Version)
+		assert.Empty(t, fake.Find(`SELECT version`))
+	})
+	t.Run("without-version", func(t *testing.T) {
+		db, fake := newTestDB(t)
+		fake.On(`UPDATE "test_items"`).Affects(0)
+		// rows affected are not checked for items without version
+		assert.NoError(t, db.Update(ctx, &testItem{Item: Item{ID: "a"}, Name: "updated"}))
+		found := fake.Find(`UPDATE "test_items"`)
+		if assert.Len(t, found, 1) {
+			assert.NotContains(t, found[0].SQL, "version")
+		}
+	})
+}